@@ -0,0 +1,269 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	utils "github.com/benni347/messengerutils"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// amqpTransport is the Transport on top of RabbitMQ, see topology.go
+// for how rooms and inboxes map to exchanges and queues.
+type amqpTransport struct {
+	manager *connectionManager
+
+	mu sync.Mutex
+	// declared holds the members whose queues were bound to the room
+	// on the current connection
+	declared map[string]string
+	// queue is the queue of the running subscription
+	queue string
+}
+
+func newAmqpTransport(endpoints []amqpEndpoint, randomize bool, verbose bool) *amqpTransport {
+	t := &amqpTransport{
+		manager:  newConnectionManager(endpoints, randomize, verbose),
+		declared: make(map[string]string),
+	}
+	// the broker may have lost non-durable state while we were away
+	t.manager.connected.Subscribe(func(interface{}) {
+		t.mu.Lock()
+		t.declared = make(map[string]string)
+		t.mu.Unlock()
+	})
+	return t
+}
+
+func (t *amqpTransport) Connect() {
+	t.manager.start()
+}
+
+func (t *amqpTransport) Close() {
+	t.manager.close()
+}
+
+func (t *amqpTransport) Status() BrokerStatus {
+	return t.manager.status()
+}
+
+func (t *amqpTransport) OnStatus(f func(BrokerStatus)) {
+	notify := func(interface{}) { f(t.Status()) }
+	t.manager.connected.Subscribe(notify)
+	t.manager.disconnected.Subscribe(notify)
+}
+
+// Publish publishes on the shared channel, which is in confirm mode.
+func (t *amqpTransport) Publish(msg Message, members []string) (<-chan error, error) {
+	channel, err := t.manager.Channel()
+	if err != nil {
+		return nil, err
+	}
+	if err := t.declareRoute(channel, msg.ChatRoomId, members); err != nil {
+		return nil, err
+	}
+	publishing, err := msg.publishing()
+	if err != nil {
+		return nil, err
+	}
+	confirmation, err := channel.PublishWithDeferredConfirm(
+		chatExchange,
+		roomRoutingKey(msg.ChatRoomId),
+		false,
+		false,
+		publishing,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		<-confirmation.Done()
+		if confirmation.Acked() {
+			done <- nil
+		} else {
+			done <- errNotConfirmed
+		}
+	}()
+	return done, nil
+}
+
+// declareRoute declares the exchange and, the first time the room is
+// used on this connection or after its members changed, the queues of
+// all its members.
+func (t *amqpTransport) declareRoute(ch *amqp.Channel, roomId string, members []string) error {
+	if err := declareChatExchange(ch); err != nil {
+		return err
+	}
+	sorted := append([]string{}, members...)
+	sort.Strings(sorted)
+	key := strings.Join(sorted, ",")
+
+	t.mu.Lock()
+	declared, ok := t.declared[roomId]
+	t.mu.Unlock()
+	if ok && declared == key {
+		return nil
+	}
+	if err := declareMembers(ch, roomId, members); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.declared[roomId] = key
+	t.mu.Unlock()
+	return nil
+}
+
+func (t *amqpTransport) Subscribe(userId string, rooms func() []string, handle func(Message)) func() {
+	stop := make(chan struct{})
+	go t.consume(userId, rooms, handle, stop)
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(stop) })
+	}
+}
+
+// consume reads deliveries from the queue of the user until stop is
+// closed, subscribing again whenever the channel or the connection is lost.
+func (t *amqpTransport) consume(userId string, rooms func() []string, handle func(Message), stop <-chan struct{}) {
+	delay := reconnectMinDelay
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		ch, queueName, deliveries, err := t.openConsumer(userId, rooms())
+		if err != nil {
+			utils.PrintError("Failed to consume messages", err)
+			select {
+			case <-stop:
+				return
+			case <-time.After(delay):
+			}
+			delay *= 2
+			if delay > reconnectMaxDelay {
+				delay = reconnectMaxDelay
+			}
+			continue
+		}
+		delay = reconnectMinDelay
+
+		t.mu.Lock()
+		t.queue = queueName
+		t.mu.Unlock()
+
+		closed := dispatch(deliveries, handle, stop)
+		t.mu.Lock()
+		if t.queue == queueName {
+			t.queue = ""
+		}
+		t.mu.Unlock()
+		if !closed {
+			if err := ch.Close(); err != nil {
+				utils.PrintError("closing channel", err)
+			}
+			return
+		}
+	}
+}
+
+// openConsumer declares the queue of the user, binds it to every
+// room and starts consuming from it.
+func (t *amqpTransport) openConsumer(userId string, rooms []string) (*amqp.Channel, string, <-chan amqp.Delivery, error) {
+	ch, err := t.manager.NewChannel()
+	if err != nil {
+		return nil, "", nil, err
+	}
+	queueName, err := declareInbox(ch, userId, rooms)
+	if err != nil {
+		_ = ch.Close()
+		return nil, "", nil, err
+	}
+	deliveries, err := ch.Consume(
+		queueName,
+		"",
+		false,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		_ = ch.Close()
+		return nil, "", nil, err
+	}
+	return ch, queueName, deliveries, nil
+}
+
+// dispatch hands every delivery to handle. It returns false when stop
+// was closed and true when the delivery channel was closed.
+func dispatch(deliveries <-chan amqp.Delivery, handle func(Message), stop <-chan struct{}) bool {
+	for {
+		select {
+		case <-stop:
+			return false
+		case d, ok := <-deliveries:
+			if !ok {
+				return true
+			}
+			message, err := decodeMessage(d.Body)
+			if err != nil {
+				utils.PrintError("Dropping a message", err)
+				if err := d.Reject(false); err != nil {
+					utils.PrintError("Failed to reject a message", err)
+				}
+				continue
+			}
+			handle(message)
+			if err := d.Ack(false); err != nil {
+				utils.PrintError("Failed to acknowledge a message", err)
+			}
+		}
+	}
+}
+
+// Join binds the queue of the running subscription to the room.
+// If no subscription is running yet, the room is bound once it starts.
+func (t *amqpTransport) Join(roomId string) error {
+	t.mu.Lock()
+	queueName := t.queue
+	t.mu.Unlock()
+	if queueName == "" {
+		return nil
+	}
+	ch, err := t.manager.NewChannel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	return bindRoom(ch, queueName, roomId)
+}
+
+// Leave stops routing the room to the queue of the user.
+func (t *amqpTransport) Leave(userId, roomId string) error {
+	queueName := userQueueName(userId)
+	if userId == "" {
+		t.mu.Lock()
+		queueName = t.queue
+		t.mu.Unlock()
+		if queueName == "" {
+			return nil
+		}
+	}
+	ch, err := t.manager.NewChannel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	t.mu.Lock()
+	delete(t.declared, roomId)
+	t.mu.Unlock()
+	return ch.QueueUnbind(queueName, roomRoutingKey(roomId), chatExchange, nil)
+}
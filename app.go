@@ -5,190 +5,238 @@ import (
 	"fmt"
 	"math"
 	"math/rand"
-	"net/url"
-	"os"
-	"strings"
+	"sync"
 	"time"
 
 	utils "github.com/benni347/messengerutils"
-	"github.com/joho/godotenv"
-	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/wailsapp/wails/v2/pkg/runtime"
 )
 
 // App struct
 type App struct {
-	ctx     context.Context
-	verbose bool
-	config  Config
-	user    User
+	ctx context.Context
+	// events receives the events instead of the frontend, if set
+	events    func(eventName string, data interface{})
+	verbose   bool
+	config    Config
+	user      User
+	transport Transport
+	mu        sync.Mutex
+
+	deliveries *deliveryTracker
+	outbox     *outbox
+	rooms      *roomDirectory
+	supabase   *supabaseClient
+	tokens     *tokenVerifier
+	auth       *authClient
+	session    *authSession
+	oauth      *oauthFlow
+	pendingMfa *pendingMfa
+	enrollment *pendingEnrollment
+	store      *authStore
+	refresher  *time.Timer
+	refreshMu  sync.Mutex
+	identity   *identity
+	trust      *trustStore
+	contacts   map[string]cachedContactKeys
+	refetched  map[string]time.Time
+	prekeys    *prekeyStore
+	sessions   *sessionStore
+
+	configProblems []ConfigProblem
 }
 
-// NewApp creates a new App application struct
-func NewApp() *App {
-	return &App{}
+// NewApp creates a new App application struct with the loaded
+// config and the problems found in it
+func NewApp(config Config, problems []ConfigProblem) *App {
+	a := &App{config: config, configProblems: problems}
+	a.deliveries = newDeliveryTracker(a.emitDeliveryStatus)
+	a.outbox = newOutbox(a.publish)
+	a.rooms = newRoomDirectory()
+	a.contacts = make(map[string]cachedContactKeys)
+	a.refetched = make(map[string]time.Time)
+	a.supabase = newSupabaseClient(config.SupaBaseUrl, config.SupaBaseApiKey)
+	a.tokens = newTokenVerifier(config)
+	a.auth = newAuthClient(config.SupaBaseUrl, config.SupaBaseApiKey)
+	return a
 }
 
 // startup is called when the app starts. The context is saved
 // so we can call the runtime methods
 func (a *App) startup(ctx context.Context) {
 	a.ctx = ctx
+	a.reportConfigProblems()
+	if store, err := openAuthStore(); err != nil {
+		utils.PrintError("Failed to open the session store", err)
+	} else {
+		a.store = store
+	}
+	if !a.brokerConfigured() {
+		return
+	}
+	transport, err := newTransport(a.config, a.verbose)
+	if err != nil {
+		utils.PrintError("Invalid transport configuration", err)
+		return
+	}
+	a.transport = transport
+	a.transport.OnStatus(func(status BrokerStatus) {
+		if status.Connected {
+			a.outbox.flush()
+		}
+		a.emitBrokerStatus(status)
+	})
+	a.outbox.start()
+	a.transport.Connect()
+	a.startConsuming()
 }
 
-type User struct {
-	queueName string
-	ch        *amqp.Channel
-}
-
-type Config struct {
-	AppId            string `json:"appId"`
-	AppSecret        string `json:"appSecret"`
-	AppKey           string `json:"appKey"`
-	ClusterId        string `json:"clusterId"`
-	SupaBaseApiKey   string `json:"supaBaseApiKey"`
-	SupaBaseUrl      string `json:"supaBaseUrl"`
-	RabbitMqAdmin    string `json:"rabbitMqAdmin"`
-	RabbitMqPassword string `json:"rabbitMqPassword"`
-	RabbitMqHost     string `json:"rabbitMqHost"`
+// shutdown is called when the app is about to quit,
+// it closes the connection to RabbitMQ
+func (a *App) shutdown(ctx context.Context) {
+	a.stopConsuming()
+	a.outbox.stop()
+	if a.transport != nil {
+		a.transport.Close()
+	}
 }
 
-// RetrieveEnvValues retrieves the values from the .env file
-// and saves them in the config struct
-// Returns the values of the .env file
-// in the following order:
-// app_id, app_secret, app_key, cluster_id
-func (a *App) RetrieveEnvValues() Config {
-	m := &utils.MessengerUtils{
-		Verbose: a.verbose,
-	}
-	m.PrintInfo("Loading .env file")
-	err := godotenv.Load()
-	if err != nil {
-		utils.PrintError("Error loading .env file", err)
-		return Config{}
-	}
-	a.config.AppId = os.Getenv("APP_ID")
-	a.config.AppSecret = os.Getenv("SECRET")
-	a.config.AppKey = os.Getenv("KEY")
-	a.config.ClusterId = os.Getenv("CLUSTER")
-	a.config.SupaBaseApiKey = os.Getenv("SUPABASE_API_KEY")
-	a.config.SupaBaseUrl = os.Getenv("SUPABASE_URL")
-	a.config.RabbitMqAdmin = os.Getenv("RABBITMQ_ADMIN")
-	a.config.RabbitMqPassword = os.Getenv("RABBITMQ_PASSWORD")
-	a.config.RabbitMqHost = os.Getenv("RABBITMQ_HOST")
-	return a.config
+type User struct {
+	id        string
+	queueName string
+	stop      func()
+	// expires is when the access token the id was taken from expires
+	expires time.Time
 }
 
 func (a *App) ValidateEmail(email string) bool {
 	return utils.ValidateEmailRegex(email)
 }
 
-func (a *App) GetAppId() string {
-	return a.config.AppId
+// Send publishes a message to the chat room and returns its id.
+// The broker confirms the message asynchronously, the outcome is
+// reported through the message:status event and GetMessageStatus.
+// While the broker is unreachable the message waits in the outbox.
+func (a *App) Send(message, chatRoomId string) (string, error) {
+	if err := validateRoomId(chatRoomId); err != nil {
+		return "", err
+	}
+	if err := a.authorizeRoom(chatRoomId); err != nil {
+		return "", err
+	}
+	if !a.brokerConfigured() {
+		return "", errInvalidConfig
+	}
+	msg := newMessage(chatRoomId, a.getSenderId(), message)
+	if err := a.seal(&msg); err != nil {
+		return "", err
+	}
+	a.deliveries.add(msg)
+	a.sendOrQueue(msg)
+	return msg.Id, nil
 }
 
-func (a *App) GetAppSecret() string {
-	return a.config.AppSecret
+// RetryMessage publishes a failed message again under the same id
+func (a *App) RetryMessage(messageId string) error {
+	msg, err := a.deliveries.message(messageId)
+	if err != nil {
+		return err
+	}
+	if err := a.deliveries.set(messageId, DeliveryPending, nil); err != nil {
+		return err
+	}
+	a.sendOrQueue(msg)
+	return nil
 }
 
-func (a *App) GetAppKey() string {
-	return a.config.AppKey
+// GetPendingMessages lists the messages waiting in the outbox
+func (a *App) GetPendingMessages() []OutboxEntry {
+	return a.outbox.entries()
 }
 
-func (a *App) GetClusterId() string {
-	return a.config.ClusterId
+// CancelMessage removes a message from the outbox,
+// it is marked as failed and will not be sent
+func (a *App) CancelMessage(messageId string) error {
+	if err := a.outbox.cancel(messageId); err != nil {
+		return err
+	}
+	a.failDelivery(messageId, errCanceled)
+	return nil
 }
 
-func (a *App) GetSupaBaseApiKey() string {
-	return a.config.SupaBaseApiKey
+// sendOrQueue publishes the message right away, unless the broker is
+// unreachable or older messages of the chat room are still waiting
+func (a *App) sendOrQueue(msg Message) {
+	if a.outbox.has(msg.ChatRoomId) {
+		a.outbox.add(msg)
+		return
+	}
+	if err := a.publish(msg); err != nil {
+		utils.PrintError("Failed to send message, queueing it", err)
+		a.outbox.add(msg)
+	}
 }
 
-func (a *App) GetSupaBaseUrl() string {
-	return a.config.SupaBaseUrl
+// GetMessageStatus returns the delivery status of a sent message
+func (a *App) GetMessageStatus(messageId string) (DeliveryStatus, error) {
+	return a.deliveries.get(messageId)
 }
 
-func (a *App) GetRabbitMqAdmin() string {
-	return a.config.RabbitMqAdmin
-}
+// publish hands the message to the transport and waits for
+// the broker to take it over in the background
+func (a *App) publish(msg Message) error {
+	if a.transport == nil {
+		return errNotConnected
+	}
+	var members []string
+	if room, ok := a.rooms.get(msg.ChatRoomId); ok {
+		for _, member := range room.Members {
+			members = append(members, member.UserId)
+		}
+	}
+	confirmation, err := a.transport.Publish(msg, members)
+	if err != nil {
+		return fmt.Errorf("publishing the message: %w", err)
+	}
 
-func (a *App) GetRabbitMqPassword() string {
-	return a.config.RabbitMqPassword
+	go a.awaitConfirm(msg.Id, confirmation)
+	return nil
 }
 
-func (a *App) GetRabbitMqHost() string {
-	return a.config.RabbitMqHost
+func (a *App) awaitConfirm(messageId string, confirmation <-chan error) {
+	select {
+	case err := <-confirmation:
+		if err != nil {
+			a.failDelivery(messageId, err)
+			return
+		}
+		if err := a.deliveries.set(messageId, DeliveryConfirmed, nil); err != nil {
+			utils.PrintError("Failed to update the message status", err)
+		}
+	case <-time.After(confirmTimeout):
+		a.failDelivery(messageId, errConfirmTimeout)
+	}
 }
 
-type Message struct {
-	Message string `json:"message"`
-	Sender  string `json:"sender"`
-	Time    string `json:"time"`
+func (a *App) failDelivery(messageId string, cause error) {
+	if err := a.deliveries.set(messageId, DeliveryFailed, cause); err != nil {
+		utils.PrintError("Failed to update the message status", err)
+	}
 }
 
-func failOnError(err error, msg string) {
-	if err != nil {
-		utils.PrintError(msg, err)
+// emit sends an event to the frontend, once the app runs in one.
+func (a *App) emit(eventName string, data interface{}) {
+	if a.events != nil {
+		a.events(eventName, data)
+		return
+	}
+	if a.ctx != nil {
+		runtime.EventsEmit(a.ctx, eventName, data)
 	}
 }
 
-func (a *App) Send(message, chatRoomId string) {
-	var amqpHost string
-	var amqpPort string
-	var amqpUser string
-	var amqpPassword string
-
-	amqpHost = a.GetRabbitMqHost()
-	amqpPort = "5672"
-	amqpUser = a.GetRabbitMqAdmin()
-	amqpPassword = a.GetRabbitMqPassword()
-
-	amqpUrl := fmt.Sprintf(
-		"amqp://%s:%s@%s:%s/",
-		amqpUser,
-		url.QueryEscape(amqpPassword),
-		amqpHost,
-		amqpPort,
-	)
-
-	conn, err := amqp.Dial(amqpUrl)
-	failOnError(err, "Failed to connect to RabbitMQ")
-
-	channel, err := conn.Channel()
-	failOnError(err, "Failed to open a channel")
-
-	queueName := chatRoomId
-	queue, err := channel.QueueDeclare(
-		queueName,
-		true,
-		false,
-		false,
-		false,
-		nil,
-	)
-	failOnError(err, "Failed to declare a queue")
-
-	body := message
-
-	err = channel.Publish(
-		"",
-		queue.Name,
-		false,
-		false,
-		amqp.Publishing{
-			ContentType: "text/plain",
-			Body:        []byte(body),
-		})
-	failOnError(err, "Failed to publish a message")
-
-	defer func() {
-		if err := conn.Close(); err != nil {
-			utils.PrintError("closing connection", err)
-		}
-		if err := channel.Close(); err != nil {
-			utils.PrintError("closing channel", err)
-		}
-	}()
-
-	time.Sleep(1 * time.Second)
+func (a *App) emitDeliveryStatus(status DeliveryStatus) {
+	a.emit(messageStatusEvent, status)
 }
 
 func intToSpecificBaseToString(num, base int) string {
@@ -243,34 +291,97 @@ func (a *App) GenerateUserName(length int) string {
 	return user_name_string
 }
 
-func (a *App) CreateChatRoomId(otherId, currentId string) string {
-	var chatRoomId string
-	if otherId < currentId {
-		chatRoomId = otherId + currentId
-	} else {
-		chatRoomId = currentId + otherId
+// CreateChatRoomId returns the opaque id of the direct chat room of two
+// users and registers the room, so both of them receive its messages.
+// currentId has to be the signed in user
+func (a *App) CreateChatRoomId(otherId, currentId string) (string, error) {
+	if me, err := normalizeUserId(currentId); err != nil || me != a.getSenderId() {
+		return "", errNotSignedIn
 	}
-	return chatRoomId
+	chatRoomId, err := directRoomId([]byte(a.config.RoomIdKey), otherId, currentId)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := a.rooms.get(chatRoomId); !ok {
+		// both ids were validated by directRoomId
+		me, _ := normalizeUserId(currentId)
+		other, _ := normalizeUserId(otherId)
+		a.rooms.put(newDirectRoom(chatRoomId, me, other))
+	}
+	if err := a.subscribe(chatRoomId); err != nil {
+		utils.PrintError("Failed to subscribe to "+chatRoomId, err)
+	}
+	return chatRoomId, nil
 }
 
-func (a *App) SetQueuName(queueName string) {
+// SetQueuName sets the active chat room
+// and makes sure its messages reach the user
+func (a *App) SetQueuName(queueName string) error {
+	if err := validateRoomId(queueName); err != nil {
+		return err
+	}
+	if err := a.authorizeRoom(queueName); err != nil {
+		return err
+	}
+	a.mu.Lock()
 	a.user.queueName = queueName
+	a.mu.Unlock()
+	if err := a.subscribe(queueName); err != nil {
+		utils.PrintError("Failed to subscribe to "+queueName, err)
+	}
+	return nil
 }
 
-func (a *App) getQueueName() string {
-	return a.user.queueName
+// setUser sets the id of the signed in user, which is sent along with
+// every message, and switches to consuming the queue of that user.
+// The id must have been taken from a verified access token.
+func (a *App) setUser(userId string, expires time.Time) {
+	a.mu.Lock()
+	changed := a.user.id != userId
+	a.user.id = userId
+	a.user.expires = expires
+	a.mu.Unlock()
+	if changed {
+		a.loadRooms(userId)
+		a.loadIdentity(userId)
+	}
+	if changed && a.isConsuming() {
+		a.startConsuming()
+	}
 }
 
-func (a *App) GetOtherUserId(concatenatedUUIDs string, myUUID string) string {
-	// Remove dashes from the UUIDs
-	myUUID = strings.ReplaceAll(myUUID, "-", "")
-	concatenatedUUIDs = strings.ReplaceAll(concatenatedUUIDs, "-", "")
-
-	// Retrieve the other UUID
-	otherUUID := strings.Replace(concatenatedUUIDs, myUUID, "", 1)
+func (a *App) getSenderId() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.user.id
+}
 
-	// Add dashes back to the other UUID
-	otherUUID = otherUUID[0:8] + "-" + otherUUID[8:12] + "-" + otherUUID[12:16] + "-" + otherUUID[16:20] + "-" + otherUUID[20:]
+func (a *App) getQueueName() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.user.queueName
+}
 
-	return otherUUID
+// GetOtherUserId looks up the other participant of a direct chat room
+func (a *App) GetOtherUserId(chatRoomId string, myUUID string) (string, error) {
+	if err := validateRoomId(chatRoomId); err != nil {
+		return "", err
+	}
+	me, err := normalizeUserId(myUUID)
+	if err != nil {
+		return "", err
+	}
+	room, ok := a.rooms.get(chatRoomId)
+	if !ok || !room.Direct {
+		return "", errUnknownRoom
+	}
+	if _, ok := room.member(me); !ok {
+		return "", errNotAMember
+	}
+	for _, member := range room.Members {
+		if member.UserId != me {
+			return member.UserId, nil
+		}
+	}
+	return "", errUnknownRoom
 }
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	utils "github.com/benni347/messengerutils"
+)
+
+// authStateEvent is emitted with the AuthUser whenever a user signed in
+// or out, the id is empty after signing out.
+const authStateEvent = "auth:state"
+
+const (
+	// refreshMargin is how long before the access token expires it is
+	// refreshed, refreshRetry how long to wait after refreshing failed.
+	refreshMargin = time.Minute
+	refreshRetry  = 30 * time.Second
+)
+
+// AuthUser is the signed in user as the frontend sees it. MfaRequired
+// is set when signing in still waits for the second factor.
+type AuthUser struct {
+	Id             string `json:"id"`
+	Email          string `json:"email"`
+	UserName       string `json:"userName"`
+	EmailConfirmed bool   `json:"emailConfirmed"`
+	MfaRequired    bool   `json:"mfaRequired"`
+}
+
+func newAuthUser(u *authUser) AuthUser {
+	if u == nil {
+		return AuthUser{}
+	}
+	id, err := normalizeUserId(u.Id)
+	if err != nil {
+		id = u.Id
+	}
+	return AuthUser{
+		Id:             id,
+		Email:          u.Email,
+		UserName:       u.userName(),
+		EmailConfirmed: u.EmailConfirmedAt != "",
+	}
+}
+
+// SignIn signs in with email and password. If the user has a second
+// factor, mfaRequired is set and VerifySignIn finishes signing in
+func (a *App) SignIn(email, password string) (AuthUser, error) {
+	email = strings.TrimSpace(email)
+	if !utils.ValidateEmailRegex(email) {
+		return AuthUser{}, errInvalidEmail
+	}
+	session, err := a.auth.signInWithPassword(email, password)
+	if err != nil {
+		return AuthUser{}, err
+	}
+	return a.completeSignIn(session)
+}
+
+// SignUp creates an account with the user name in its metadata. Unless
+// the project skips confirming email addresses, the user has to follow
+// the link in the mail before signing in, emailConfirmed tells which
+func (a *App) SignUp(email, password, userName string) (AuthUser, error) {
+	email = strings.TrimSpace(email)
+	if !utils.ValidateEmailRegex(email) {
+		return AuthUser{}, errInvalidEmail
+	}
+	session, user, err := a.auth.signUp(email, password, strings.TrimSpace(userName))
+	if err != nil {
+		return AuthUser{}, err
+	}
+	if session != nil {
+		if err := a.setSession(session); err != nil {
+			return AuthUser{}, err
+		}
+		a.emitAuthState(newAuthUser(user))
+	}
+	return newAuthUser(user), nil
+}
+
+// RefreshSession trades the refresh token for a new access token.
+// If the session ended on the server, the user is signed out
+func (a *App) RefreshSession() error {
+	// refresh tokens are used only once, concurrent refreshes
+	// would end the session
+	a.refreshMu.Lock()
+	defer a.refreshMu.Unlock()
+	a.mu.Lock()
+	current := a.session
+	a.mu.Unlock()
+	if current == nil {
+		return errNotSignedIn
+	}
+	session, err := a.auth.refresh(current.RefreshToken)
+	if errors.Is(err, errInvalidRefresh) {
+		a.clearSession()
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if session.User == nil {
+		session.User = current.User
+	}
+	return a.setSession(session)
+}
+
+// SignOut ends the session, both on the server and in the app,
+// and deletes the session saved on this device
+func (a *App) SignOut() error {
+	a.mu.Lock()
+	session := a.session
+	a.mu.Unlock()
+	var err error
+	if session != nil {
+		err = a.auth.signOut(session.AccessToken)
+	}
+	a.clearSession()
+	return err
+}
+
+// RecoverPassword sends a mail to reset the password
+func (a *App) RecoverPassword(email string) error {
+	email = strings.TrimSpace(email)
+	if !utils.ValidateEmailRegex(email) {
+		return errInvalidEmail
+	}
+	return a.auth.recover(email)
+}
+
+// GetCurrentUser returns the signed in user,
+// the id is empty if nobody is signed in
+func (a *App) GetCurrentUser() (AuthUser, error) {
+	a.mu.Lock()
+	session := a.session
+	a.mu.Unlock()
+	if session != nil && session.User != nil {
+		return newAuthUser(session.User), nil
+	}
+	token := a.supabase.token()
+	if token == "" {
+		return AuthUser{}, nil
+	}
+	// signed in through the frontend, which only handed over the token
+	user, err := a.auth.user(token)
+	if err != nil {
+		return AuthUser{}, err
+	}
+	return newAuthUser(user), nil
+}
+
+// signInWith signs in with the session and tells the frontend.
+func (a *App) signInWith(session *authSession) (AuthUser, error) {
+	if err := a.setSession(session); err != nil {
+		return AuthUser{}, err
+	}
+	user := newAuthUser(session.User)
+	a.emitAuthState(user)
+	return user, nil
+}
+
+// setSession verifies the access token of the session and signs in as
+// the user it belongs to. The session is refreshed before it expires and,
+// if the user saved it, the rotated refresh token is saved again.
+func (a *App) setSession(session *authSession) error {
+	if err := a.SetAccessToken(session.AccessToken); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.session = session
+	a.mu.Unlock()
+	if a.store != nil {
+		if err := a.store.save(session.RefreshToken); err != nil {
+			utils.PrintError("Failed to save the session", err)
+		}
+	}
+	a.scheduleRefresh(session, refreshDelay(session.expires(), time.Now()))
+	return nil
+}
+
+// refreshDelay is how long to wait before refreshing an access token
+// that expires at the time, at least half of its remaining lifetime, so
+// short lived tokens are not refreshed over and over again.
+func refreshDelay(expires, now time.Time) time.Duration {
+	delay := expires.Add(-refreshMargin).Sub(now)
+	if half := expires.Sub(now) / 2; delay < half {
+		delay = half
+	}
+	if delay < 0 {
+		return 0
+	}
+	return delay
+}
+
+// scheduleRefresh refreshes the session after the delay, replacing the
+// refresh scheduled before.
+func (a *App) scheduleRefresh(session *authSession, delay time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.refresher != nil {
+		a.refresher.Stop()
+	}
+	a.refresher = time.AfterFunc(delay, func() { a.autoRefresh(session) })
+}
+
+// autoRefresh refreshes the session, unless it was replaced or ended in
+// the meantime. Refreshing is retried until the session ended on the
+// server, while offline the access token may expire in between.
+func (a *App) autoRefresh(session *authSession) {
+	a.mu.Lock()
+	current := a.session
+	a.mu.Unlock()
+	if current != session {
+		return
+	}
+	err := a.RefreshSession()
+	if err == nil || errors.Is(err, errInvalidRefresh) || errors.Is(err, errNotSignedIn) {
+		return
+	}
+	utils.PrintError("Failed to refresh the session", err)
+	a.scheduleRefresh(session, refreshRetry)
+}
+
+// clearSession forgets the session, also the one saved on this device,
+// and signs out.
+func (a *App) clearSession() {
+	a.mu.Lock()
+	hadSession := a.session != nil
+	a.session = nil
+	a.pendingMfa = nil
+	a.enrollment = nil
+	if a.refresher != nil {
+		a.refresher.Stop()
+		a.refresher = nil
+	}
+	a.mu.Unlock()
+	if a.store != nil {
+		if err := a.store.wipe(); err != nil {
+			utils.PrintError("Failed to delete the saved session", err)
+		}
+	}
+	if err := a.SetAccessToken(""); err != nil {
+		utils.PrintError("Failed to sign out", err)
+	}
+	if hadSession {
+		a.emitAuthState(AuthUser{})
+	}
+}
+
+func (a *App) emitAuthState(user AuthUser) {
+	a.emit(authStateEvent, user)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	utils "github.com/benni347/messengerutils"
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	// authStoreKdf names the key derivation in the file, so the
+	// parameters can be raised without breaking stored sessions.
+	authStoreKdf = "argon2id"
+	// authStoreTime, authStoreMemory (in KiB) and authStoreThreads are
+	// the Argon2id parameters new files are written with.
+	authStoreTime    = 3
+	authStoreMemory  = 64 * 1024
+	authStoreThreads = 4
+	// maxAuthStoreTime, maxAuthStoreMemory and maxAuthStoreThreads bound
+	// the parameters read from a file, so a tampered file can neither
+	// exhaust the memory nor keep the app busy.
+	maxAuthStoreTime    = 10
+	maxAuthStoreMemory  = 1024 * 1024
+	maxAuthStoreThreads = 16
+	// minPassphraseLength is the shortest passphrase a session is
+	// stored with.
+	minPassphraseLength = 8
+)
+
+var (
+	errNoSavedSession     = errors.New("no session is saved on this device")
+	errWrongPassphrase    = errors.New("wrong passphrase")
+	errPassphraseTooShort = fmt.Errorf("the passphrase needs at least %d characters", minPassphraseLength)
+)
+
+// authStoreFile is the session store on disk. Only the refresh token is
+// kept, encrypted with AES-GCM under a key derived from the passphrase
+// of the user with Argon2id, the access token is fetched again with it.
+type authStoreFile struct {
+	Kdf        string `json:"kdf"`
+	Time       uint32 `json:"time"`
+	Memory     uint32 `json:"memory"`
+	Threads    uint8  `json:"threads"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// authStorePlaintext is what is encrypted in the file.
+type authStorePlaintext struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// authStore keeps the refresh token of the signed in user so the app
+// stays signed in across restarts. Once it is created or unlocked, the
+// derived key stays in memory and every rotated refresh token is saved.
+type authStore struct {
+	path string
+
+	mu   sync.Mutex
+	file authStoreFile
+	key  []byte
+}
+
+func openAuthStore() (*authStore, error) {
+	dir, err := configDir()
+	if err != nil {
+		return nil, err
+	}
+	return &authStore{path: filepath.Join(dir, "session.json")}, nil
+}
+
+// deriveKey derives the encryption key from the passphrase with the
+// parameters and the salt of the file.
+func (f authStoreFile) deriveKey(passphrase string) []byte {
+	return argon2.IDKey([]byte(passphrase), f.Salt, f.Time, f.Memory, f.Threads, 32)
+}
+
+// checkKdf makes sure the key derivation of the file is supported and
+// its parameters are within bounds before a key is derived with them.
+func (f authStoreFile) checkKdf() error {
+	if f.Kdf != authStoreKdf {
+		return fmt.Errorf("unsupported key derivation %q", f.Kdf)
+	}
+	if f.Time < 1 || f.Time > maxAuthStoreTime ||
+		f.Threads < 1 || f.Threads > maxAuthStoreThreads ||
+		f.Memory < 8*uint32(f.Threads) || f.Memory > maxAuthStoreMemory {
+		return fmt.Errorf("invalid %s parameters t=%d m=%d p=%d", f.Kdf, f.Time, f.Memory, f.Threads)
+	}
+	if len(f.Salt) < 16 {
+		return errors.New("the salt is too short")
+	}
+	return nil
+}
+
+// exists reports whether a session is saved.
+func (s *authStore) exists() bool {
+	_, err := os.Stat(s.path)
+	return err == nil
+}
+
+// create saves the refresh token under a new passphrase, replacing the
+// session saved before.
+func (s *authStore) create(passphrase, refreshToken string) error {
+	if len(passphrase) < minPassphraseLength {
+		return errPassphraseTooShort
+	}
+	file := authStoreFile{
+		Kdf:     authStoreKdf,
+		Time:    authStoreTime,
+		Memory:  authStoreMemory,
+		Threads: authStoreThreads,
+		Salt:    make([]byte, 16),
+	}
+	if _, err := rand.Read(file.Salt); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.file = file
+	s.key = file.deriveKey(passphrase)
+	return s.write(refreshToken)
+}
+
+// unlock decrypts the saved refresh token with the passphrase.
+func (s *authStore) unlock(passphrase string) (string, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", errNoSavedSession
+	}
+	if err != nil {
+		return "", err
+	}
+	var file authStoreFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return "", fmt.Errorf("reading %s: %w", s.path, err)
+	}
+	if err := file.checkKdf(); err != nil {
+		return "", fmt.Errorf("reading %s: %w", s.path, err)
+	}
+	key := file.deriveKey(passphrase)
+	aead, err := newGcm(key)
+	if err != nil {
+		return "", err
+	}
+	if len(file.Nonce) != aead.NonceSize() {
+		return "", fmt.Errorf("reading %s: invalid nonce", s.path)
+	}
+	plaintext, err := aead.Open(nil, file.Nonce, file.Ciphertext, file.Salt)
+	if err != nil {
+		return "", errWrongPassphrase
+	}
+	var stored authStorePlaintext
+	if err := json.Unmarshal(plaintext, &stored); err != nil {
+		return "", fmt.Errorf("reading %s: %w", s.path, err)
+	}
+
+	s.mu.Lock()
+	s.file = file
+	s.key = key
+	s.mu.Unlock()
+	return stored.RefreshToken, nil
+}
+
+// save replaces the saved refresh token, as long as the store was
+// created or unlocked. Otherwise the user did not want to stay signed in.
+func (s *authStore) save(refreshToken string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.key == nil {
+		return nil
+	}
+	return s.write(refreshToken)
+}
+
+// write encrypts the refresh token with a new nonce. The caller must
+// hold the lock.
+func (s *authStore) write(refreshToken string) error {
+	plaintext, err := json.Marshal(authStorePlaintext{RefreshToken: refreshToken})
+	if err != nil {
+		return err
+	}
+	aead, err := newGcm(s.key)
+	if err != nil {
+		return err
+	}
+	s.file.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(s.file.Nonce); err != nil {
+		return err
+	}
+	s.file.Ciphertext = aead.Seal(nil, s.file.Nonce, plaintext, s.file.Salt)
+	data, err := json.Marshal(s.file)
+	if err != nil {
+		return err
+	}
+	return writePrivateFile(s.path, data)
+}
+
+// wipe forgets the key and deletes the saved session.
+func (s *authStore) wipe() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.key {
+		s.key[i] = 0
+	}
+	s.key = nil
+	s.file = authStoreFile{}
+	err := os.Remove(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// HasSavedSession reports whether a session is saved on this device,
+// UnlockSession restores it
+func (a *App) HasSavedSession() bool {
+	return a.store != nil && a.store.exists()
+}
+
+// SaveSession keeps the current session on this device, encrypted
+// with the passphrase, so the user stays signed in after a restart
+func (a *App) SaveSession(passphrase string) error {
+	a.mu.Lock()
+	session := a.session
+	a.mu.Unlock()
+	if session == nil {
+		return errNotSignedIn
+	}
+	if a.store == nil {
+		return errNoSavedSession
+	}
+	return a.store.create(passphrase, session.RefreshToken)
+}
+
+// UnlockSession decrypts the saved session with the passphrase and
+// signs in with it
+func (a *App) UnlockSession(passphrase string) (AuthUser, error) {
+	if a.store == nil {
+		return AuthUser{}, errNoSavedSession
+	}
+	refreshToken, err := a.store.unlock(passphrase)
+	if err != nil {
+		return AuthUser{}, err
+	}
+	session, err := a.auth.refresh(refreshToken)
+	if errors.Is(err, errInvalidRefresh) {
+		// the session ended while the app was closed
+		if err := a.store.wipe(); err != nil {
+			utils.PrintError("Failed to delete the saved session", err)
+		}
+		return AuthUser{}, err
+	}
+	if err != nil {
+		return AuthUser{}, err
+	}
+	// setSession saves the rotated refresh token
+	return a.signInWith(session)
+}
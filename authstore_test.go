@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestAuthStore(t *testing.T) *authStore {
+	t.Helper()
+	return &authStore{path: filepath.Join(t.TempDir(), "session.json")}
+}
+
+func TestAuthStoreRoundTrip(t *testing.T) {
+	store := newTestAuthStore(t)
+	if store.exists() {
+		t.Fatal("a new store exists")
+	}
+	if _, err := store.unlock("passphrase"); !errors.Is(err, errNoSavedSession) {
+		t.Fatalf("unlocking nothing: %v", err)
+	}
+	if err := store.create("short", "refresh-1"); !errors.Is(err, errPassphraseTooShort) {
+		t.Fatalf("short passphrase: %v", err)
+	}
+	if err := store.create("correct horse", "refresh-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(store.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "refresh-1") {
+		t.Fatal("the refresh token is stored in the clear")
+	}
+	if info, err := os.Stat(store.path); err != nil || info.Mode().Perm()&0o077 != 0 {
+		t.Fatalf("the file is readable by others: %v", info.Mode())
+	}
+
+	reopened := &authStore{path: store.path}
+	if _, err := reopened.unlock("wrong horse"); !errors.Is(err, errWrongPassphrase) {
+		t.Fatalf("wrong passphrase: %v", err)
+	}
+	token, err := reopened.unlock("correct horse")
+	if err != nil || token != "refresh-1" {
+		t.Fatalf("unlocked %q, %v", token, err)
+	}
+
+	// the rotated refresh token is saved under the same passphrase
+	if err := reopened.save("refresh-2"); err != nil {
+		t.Fatal(err)
+	}
+	if token, err := (&authStore{path: store.path}).unlock("correct horse"); err != nil || token != "refresh-2" {
+		t.Fatalf("after saving: %q, %v", token, err)
+	}
+
+	if err := reopened.wipe(); err != nil {
+		t.Fatal(err)
+	}
+	if store.exists() {
+		t.Fatal("the session is still saved after wiping")
+	}
+	// a store that was never unlocked does not save
+	if err := reopened.save("refresh-3"); err != nil || store.exists() {
+		t.Fatalf("saved without a key: %v", err)
+	}
+}
+
+func TestAuthStoreRejectsTamperedKdf(t *testing.T) {
+	store := newTestAuthStore(t)
+	if err := store.create("correct horse", "refresh"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(store.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved authStoreFile
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]func(f *authStoreFile){
+		"other kdf":         func(f *authStoreFile) { f.Kdf = "scrypt" },
+		"no threads":        func(f *authStoreFile) { f.Threads = 0 },
+		"no passes":         func(f *authStoreFile) { f.Time = 0 },
+		"too many passes":   func(f *authStoreFile) { f.Time = maxAuthStoreTime + 1 },
+		"too much memory":   func(f *authStoreFile) { f.Memory = 1<<32 - 1 },
+		"too little memory": func(f *authStoreFile) { f.Memory = 8*uint32(f.Threads) - 1 },
+		"short salt":        func(f *authStoreFile) { f.Salt = f.Salt[:4] },
+	}
+	for name, tamper := range tests {
+		file := saved
+		tamper(&file)
+		data, err := json.Marshal(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writePrivateFile(store.path, data); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := (&authStore{path: store.path}).unlock("correct horse"); err == nil || errors.Is(err, errWrongPassphrase) {
+			t.Errorf("%s: %v, want the file to be refused", name, err)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	defaultAmqpPort  = "5672"
+	defaultAmqpsPort = "5671"
+
+	// failoverOrdered tries the brokers in the configured order,
+	// failoverRandom in a random order, which spreads the clients.
+	// Both start with the broker that worked last.
+	failoverOrdered = "ordered"
+	failoverRandom  = "random"
+)
+
+var (
+	errNoCertificates  = errors.New("the CA file contains no certificates")
+	errTlsWithoutAmqps = errors.New("TLS is enabled but the url does not use amqps://")
+	errHalfClientCert  = errors.New("a client certificate needs both a certificate and a key file")
+	errNoBroker        = errors.New("no RabbitMQ broker is configured")
+)
+
+// amqpEndpoint is everything needed to dial the broker.
+type amqpEndpoint struct {
+	url    string
+	config amqp.Config
+}
+
+// dial opens a connection to the endpoint.
+func (e amqpEndpoint) dial() (*amqp.Connection, error) {
+	return amqp.DialConfig(e.url, e.config)
+}
+
+// String returns the url of the endpoint without the password,
+// so it can be logged.
+func (e amqpEndpoint) String() string {
+	u, err := url.Parse(e.url)
+	if err != nil {
+		return "invalid url"
+	}
+	if u.User != nil {
+		u.User = url.User(u.User.Username())
+	}
+	return u.String()
+}
+
+// brokerEndpoints builds the endpoints of all brokers in the config:
+// either from the comma separated AMQP URIs or from the comma separated
+// hosts, which may carry their own port, together with port and vhost.
+func brokerEndpoints(c Config) ([]amqpEndpoint, error) {
+	var endpoints []amqpEndpoint
+	if c.RabbitMqUrl != "" {
+		for _, rawUrl := range splitList(c.RabbitMqUrl) {
+			endpoint, err := brokerEndpoint(c, rawUrl, "")
+			if err != nil {
+				return nil, err
+			}
+			endpoints = append(endpoints, endpoint)
+		}
+	} else {
+		for _, host := range splitList(c.RabbitMqHost) {
+			endpoint, err := brokerEndpoint(c, "", host)
+			if err != nil {
+				return nil, err
+			}
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	if len(endpoints) == 0 {
+		return nil, errNoBroker
+	}
+	return endpoints, nil
+}
+
+// brokerEndpoint builds the endpoint of one broker, given either by a
+// full AMQP URI or by its host. Credentials that are not part of the
+// URI are taken from the user and password settings.
+func brokerEndpoint(c Config, rawUrl, host string) (amqpEndpoint, error) {
+	var u *url.URL
+	if rawUrl != "" {
+		uri, err := amqp.ParseURI(rawUrl)
+		if err != nil {
+			return amqpEndpoint{}, err
+		}
+		if u, err = url.Parse(rawUrl); err != nil {
+			return amqpEndpoint{}, err
+		}
+		if u.User == nil && c.RabbitMqAdmin != "" {
+			u.User = url.UserPassword(c.RabbitMqAdmin, c.RabbitMqPassword)
+		}
+		if parseBool(c.RabbitMqTls) && uri.Scheme != "amqps" {
+			return amqpEndpoint{}, errTlsWithoutAmqps
+		}
+	} else {
+		scheme, port := "amqp", defaultAmqpPort
+		if parseBool(c.RabbitMqTls) {
+			scheme, port = "amqps", defaultAmqpsPort
+		}
+		if c.RabbitMqPort != "" {
+			port = c.RabbitMqPort
+		}
+		if h, p, err := net.SplitHostPort(host); err == nil {
+			host, port = h, p
+		}
+		u = &url.URL{
+			Scheme: scheme,
+			User:   url.UserPassword(c.RabbitMqAdmin, c.RabbitMqPassword),
+			Host:   net.JoinHostPort(host, port),
+			Path:   "/",
+		}
+	}
+
+	config := amqp.Config{
+		Locale:     "en_US",
+		Properties: amqp.NewConnectionProperties(),
+	}
+	if c.RabbitMqHeartbeat != "" {
+		heartbeat, err := time.ParseDuration(c.RabbitMqHeartbeat)
+		if err != nil {
+			return amqpEndpoint{}, err
+		}
+		config.Heartbeat = heartbeat
+	}
+	if c.RabbitMqConnectionName != "" {
+		config.Properties.SetClientConnectionName(c.RabbitMqConnectionName)
+	}
+	if c.RabbitMqVhost != "" && rawUrl == "" {
+		config.Vhost = c.RabbitMqVhost
+	}
+	if u.Scheme == "amqps" {
+		tlsConfig, err := brokerTlsConfig(c, u.Hostname())
+		if err != nil {
+			return amqpEndpoint{}, err
+		}
+		config.TLSClientConfig = tlsConfig
+	}
+	return amqpEndpoint{url: u.String(), config: config}, nil
+}
+
+// splitList splits a comma separated setting, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// brokerTlsConfig trusts the CA bundle, if one is configured, on top
+// of the system roots and presents the client certificate, if any.
+func brokerTlsConfig(c Config, serverName string) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+	}
+	if c.RabbitMqCaFile != "" {
+		pool, err := loadCaPool(c.RabbitMqCaFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if c.RabbitMqCertFile != "" || c.RabbitMqKeyFile != "" {
+		cert, err := loadClientCert(c.RabbitMqCertFile, c.RabbitMqKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func loadCaPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: %w", path, errNoCertificates)
+	}
+	return pool, nil
+}
+
+func loadClientCert(certFile, keyFile string) (tls.Certificate, error) {
+	if certFile == "" || keyFile == "" {
+		return tls.Certificate{}, errHalfClientCert
+	}
+	return tls.LoadX509KeyPair(certFile, keyFile)
+}
+
+// validateBrokerConfig checks the broker settings that depend on each
+// other, the single values were validated before.
+func validateBrokerConfig(c Config) []ConfigProblem {
+	var problems []ConfigProblem
+	problem := func(field, message string) {
+		problems = append(problems, ConfigProblem{Field: field, Source: sourceDefault, Message: message})
+	}
+
+	if c.RabbitMqUrl == "" {
+		if c.RabbitMqHost == "" {
+			problem("RABBITMQ_HOST", "is required unless RABBITMQ_URL is set")
+		}
+		if c.RabbitMqAdmin == "" {
+			problem("RABBITMQ_ADMIN", "is required unless RABBITMQ_URL is set")
+		}
+		if c.RabbitMqPassword == "" {
+			problem("RABBITMQ_PASSWORD", "is required unless RABBITMQ_URL is set")
+		}
+	} else if parseBool(c.RabbitMqTls) {
+		for _, rawUrl := range splitList(c.RabbitMqUrl) {
+			if !strings.HasPrefix(rawUrl, "amqps://") {
+				problem("RABBITMQ_TLS", errTlsWithoutAmqps.Error())
+				break
+			}
+		}
+	}
+
+	if c.RabbitMqCaFile != "" {
+		if _, err := loadCaPool(c.RabbitMqCaFile); err != nil {
+			problem("RABBITMQ_CA_FILE", err.Error())
+		}
+	}
+	if c.RabbitMqCertFile != "" || c.RabbitMqKeyFile != "" {
+		if _, err := loadClientCert(c.RabbitMqCertFile, c.RabbitMqKeyFile); err != nil {
+			problem("RABBITMQ_CERT_FILE", err.Error())
+		}
+	}
+	return problems
+}
+
+func validateAmqpUrls(value string) error {
+	for _, rawUrl := range splitList(value) {
+		if _, err := amqp.ParseURI(rawUrl); err != nil {
+			return fmt.Errorf("%q is not a valid AMQP url: %v", rawUrl, err)
+		}
+	}
+	return nil
+}
+
+func validateHosts(value string) error {
+	for _, host := range splitList(value) {
+		if err := validateHost(host); err != nil {
+			return fmt.Errorf("%q %v", host, err)
+		}
+		if _, port, err := net.SplitHostPort(host); err == nil {
+			if err := validatePort(port); err != nil {
+				return fmt.Errorf("%q: port %v", host, err)
+			}
+		}
+	}
+	return nil
+}
+
+func validateFailover(value string) error {
+	if value != failoverOrdered && value != failoverRandom {
+		return fmt.Errorf("must be %q or %q", failoverOrdered, failoverRandom)
+	}
+	return nil
+}
+
+func validateBool(value string) error {
+	switch strings.ToLower(value) {
+	case "true", "false", "1", "0", "yes", "no":
+		return nil
+	}
+	return errors.New("must be true or false")
+}
+
+func parseBool(value string) bool {
+	switch strings.ToLower(value) {
+	case "true", "1", "yes":
+		return true
+	}
+	return false
+}
+
+func validateDuration(value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return errors.New("must be a duration like 10s")
+	}
+	return nil
+}
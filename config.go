@@ -0,0 +1,609 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	utils "github.com/benni347/messengerutils"
+	"github.com/joho/godotenv"
+)
+
+// configProblemsEvent is emitted on startup with the ConfigProblems
+// found while loading the config, if there are any.
+const configProblemsEvent = "config:problems"
+
+// The sources a setting can come from, later ones take precedence.
+const (
+	sourceDefault = "default"
+	sourceFile    = "config file"
+	sourceDotEnv  = ".env"
+	sourceEnv     = "environment"
+	sourceFlag    = "flag"
+)
+
+var errInvalidConfig = errors.New("the configuration is invalid, see GetConfigProblems")
+
+// Config holds the settings of the app. It never leaves the Go
+// process, the frontend gets a PublicConfig instead.
+type Config struct {
+	AppId          string `json:"-"`
+	AppSecret      string `json:"-"`
+	AppKey         string `json:"-"`
+	ClusterId      string `json:"-"`
+	SupaBaseApiKey string `json:"-"`
+	SupaBaseUrl    string `json:"-"`
+	// SupaBaseJwtSecret verifies HS256 access tokens, without it
+	// only tokens signed with the keys of the JWKS are accepted
+	SupaBaseJwtSecret   string `json:"-"`
+	SupaBaseJwtAudience string `json:"-"`
+	// OAuthRedirectPort is the loopback port the OAuth provider
+	// redirects to, a free one is picked when it is empty
+	OAuthRedirectPort string `json:"-"`
+	// Transport selects how messages travel, see newTransport
+	Transport        string `json:"-"`
+	RabbitMqAdmin    string `json:"-"`
+	RabbitMqPassword string `json:"-"`
+	// RabbitMqUrl replaces host, port and vhost when it is set,
+	// both may list several brokers separated by commas
+	RabbitMqUrl            string `json:"-"`
+	RabbitMqHost           string `json:"-"`
+	RabbitMqFailover       string `json:"-"`
+	RabbitMqPort           string `json:"-"`
+	RabbitMqVhost          string `json:"-"`
+	RabbitMqTls            string `json:"-"`
+	RabbitMqCaFile         string `json:"-"`
+	RabbitMqCertFile       string `json:"-"`
+	RabbitMqKeyFile        string `json:"-"`
+	RabbitMqConnectionName string `json:"-"`
+	RabbitMqHeartbeat      string `json:"-"`
+	// MqttUrl may list several brokers separated by commas,
+	// they are tried in order
+	MqttUrl      string `json:"-"`
+	MqttUser     string `json:"-"`
+	MqttPassword string `json:"-"`
+	MqttCaFile   string `json:"-"`
+	// GatewayAddr turns the process into the WebSocket gateway,
+	// see runGateway
+	GatewayAddr    string `json:"-"`
+	GatewayOrigins string `json:"-"`
+	RoomIdKey      string `json:"-"`
+}
+
+// PublicConfig is the part of the config the frontend may see.
+// SupaBaseAnonKey is only set if the configured key is the anon key,
+// which Supabase meant to be public and which row level security guards.
+type PublicConfig struct {
+	AppId           string `json:"appId"`
+	AppKey          string `json:"appKey"`
+	ClusterId       string `json:"clusterId"`
+	SupaBaseUrl     string `json:"supaBaseUrl"`
+	SupaBaseAnonKey string `json:"supaBaseAnonKey"`
+}
+
+// ConfigProblem describes a setting that is missing or invalid.
+type ConfigProblem struct {
+	Field   string `json:"field"`
+	Source  string `json:"source"`
+	Message string `json:"message"`
+}
+
+// configField describes one setting: its key in the config file, the
+// environment variable and the command-line flag it is read from.
+type configField struct {
+	key      string
+	env      string
+	flag     string
+	usage    string
+	value    func(c *Config) *string
+	def      string
+	required bool
+	validate func(string) error
+}
+
+var configFields = []configField{
+	{key: "appId", env: "APP_ID", flag: "app-id", usage: "Pusher app id", value: func(c *Config) *string { return &c.AppId }},
+	{key: "appSecret", env: "SECRET", flag: "app-secret", usage: "Pusher app secret", value: func(c *Config) *string { return &c.AppSecret }},
+	{key: "appKey", env: "KEY", flag: "app-key", usage: "Pusher app key", value: func(c *Config) *string { return &c.AppKey }},
+	{key: "clusterId", env: "CLUSTER", flag: "cluster", usage: "Pusher cluster", value: func(c *Config) *string { return &c.ClusterId }},
+	{
+		key:      "supaBaseUrl",
+		env:      "SUPABASE_URL",
+		flag:     "supabase-url",
+		usage:    "url of the Supabase project",
+		value:    func(c *Config) *string { return &c.SupaBaseUrl },
+		required: true,
+		validate: validateHttpUrl,
+	},
+	{
+		key:      "supaBaseApiKey",
+		env:      "SUPABASE_API_KEY",
+		flag:     "supabase-api-key",
+		usage:    "anon key of the Supabase project",
+		value:    func(c *Config) *string { return &c.SupaBaseApiKey },
+		required: true,
+	},
+	{
+		key:   "supaBaseJwtSecret",
+		env:   "SUPABASE_JWT_SECRET",
+		flag:  "supabase-jwt-secret",
+		usage: "JWT secret of the Supabase project, for projects signing with HS256",
+		value: func(c *Config) *string { return &c.SupaBaseJwtSecret },
+	},
+	{
+		key:   "supaBaseJwtAudience",
+		env:   "SUPABASE_JWT_AUDIENCE",
+		flag:  "supabase-jwt-audience",
+		usage: "audience the access tokens must be issued for",
+		value: func(c *Config) *string { return &c.SupaBaseJwtAudience },
+		def:   defaultTokenAudience,
+	},
+	{
+		key:      "oauthRedirectPort",
+		env:      "OAUTH_REDIRECT_PORT",
+		flag:     "oauth-redirect-port",
+		usage:    "loopback port signing in with GitHub redirects to, the redirect url must be allowed in Supabase",
+		value:    func(c *Config) *string { return &c.OAuthRedirectPort },
+		validate: validatePort,
+	},
+	{
+		key:      "transport",
+		env:      "TRANSPORT",
+		flag:     "transport",
+		usage:    "how messages travel: amqp, mqtt, or memory to stay within the app",
+		value:    func(c *Config) *string { return &c.Transport },
+		def:      transportAmqp,
+		validate: validateTransport,
+	},
+	{
+		key:      "rabbitMqUrl",
+		env:      "RABBITMQ_URL",
+		flag:     "rabbitmq-url",
+		usage:    "comma separated amqp:// or amqps:// urls of the RabbitMQ brokers",
+		value:    func(c *Config) *string { return &c.RabbitMqUrl },
+		validate: validateAmqpUrls,
+	},
+	{
+		key:      "rabbitMqHost",
+		env:      "RABBITMQ_HOST",
+		flag:     "rabbitmq-host",
+		usage:    "comma separated host names of the RabbitMQ brokers, each may have a :port",
+		value:    func(c *Config) *string { return &c.RabbitMqHost },
+		validate: validateHosts,
+	},
+	{
+		key:      "rabbitMqPort",
+		env:      "RABBITMQ_PORT",
+		flag:     "rabbitmq-port",
+		usage:    "port of the RabbitMQ broker, 5672 or 5671 with TLS by default",
+		value:    func(c *Config) *string { return &c.RabbitMqPort },
+		validate: validatePort,
+	},
+	{
+		key:   "rabbitMqVhost",
+		env:   "RABBITMQ_VHOST",
+		flag:  "rabbitmq-vhost",
+		usage: "RabbitMQ virtual host",
+		value: func(c *Config) *string { return &c.RabbitMqVhost },
+		def:   "/",
+	},
+	{
+		key:      "rabbitMqFailover",
+		env:      "RABBITMQ_FAILOVER",
+		flag:     "rabbitmq-failover",
+		usage:    "order the brokers are tried in, ordered or random",
+		value:    func(c *Config) *string { return &c.RabbitMqFailover },
+		def:      failoverOrdered,
+		validate: validateFailover,
+	},
+	{
+		key:   "rabbitMqAdmin",
+		env:   "RABBITMQ_ADMIN",
+		flag:  "rabbitmq-user",
+		usage: "RabbitMQ user name",
+		value: func(c *Config) *string { return &c.RabbitMqAdmin },
+	},
+	{
+		key:   "rabbitMqPassword",
+		env:   "RABBITMQ_PASSWORD",
+		flag:  "rabbitmq-password",
+		usage: "RabbitMQ password",
+		value: func(c *Config) *string { return &c.RabbitMqPassword },
+	},
+	{
+		key:      "rabbitMqTls",
+		env:      "RABBITMQ_TLS",
+		flag:     "rabbitmq-tls",
+		usage:    "connect to RabbitMQ with amqps://",
+		value:    func(c *Config) *string { return &c.RabbitMqTls },
+		def:      "false",
+		validate: validateBool,
+	},
+	{
+		key:   "rabbitMqCaFile",
+		env:   "RABBITMQ_CA_FILE",
+		flag:  "rabbitmq-ca-file",
+		usage: "PEM bundle of CAs to trust for the broker",
+		value: func(c *Config) *string { return &c.RabbitMqCaFile },
+	},
+	{
+		key:   "rabbitMqCertFile",
+		env:   "RABBITMQ_CERT_FILE",
+		flag:  "rabbitmq-cert-file",
+		usage: "PEM client certificate for the broker",
+		value: func(c *Config) *string { return &c.RabbitMqCertFile },
+	},
+	{
+		key:   "rabbitMqKeyFile",
+		env:   "RABBITMQ_KEY_FILE",
+		flag:  "rabbitmq-key-file",
+		usage: "PEM key of the client certificate",
+		value: func(c *Config) *string { return &c.RabbitMqKeyFile },
+	},
+	{
+		key:   "rabbitMqConnectionName",
+		env:   "RABBITMQ_CONNECTION_NAME",
+		flag:  "rabbitmq-connection-name",
+		usage: "name the connection is listed under on the broker",
+		value: func(c *Config) *string { return &c.RabbitMqConnectionName },
+		def:   defaultConnectionName(),
+	},
+	{
+		key:      "rabbitMqHeartbeat",
+		env:      "RABBITMQ_HEARTBEAT",
+		flag:     "rabbitmq-heartbeat",
+		usage:    "heartbeat interval of the broker connection",
+		value:    func(c *Config) *string { return &c.RabbitMqHeartbeat },
+		def:      "10s",
+		validate: validateDuration,
+	},
+	{
+		key:      "mqttUrl",
+		env:      "MQTT_URL",
+		flag:     "mqtt-url",
+		usage:    "comma separated tcp://, ssl:// or ws:// urls of the MQTT 3.1.1 brokers",
+		value:    func(c *Config) *string { return &c.MqttUrl },
+		validate: validateMqttUrls,
+	},
+	{
+		key:   "mqttUser",
+		env:   "MQTT_USER",
+		flag:  "mqtt-user",
+		usage: "MQTT user name",
+		value: func(c *Config) *string { return &c.MqttUser },
+	},
+	{
+		key:   "mqttPassword",
+		env:   "MQTT_PASSWORD",
+		flag:  "mqtt-password",
+		usage: "MQTT password",
+		value: func(c *Config) *string { return &c.MqttPassword },
+	},
+	{
+		key:   "mqttCaFile",
+		env:   "MQTT_CA_FILE",
+		flag:  "mqtt-ca-file",
+		usage: "PEM file with the CA certificates to trust for ssl:// and wss://",
+		value: func(c *Config) *string { return &c.MqttCaFile },
+	},
+	{
+		key:      "gatewayAddr",
+		env:      "GATEWAY_ADDR",
+		flag:     "gateway-addr",
+		usage:    "serve the WebSocket gateway on this address, like :8080, instead of opening the app",
+		value:    func(c *Config) *string { return &c.GatewayAddr },
+		validate: validateListenAddr,
+	},
+	{
+		key:   "gatewayOrigins",
+		env:   "GATEWAY_ORIGINS",
+		flag:  "gateway-origins",
+		usage: "comma separated origins of the web clients the gateway accepts, * for any",
+		value: func(c *Config) *string { return &c.GatewayOrigins },
+	},
+	{
+		key:      "roomIdKey",
+		env:      "ROOM_ID_KEY",
+		flag:     "room-id-key",
+		usage:    "key the ids of direct rooms are derived with, the same for all apps and gateways of a deployment",
+		value:    func(c *Config) *string { return &c.RoomIdKey },
+		def:      defaultRoomIdKey,
+		validate: validateRoomIdKey,
+	},
+}
+
+// loadConfig builds the config from, in increasing precedence, the
+// defaults, the config file in the user config dir, the .env file in
+// the working directory, the environment and the command-line flags.
+// Every value is validated, the problems are returned next to the
+// config so they can all be reported at once.
+func loadConfig(args []string, lookupEnv func(string) (string, bool)) (Config, []ConfigProblem) {
+	var config Config
+	var problems []ConfigProblem
+	sources := make(map[string]string)
+	set := func(field configField, value, source string) {
+		*field.value(&config) = value
+		sources[field.key] = source
+	}
+
+	for _, field := range configFields {
+		if field.def != "" {
+			set(field, field.def, sourceDefault)
+		}
+	}
+
+	flags := flag.NewFlagSet("messenger", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	configPath := flags.String("config", "", "path of the config file")
+	flagValues := make(map[string]*string, len(configFields))
+	for _, field := range configFields {
+		flagValues[field.key] = flags.String(field.flag, "", field.usage+" ("+field.env+")")
+	}
+	if err := flags.Parse(args); err != nil {
+		problems = append(problems, ConfigProblem{Field: "flags", Source: sourceFlag, Message: err.Error()})
+	}
+
+	path := *configPath
+	if path == "" {
+		if dir, err := configDir(); err == nil {
+			path = filepath.Join(dir, "config.json")
+		}
+	}
+	file, err := readConfigFile(path)
+	if err != nil {
+		problems = append(problems, ConfigProblem{Field: path, Source: sourceFile, Message: err.Error()})
+	}
+
+	dotEnv, err := godotenv.Read()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		problems = append(problems, ConfigProblem{Field: ".env", Source: sourceDotEnv, Message: err.Error()})
+	}
+
+	explicit := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	for _, field := range configFields {
+		if value, ok := file[field.key]; ok {
+			set(field, value, sourceFile)
+		}
+		if value, ok := dotEnv[field.env]; ok {
+			set(field, value, sourceDotEnv)
+		}
+		if value, ok := lookupEnv(field.env); ok {
+			set(field, value, sourceEnv)
+		}
+		if explicit[field.flag] {
+			set(field, *flagValues[field.key], sourceFlag)
+		}
+	}
+
+	for _, field := range configFields {
+		value := strings.TrimSpace(*field.value(&config))
+		*field.value(&config) = value
+		source, ok := sources[field.key]
+		if !ok {
+			source = sourceDefault
+		}
+		if value == "" {
+			if field.required {
+				problems = append(problems, ConfigProblem{
+					Field:   field.env,
+					Source:  source,
+					Message: "is required, set " + field.env + ", --" + field.flag + " or " + field.key + " in the config file",
+				})
+			}
+			continue
+		}
+		if field.validate != nil {
+			if err := field.validate(value); err != nil {
+				problems = append(problems, ConfigProblem{Field: field.env, Source: source, Message: err.Error()})
+			}
+		}
+	}
+	switch config.Transport {
+	case transportAmqp:
+		problems = append(problems, validateBrokerConfig(config)...)
+	case transportMqtt:
+		problems = append(problems, validateMqttConfig(config)...)
+	}
+	return config, problems
+}
+
+// defaultConnectionName names the broker connection after the app
+// and the machine, so it can be told apart in the management UI.
+func defaultConnectionName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "messenger"
+	}
+	return "messenger@" + host
+}
+
+// readConfigFile reads the JSON config file, a missing file is fine.
+func readConfigFile(path string) (map[string]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	known := make(map[string]bool, len(configFields))
+	for _, field := range configFields {
+		known[field.key] = true
+	}
+	file := make(map[string]string, len(raw))
+	var unknown []string
+	for key, value := range raw {
+		if !known[key] {
+			unknown = append(unknown, key)
+			continue
+		}
+		var s string
+		if err := json.Unmarshal(value, &s); err != nil {
+			// numbers are fine for the port
+			s = string(value)
+		}
+		file[key] = s
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return file, fmt.Errorf("unknown settings: %s", strings.Join(unknown, ", "))
+	}
+	return file, nil
+}
+
+func validateHttpUrl(value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return fmt.Errorf("is not a valid url: %v", err)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return errors.New("must be an http or https url")
+	}
+	if u.Host == "" {
+		return errors.New("must contain a host")
+	}
+	return nil
+}
+
+func validateHost(value string) error {
+	if strings.Contains(value, "://") {
+		return errors.New("must be a host name without a scheme")
+	}
+	if strings.ContainsAny(value, "/?#@ ") {
+		return errors.New("must be a plain host name")
+	}
+	return nil
+}
+
+func validatePort(value string) error {
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		return errors.New("must be a port between 1 and 65535")
+	}
+	return nil
+}
+
+func validateListenAddr(value string) error {
+	_, port, err := net.SplitHostPort(value)
+	if err != nil {
+		return errors.New("must be host:port or :port")
+	}
+	return validatePort(port)
+}
+
+func validateTransport(value string) error {
+	if value != transportAmqp && value != transportMqtt && value != transportMemory {
+		return fmt.Errorf("must be %q, %q or %q", transportAmqp, transportMqtt, transportMemory)
+	}
+	return nil
+}
+
+func validateRoomIdKey(value string) error {
+	if len(value) < 16 {
+		return errors.New("must be at least 16 characters long")
+	}
+	return nil
+}
+
+// reportConfigProblems reports the problems of the config the app was
+// created with both on the console and to the frontend
+func (a *App) reportConfigProblems() {
+	problems := a.GetConfigProblems()
+	for _, problem := range problems {
+		utils.PrintError("Invalid configuration", fmt.Errorf("%s (%s): %s", problem.Field, problem.Source, problem.Message))
+	}
+	if len(problems) > 0 {
+		a.emit(configProblemsEvent, problems)
+	}
+}
+
+// brokerConfigured reports whether the transport settings are valid,
+// so the app does not dial a half configured broker.
+func (a *App) brokerConfigured() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, problem := range a.configProblems {
+		if problem.Field == "TRANSPORT" {
+			return false
+		}
+		if a.config.Transport == transportAmqp && strings.HasPrefix(problem.Field, "RABBITMQ_") {
+			return false
+		}
+		if a.config.Transport == transportMqtt && strings.HasPrefix(problem.Field, "MQTT_") {
+			return false
+		}
+	}
+	return true
+}
+
+// GetConfigProblems returns the problems found in the
+// configuration on startup, empty if there are none
+func (a *App) GetConfigProblems() []ConfigProblem {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]ConfigProblem{}, a.configProblems...)
+}
+
+// GetPublicConfig returns the settings the frontend needs,
+// secrets stay in the backend
+func (a *App) GetPublicConfig() PublicConfig {
+	return PublicConfig{
+		AppId:           a.config.AppId,
+		AppKey:          a.config.AppKey,
+		ClusterId:       a.config.ClusterId,
+		SupaBaseUrl:     a.config.SupaBaseUrl,
+		SupaBaseAnonKey: publicSupabaseKey(a.config.SupaBaseApiKey),
+	}
+}
+
+// publicSupabaseKey returns the key if it is a Supabase anon or
+// publishable key and an empty string for any other key, most
+// importantly the service role key, which bypasses row level security.
+func publicSupabaseKey(key string) string {
+	if strings.HasPrefix(key, "sb_publishable_") || supabaseKeyRole(key) == "anon" {
+		return key
+	}
+	if key != "" {
+		utils.PrintError("Not handing the Supabase key to the frontend", errors.New("it is not the anon key"))
+	}
+	return ""
+}
+
+// supabaseKeyRole reads the role claim of a legacy Supabase API key,
+// which is a JWT. The signature does not matter here.
+func supabaseKeyRole(key string) string {
+	parts := strings.Split(key, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	var claims struct {
+		Role string `json:"role"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	return claims.Role
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// configEnv is an environment with the settings every config needs.
+func configEnv(extra map[string]string) func(string) (string, bool) {
+	env := map[string]string{
+		"SUPABASE_URL":      "https://project.supabase.co",
+		"SUPABASE_API_KEY":  "anon-key",
+		"RABBITMQ_HOST":     "broker.example.com",
+		"RABBITMQ_ADMIN":    "messenger",
+		"RABBITMQ_PASSWORD": "secret",
+	}
+	for key, value := range extra {
+		env[key] = value
+	}
+	return func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+}
+
+// inTempDir runs the test in an empty working directory, which is where
+// the .env file is read from, and returns the directory.
+func inTempDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "config"))
+	return dir
+}
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigDefaults(t *testing.T) {
+	inTempDir(t)
+	config, problems := loadConfig(nil, configEnv(nil))
+	if len(problems) > 0 {
+		t.Fatalf("problems: %+v", problems)
+	}
+	if config.RoomIdKey != defaultRoomIdKey {
+		t.Errorf("room id key %q, want the built-in one", config.RoomIdKey)
+	}
+	if config.SupaBaseUrl != "https://project.supabase.co" {
+		t.Errorf("Supabase url %q", config.SupaBaseUrl)
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	dir := inTempDir(t)
+	configPath := filepath.Join(dir, "config.json")
+	writeTestFile(t, configPath, `{"rabbitMqPort": 1001}`)
+	load := func(flags []string, env map[string]string) string {
+		t.Helper()
+		config, problems := loadConfig(append([]string{"--config", configPath}, flags...), configEnv(env))
+		if len(problems) > 0 {
+			t.Fatalf("problems: %+v", problems)
+		}
+		return config.RabbitMqPort
+	}
+
+	if port := load(nil, nil); port != "1001" {
+		t.Errorf("config file: port %s", port)
+	}
+	writeTestFile(t, filepath.Join(dir, ".env"), "RABBITMQ_PORT=1002\n")
+	if port := load(nil, nil); port != "1002" {
+		t.Errorf(".env over the config file: port %s", port)
+	}
+	env := map[string]string{"RABBITMQ_PORT": "1003"}
+	if port := load(nil, env); port != "1003" {
+		t.Errorf("environment over .env: port %s", port)
+	}
+	if port := load([]string{"--rabbitmq-port", "1004"}, env); port != "1004" {
+		t.Errorf("flag over the environment: port %s", port)
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	dir := inTempDir(t)
+	configPath := filepath.Join(dir, "config.json")
+	writeTestFile(t, configPath, `{"rabbitMqPort": "70000", "colour": "blue"}`)
+
+	_, problems := loadConfig([]string{"--config", configPath, "--room-id-key", "too short"}, configEnv(map[string]string{
+		"SUPABASE_URL":     "ftp://project.supabase.co",
+		"SUPABASE_API_KEY": " ",
+	}))
+	want := map[string]string{
+		configPath:         sourceFile,
+		"SUPABASE_URL":     sourceEnv,
+		"SUPABASE_API_KEY": sourceEnv,
+		"RABBITMQ_PORT":    sourceFile,
+		"ROOM_ID_KEY":      sourceFlag,
+	}
+	for _, problem := range problems {
+		source, ok := want[problem.Field]
+		if !ok {
+			t.Errorf("unexpected problem %+v", problem)
+			continue
+		}
+		if problem.Source != source {
+			t.Errorf("%s: source %s, want %s", problem.Field, problem.Source, source)
+		}
+		delete(want, problem.Field)
+	}
+	for field := range want {
+		t.Errorf("%s was not reported", field)
+	}
+}
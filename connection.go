@@ -0,0 +1,286 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	utils "github.com/benni347/messengerutils"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	reconnectMinDelay = 500 * time.Millisecond
+	reconnectMaxDelay = 30 * time.Second
+)
+
+var (
+	errNotConnected = errors.New("not connected to the broker")
+	errBlocked      = errors.New("RabbitMQ connection is blocked by the broker")
+	errManagerDone  = errors.New("connection manager is closed")
+)
+
+// connectionManager owns the single long-lived AMQP connection of the app.
+// It keeps one publishing channel around, watches the connection for
+// close and blocked notifications and reconnects with an exponential
+// backoff whenever the broker goes away. With several brokers it fails
+// over to the next one, starting with the one that worked last.
+type connectionManager struct {
+	endpoints []amqpEndpoint
+	randomize bool
+	verbose   bool
+
+	mu      sync.Mutex
+	conn    *amqp.Connection
+	channel *amqp.Channel
+	blocked bool
+	closed  bool
+	// healthy is the index of the endpoint that was connected last,
+	// current the one of the open connection or -1
+	healthy int
+	current int
+
+	// connected is emitted every time a connection was established,
+	// disconnected every time it was lost
+	connected    utils.Event
+	disconnected utils.Event
+
+	done chan struct{}
+}
+
+// newConnectionManager creates a manager for the given AMQP endpoints.
+// Call start to establish the connection.
+func newConnectionManager(endpoints []amqpEndpoint, randomize bool, verbose bool) *connectionManager {
+	return &connectionManager{
+		endpoints: endpoints,
+		randomize: randomize,
+		verbose:   verbose,
+		healthy:   -1,
+		current:   -1,
+		done:      make(chan struct{}),
+	}
+}
+
+// start connects in the background and keeps the connection alive
+// until close is called.
+func (c *connectionManager) start() {
+	go c.run()
+}
+
+func (c *connectionManager) run() {
+	m := &utils.MessengerUtils{
+		Verbose: c.verbose,
+	}
+	delay := reconnectMinDelay
+	for {
+		conn, index, err := c.dial()
+		if err != nil {
+			select {
+			case <-c.done:
+				return
+			case <-time.After(delay):
+			}
+			delay *= 2
+			if delay > reconnectMaxDelay {
+				delay = reconnectMaxDelay
+			}
+			continue
+		}
+		delay = reconnectMinDelay
+		m.PrintInfo("Connected to RabbitMQ at " + c.endpoints[index].String())
+
+		closeCh := conn.NotifyClose(make(chan *amqp.Error, 1))
+		blockedCh := conn.NotifyBlocked(make(chan amqp.Blocking, 1))
+
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			if err := conn.Close(); err != nil {
+				utils.PrintError("closing connection", err)
+			}
+			return
+		}
+		c.conn = conn
+		c.blocked = false
+		c.healthy = index
+		c.current = index
+		c.mu.Unlock()
+		c.connected.Emit(nil)
+
+		if !c.watch(closeCh, blockedCh) {
+			return
+		}
+		c.disconnected.Emit(nil)
+		m.PrintInfo("Lost connection to RabbitMQ, reconnecting")
+	}
+}
+
+// dial tries the endpoints one after the other and returns the first
+// connection that could be established together with its index.
+func (c *connectionManager) dial() (*amqp.Connection, int, error) {
+	var err error
+	for _, index := range c.order() {
+		var conn *amqp.Connection
+		conn, err = c.endpoints[index].dial()
+		if err == nil {
+			return conn, index, nil
+		}
+		utils.PrintError("Failed to connect to RabbitMQ at "+c.endpoints[index].String(), err)
+	}
+	if err == nil {
+		err = errNoBroker
+	}
+	return nil, -1, err
+}
+
+// order returns the indexes of the endpoints in the order they are
+// tried in: the last healthy one first, then the others.
+func (c *connectionManager) order() []int {
+	c.mu.Lock()
+	healthy := c.healthy
+	c.mu.Unlock()
+
+	others := make([]int, 0, len(c.endpoints))
+	for i := range c.endpoints {
+		if i != healthy {
+			others = append(others, i)
+		}
+	}
+	if c.randomize {
+		rand.Shuffle(len(others), func(i, j int) {
+			others[i], others[j] = others[j], others[i]
+		})
+	}
+	if healthy < 0 || healthy >= len(c.endpoints) {
+		return others
+	}
+	return append([]int{healthy}, others...)
+}
+
+// watch blocks until the connection is lost or the manager is closed.
+// It returns false once the manager should stop reconnecting.
+func (c *connectionManager) watch(closeCh <-chan *amqp.Error, blockedCh <-chan amqp.Blocking) bool {
+	for {
+		select {
+		case <-c.done:
+			return false
+		case b, ok := <-blockedCh:
+			if !ok {
+				// closed along with the connection, a nil channel
+				// keeps the select from spinning on it
+				blockedCh = nil
+				continue
+			}
+			c.mu.Lock()
+			c.blocked = b.Active
+			c.mu.Unlock()
+			if b.Active {
+				utils.PrintError("RabbitMQ blocked the connection", errors.New(b.Reason))
+			} else {
+				c.connected.Emit(nil)
+			}
+		case err := <-closeCh:
+			if err != nil {
+				utils.PrintError("RabbitMQ connection closed", err)
+			}
+			c.mu.Lock()
+			c.conn = nil
+			c.channel = nil
+			c.blocked = false
+			c.current = -1
+			c.mu.Unlock()
+			return true
+		}
+	}
+}
+
+// Channel returns the shared publishing channel, opening a new one on
+// the current connection if the previous channel was closed.
+// The channel is in confirm mode, so publishes must be confirmed.
+func (c *connectionManager) Channel() (*amqp.Channel, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, errManagerDone
+	}
+	if c.conn == nil || c.conn.IsClosed() {
+		return nil, errNotConnected
+	}
+	if c.blocked {
+		return nil, errBlocked
+	}
+	if c.channel != nil && !c.channel.IsClosed() {
+		return c.channel, nil
+	}
+	channel, err := c.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	if err := channel.Confirm(false); err != nil {
+		_ = channel.Close()
+		return nil, err
+	}
+	c.channel = channel
+	return channel, nil
+}
+
+// NewChannel opens a dedicated channel on the current connection,
+// for users such as consumers that must not share the publishing channel.
+func (c *connectionManager) NewChannel() (*amqp.Channel, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, errManagerDone
+	}
+	if c.conn == nil || c.conn.IsClosed() {
+		return nil, errNotConnected
+	}
+	return c.conn.Channel()
+}
+
+// IsConnected reports whether there currently is an open connection.
+func (c *connectionManager) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn != nil && !c.conn.IsClosed()
+}
+
+// status reports the broker the manager is connected to.
+func (c *connectionManager) status() BrokerStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil || c.conn.IsClosed() || c.current < 0 {
+		return BrokerStatus{}
+	}
+	return BrokerStatus{
+		Connected: true,
+		Blocked:   c.blocked,
+		Broker:    c.endpoints[c.current].String(),
+	}
+}
+
+// close stops reconnecting and tears down the connection.
+func (c *connectionManager) close() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	close(c.done)
+	conn, channel := c.conn, c.channel
+	c.conn, c.channel = nil, nil
+	c.mu.Unlock()
+
+	if channel != nil {
+		if err := channel.Close(); err != nil {
+			utils.PrintError("closing channel", err)
+		}
+	}
+	if conn != nil {
+		if err := conn.Close(); err != nil {
+			utils.PrintError("closing connection", err)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+
+	utils "github.com/benni347/messengerutils"
+)
+
+// messageReceivedEvent is the name of the Wails event every incoming
+// message is emitted under, the payload is the decoded Message.
+const messageReceivedEvent = "message:received"
+
+var errSenderNotAMember = errors.New("the sender is not a member of the chat room")
+
+// startConsuming stops the running consumer and starts consuming
+// from the inbox of the current user, if there is a transport to use.
+func (a *App) startConsuming() {
+	a.stopConsuming()
+	if a.transport == nil {
+		return
+	}
+
+	a.mu.Lock()
+	userId := a.user.id
+	a.mu.Unlock()
+	cancel := a.transport.Subscribe(userId, a.subscribedRooms, a.receive)
+
+	a.mu.Lock()
+	a.user.stop = cancel
+	a.mu.Unlock()
+}
+
+// stopConsuming cancels the running consumer, if there is one.
+func (a *App) stopConsuming() {
+	a.mu.Lock()
+	stop := a.user.stop
+	a.user.stop = nil
+	a.mu.Unlock()
+
+	if stop != nil {
+		stop()
+	}
+}
+
+// isConsuming reports whether a consumer was started.
+func (a *App) isConsuming() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.user.stop != nil
+}
+
+// subscribedRooms lists the rooms the inbox of the user receives:
+// every room the user belongs to and the active one.
+func (a *App) subscribedRooms() []string {
+	me := a.getSenderId()
+	var rooms []string
+	for _, room := range a.rooms.list() {
+		if _, ok := room.member(me); ok {
+			rooms = append(rooms, room.Id)
+		}
+	}
+	if active := a.getQueueName(); active != "" && a.authorizeRoom(active) == nil {
+		rooms = append(rooms, active)
+	}
+	return rooms
+}
+
+// subscribe makes the running consumer receive the room.
+// If no consumer is running yet, the room is joined once it starts.
+func (a *App) subscribe(roomId string) error {
+	if a.transport == nil {
+		return nil
+	}
+	return a.transport.Join(roomId)
+}
+
+// unsubscribe stops delivering the room to the inbox of the user.
+func (a *App) unsubscribe(roomId, userId string) error {
+	if a.transport == nil {
+		return errNotConnected
+	}
+	return a.transport.Leave(userId, roomId)
+}
+
+// receive verifies and, if needed, decrypts a message and hands it to
+// the frontend, room announcements update the room directory instead.
+// The echo of an encrypted message the user sent is dropped, so are
+// replayed messages and messages of senders who are not members of the
+// room.
+func (a *App) receive(message Message) {
+	if message.ContentType != roomContentType {
+		// room updates check the sender against the known room
+		// themselves, everything else is dropped before its keys are
+		// fetched
+		if err := a.checkSender(message); err != nil {
+			utils.PrintError("Ignoring a message from "+message.Sender, err)
+			return
+		}
+	}
+	a.verify(&message)
+	message.Encrypted = false
+	if message.ContentType == ratchetContentType {
+		if message.Sender == a.getSenderId() {
+			// only the peer can read it, the sender already shows it
+			return
+		}
+		if err := a.decrypt(&message); err != nil {
+			if errors.Is(err, errReplayed) {
+				utils.PrintError("Ignoring a message from "+message.Sender, err)
+				return
+			}
+			if errors.Is(err, errUndecryptable) {
+				// a key change shows as a message that does not decrypt
+				if _, keyErr := a.refetchContactKeys(message.Sender); keyErr != nil {
+					err = keyErr
+				}
+			}
+			utils.PrintError("Failed to decrypt a message from "+message.Sender, err)
+			a.emitMessageError(message, err)
+			return
+		}
+		message.Encrypted = true
+	}
+
+	if message.ContentType == roomContentType {
+		if !message.Verified {
+			utils.PrintError("Ignoring an unverified room update from "+message.Sender, errors.New(message.Warning))
+			return
+		}
+		if err := a.applyRoomUpdate(message); err != nil {
+			utils.PrintError("Ignoring a room update from "+message.Sender, err)
+		}
+		return
+	}
+	a.emit(messageReceivedEvent, message)
+}
+
+// checkSender makes sure the sender of the message belongs to its room.
+// Everybody may write to the public room. A direct room the user does not
+// know yet is accepted if its id is the one of the user and the sender.
+func (a *App) checkSender(message Message) error {
+	if message.ChatRoomId == publicChatRoomId {
+		return nil
+	}
+	if room, ok := a.rooms.get(message.ChatRoomId); ok {
+		if _, ok := room.member(message.Sender); !ok {
+			return errSenderNotAMember
+		}
+		return nil
+	}
+	direct, err := directRoomId([]byte(a.config.RoomIdKey), a.getSenderId(), message.Sender)
+	if err != nil || direct != message.ChatRoomId {
+		return errSenderNotAMember
+	}
+	return nil
+}
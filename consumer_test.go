@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReceiveLimitsKeyFetches(t *testing.T) {
+	alice := fixedIdentity(t, 9, 13)
+	bob := fixedIdentity(t, 7, 8)
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		_ = json.NewEncoder(w).Encode([]profileKeys{alice.publicKeys(aliceId)})
+	}))
+	defer server.Close()
+
+	a := newSessionApp(t, bob, alice)
+	a.config.RoomIdKey = "a room id key for the tests"
+	a.supabase = newSupabaseClient(server.URL, "anon-key")
+	a.supabase.setAccessToken("access-token")
+	a.trust = &trustStore{path: filepath.Join(t.TempDir(), "trust.json"), entries: make(map[string]trustEntry)}
+	var received []Message
+	a.events = func(name string, data interface{}) {
+		if name == messageReceivedEvent {
+			received = append(received, data.(Message))
+		}
+	}
+	direct, err := directRoomId([]byte(a.config.RoomIdKey), bobId, aliceId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a stranger in the direct room is dropped before asking for keys
+	a.receive(Message{Version: messageVersion, Id: "stranger", ChatRoomId: direct, Sender: carolId, ContentType: textContentType, Message: "hi"})
+	if n := atomic.LoadInt32(&fetches); n != 0 || len(received) != 0 {
+		t.Fatalf("%d key fetches and %d messages for a stranger", n, len(received))
+	}
+
+	// messages that do not verify fetch the keys of the sender once
+	for i := 0; i < 5; i++ {
+		msg := Message{Version: messageVersion, Id: "m" + strconv.Itoa(i), ChatRoomId: direct, Sender: aliceId, ContentType: textContentType, Message: "hi"}
+		signMessage(bob.signing, &msg)
+		a.receive(msg)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("%d key fetches, want 1", n)
+	}
+	if len(received) != 5 {
+		t.Fatalf("%d messages received, want 5", len(received))
+	}
+	for _, msg := range received {
+		if msg.Verified || msg.Warning == "" {
+			t.Errorf("%s is shown as verified", msg.Id)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+const (
+	// contactsTable holds the contacts of all users, one row per user and
+	// contact, owned by the user. Adding a contact creates the row of the
+	// requester with the status pending, which the other user sees as a
+	// request. Accepting it marks it accepted and creates the row of the
+	// other user, declining marks it declined.
+	contactsTable = "contacts"
+	// findUserRpc is a database function that looks up users by their
+	// exact user name or email address and answers with their ids and
+	// user names, so nobody can list the users or read their addresses.
+	findUserRpc = "rpc/find_user"
+)
+
+// The statuses of a contact. Requested is never stored, it is how a
+// pending row of another user looks to the user it asks.
+const (
+	contactPending   = "pending"
+	contactRequested = "requested"
+	contactAccepted  = "accepted"
+	contactDeclined  = "declined"
+)
+
+var (
+	errUserNotFound     = errors.New("no user with this user name or email address")
+	errAmbiguousUser    = errors.New("more than one user has this user name, use the email address")
+	errNoContact        = errors.New("not a contact")
+	errNoContactRequest = errors.New("no contact request from this user")
+)
+
+// Contact is another user in the contacts of the signed in user.
+// Status is pending until the other user answered the request,
+// requested while the signed in user did not answer the request of
+// the other user, then accepted or declined.
+type Contact struct {
+	UserId   string `json:"userId"`
+	UserName string `json:"userName"`
+	Nickname string `json:"nickname"`
+	Status   string `json:"status"`
+}
+
+// contactRow is a row of the contactsTable. The user names are kept
+// along, so both users know who they talk to without further lookups.
+// The database fills them in from the accounts of both users whenever a
+// row is written, the names the app sends are never used.
+type contactRow struct {
+	OwnerId     string `json:"owner_id"`
+	ContactId   string `json:"contact_id"`
+	Status      string `json:"status"`
+	Nickname    string `json:"nickname,omitempty"`
+	OwnerName   string `json:"owner_name,omitempty"`
+	ContactName string `json:"contact_name,omitempty"`
+}
+
+// contact is the row as its owner sees it.
+func (r contactRow) contact() Contact {
+	return Contact{
+		UserId:   r.ContactId,
+		UserName: r.ContactName,
+		Nickname: r.Nickname,
+		Status:   r.Status,
+	}
+}
+
+// request is the pending row as the user it asks sees it.
+func (r contactRow) request() Contact {
+	return Contact{
+		UserId:   r.OwnerId,
+		UserName: r.OwnerName,
+		Status:   contactRequested,
+	}
+}
+
+// foundUser is a user findUserRpc answers with.
+type foundUser struct {
+	Id       string `json:"id"`
+	UserName string `json:"user_name"`
+}
+
+// findUser looks up a user by user name or email address.
+func (s *supabaseClient) findUser(query string) ([]foundUser, error) {
+	var users []foundUser
+	err := s.rest("POST", findUserRpc, nil, map[string]string{"query": query}, &users, nil)
+	return users, err
+}
+
+// contactRows reads the rows of the contactsTable matching the filter.
+func (s *supabaseClient) contactRows(filter url.Values) ([]contactRow, error) {
+	var rows []contactRow
+	err := s.rest("GET", contactsTable, filter, nil, &rows, nil)
+	return rows, err
+}
+
+// upsertContact creates the row or replaces the one of the same owner
+// and contact, and returns it with the user names the database filled
+// in. A nickname is only replaced if the row has one.
+func (s *supabaseClient) upsertContact(row contactRow) (contactRow, error) {
+	var rows []contactRow
+	err := s.rest(
+		"POST",
+		contactsTable,
+		url.Values{"on_conflict": {"owner_id,contact_id"}},
+		row,
+		&rows,
+		map[string]string{"Prefer": "resolution=merge-duplicates,return=representation"},
+	)
+	if err != nil {
+		return contactRow{}, err
+	}
+	if len(rows) == 0 {
+		return contactRow{}, errNoContact
+	}
+	return rows[0], nil
+}
+
+// updateContacts changes the rows matching the filter and returns them.
+func (s *supabaseClient) updateContacts(filter url.Values, changes map[string]string) ([]contactRow, error) {
+	var rows []contactRow
+	err := s.rest("PATCH", contactsTable, filter, changes, &rows, map[string]string{"Prefer": "return=representation"})
+	return rows, err
+}
+
+// contactFilter matches the row of the owner for the contact.
+func contactFilter(ownerId, contactId string) url.Values {
+	return url.Values{
+		"owner_id":   {"eq." + ownerId},
+		"contact_id": {"eq." + contactId},
+	}
+}
+
+// AddContact asks the user with the user name or email address to
+// become a contact. If that user asked first, the request is accepted
+func (a *App) AddContact(query string) (Contact, error) {
+	me := a.getSenderId()
+	if me == "" {
+		return Contact{}, errNotSignedIn
+	}
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return Contact{}, errUserNotFound
+	}
+	users, err := a.supabase.findUser(query)
+	if err != nil {
+		return Contact{}, err
+	}
+	// user names are not unique, only an exact single match is asked
+	if len(users) == 0 {
+		return Contact{}, errUserNotFound
+	}
+	if len(users) != 1 {
+		return Contact{}, errAmbiguousUser
+	}
+	other, err := normalizeUserId(users[0].Id)
+	if err != nil {
+		return Contact{}, err
+	}
+	if other == me {
+		return Contact{}, errSameUser
+	}
+
+	own, err := a.supabase.contactRows(contactFilter(me, other))
+	if err != nil {
+		return Contact{}, err
+	}
+	if len(own) > 0 && own[0].Status == contactAccepted {
+		return own[0].contact(), nil
+	}
+	filter := contactFilter(other, me)
+	filter.Set("status", "eq."+contactPending)
+	incoming, err := a.supabase.contactRows(filter)
+	if err != nil {
+		return Contact{}, err
+	}
+	if len(incoming) > 0 {
+		return a.AcceptContact(other)
+	}
+
+	row, err := a.supabase.upsertContact(contactRow{OwnerId: me, ContactId: other, Status: contactPending})
+	if err != nil {
+		return Contact{}, err
+	}
+	return row.contact(), nil
+}
+
+// AcceptContact accepts the contact request of the user
+func (a *App) AcceptContact(userId string) (Contact, error) {
+	me, other, err := a.contactIds(userId)
+	if err != nil {
+		return Contact{}, err
+	}
+	filter := contactFilter(other, me)
+	filter.Set("status", "eq."+contactPending)
+	requests, err := a.supabase.updateContacts(filter, map[string]string{"status": contactAccepted})
+	if err != nil {
+		return Contact{}, err
+	}
+	if len(requests) == 0 {
+		return Contact{}, errNoContactRequest
+	}
+	row, err := a.supabase.upsertContact(contactRow{OwnerId: me, ContactId: other, Status: contactAccepted})
+	if err != nil {
+		return Contact{}, err
+	}
+	return row.contact(), nil
+}
+
+// DeclineContact declines the contact request of the user
+func (a *App) DeclineContact(userId string) error {
+	me, other, err := a.contactIds(userId)
+	if err != nil {
+		return err
+	}
+	filter := contactFilter(other, me)
+	filter.Set("status", "eq."+contactPending)
+	requests, err := a.supabase.updateContacts(filter, map[string]string{"status": contactDeclined})
+	if err != nil {
+		return err
+	}
+	if len(requests) == 0 {
+		return errNoContactRequest
+	}
+	return nil
+}
+
+// SetContactNickname names the contact in the contacts of the signed
+// in user, an empty nickname removes the name
+func (a *App) SetContactNickname(userId, nickname string) (Contact, error) {
+	me, other, err := a.contactIds(userId)
+	if err != nil {
+		return Contact{}, err
+	}
+	rows, err := a.supabase.updateContacts(contactFilter(me, other), map[string]string{"nickname": strings.TrimSpace(nickname)})
+	if err != nil {
+		return Contact{}, err
+	}
+	if len(rows) == 0 {
+		return Contact{}, errNoContact
+	}
+	return rows[0].contact(), nil
+}
+
+// GetContacts lists the contact requests of other users
+// followed by the contacts of the signed in user
+func (a *App) GetContacts() ([]Contact, error) {
+	me := a.getSenderId()
+	if me == "" {
+		return nil, errNotSignedIn
+	}
+	requests, err := a.supabase.contactRows(url.Values{
+		"contact_id": {"eq." + me},
+		"status":     {"eq." + contactPending},
+		"order":      {"owner_name.asc"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	own, err := a.supabase.contactRows(url.Values{
+		"owner_id": {"eq." + me},
+		"order":    {"contact_name.asc"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	contacts := make([]Contact, 0, len(requests)+len(own))
+	for _, row := range requests {
+		contacts = append(contacts, row.request())
+	}
+	for _, row := range own {
+		contacts = append(contacts, row.contact())
+	}
+	return contacts, nil
+}
+
+// contactIds returns the id of the signed in user and the validated id
+// of the other user.
+func (a *App) contactIds(userId string) (string, string, error) {
+	me := a.getSenderId()
+	if me == "" {
+		return "", "", errNotSignedIn
+	}
+	other, err := normalizeUserId(userId)
+	if err != nil {
+		return "", "", err
+	}
+	if other == me {
+		return "", "", errSameUser
+	}
+	return me, other, nil
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	graceId = "2b7e1516-28ae-4d2a-a6ab-f7158809cf4f"
+	alanId  = "6bc1bee2-2e40-4f96-9f3b-a2f5c5e0c1d3"
+	alan2Id = "ae2d8a57-1e03-4ac9-9c9e-5fd0e1f2a3b4"
+	zoeId   = "30c81c46-a35c-4e11-8b1f-7d1a5c3e9f20"
+)
+
+// fakeUser is a user the fake contacts table knows.
+type fakeUser struct {
+	id    string
+	name  string
+	email string
+}
+
+// fakeContacts is the part of PostgREST the contacts use: the
+// contactsTable with eq filters, order, upserts and updates, and
+// findUserRpc. Like the database it fills in the user names of every
+// written row from the users.
+type fakeContacts struct {
+	mu    sync.Mutex
+	users []fakeUser
+	rows  []contactRow
+}
+
+func newFakeContacts(rows ...contactRow) *fakeContacts {
+	c := &fakeContacts{
+		users: []fakeUser{
+			{testUserId, "ada", "ada@example.com"},
+			{graceId, "grace", "grace@example.com"},
+			{alanId, "alan", "alan@example.com"},
+			{alan2Id, "alan", "turing@example.com"},
+			{zoeId, "zoe", "zoe@example.com"},
+		},
+	}
+	for _, row := range rows {
+		c.rows = append(c.rows, c.named(row))
+	}
+	return c
+}
+
+// newContactsApp returns an app signed in as the test user whose
+// contacts are kept in the fake.
+func newContactsApp(t *testing.T, contacts *fakeContacts) (*App, *fakeSupabase) {
+	t.Helper()
+	a, fake := newSupabaseApp(t, contacts.answer)
+	var session authSession
+	if err := json.Unmarshal([]byte(sessionJson(t, "aal1", "")), &session); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.signInWith(&session); err != nil {
+		t.Fatal(err)
+	}
+	return a, fake
+}
+
+func (c *fakeContacts) answer(r supabaseRequest) (int, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch r.path {
+	case "/rest/v1/" + findUserRpc:
+		var body map[string]string
+		if err := json.Unmarshal(r.body, &body); err != nil {
+			return http.StatusBadRequest, `{}`
+		}
+		found := []foundUser{}
+		for _, user := range c.users {
+			if user.name == body["query"] || user.email == strings.ToLower(body["query"]) {
+				found = append(found, foundUser{Id: user.id, UserName: user.name})
+			}
+		}
+		return c.reply(http.StatusOK, found)
+	case "/rest/v1/" + contactsTable:
+	default:
+		return http.StatusNotFound, `{}`
+	}
+
+	query, _ := url.ParseQuery(r.query)
+	switch r.method {
+	case "GET":
+		rows := c.matching(query)
+		switch query.Get("order") {
+		case "owner_name.asc":
+			sort.SliceStable(rows, func(i, j int) bool { return rows[i].OwnerName < rows[j].OwnerName })
+		case "contact_name.asc":
+			sort.SliceStable(rows, func(i, j int) bool { return rows[i].ContactName < rows[j].ContactName })
+		}
+		return c.reply(http.StatusOK, rows)
+	case "PATCH":
+		var changes map[string]string
+		if err := json.Unmarshal(r.body, &changes); err != nil {
+			return http.StatusBadRequest, `{}`
+		}
+		updated := []contactRow{}
+		for i, row := range c.rows {
+			if !rowMatches(row, query) {
+				continue
+			}
+			if status, ok := changes["status"]; ok {
+				row.Status = status
+			}
+			if nickname, ok := changes["nickname"]; ok {
+				row.Nickname = nickname
+			}
+			c.rows[i] = c.named(row)
+			updated = append(updated, c.rows[i])
+		}
+		return c.reply(http.StatusOK, updated)
+	case "POST":
+		if query.Get("on_conflict") != "owner_id,contact_id" {
+			return http.StatusBadRequest, `{}`
+		}
+		var row contactRow
+		if err := json.Unmarshal(r.body, &row); err != nil {
+			return http.StatusBadRequest, `{}`
+		}
+		for i, existing := range c.rows {
+			if existing.OwnerId == row.OwnerId && existing.ContactId == row.ContactId {
+				// merge-duplicates only sets the columns of the body
+				existing.Status = row.Status
+				if row.Nickname != "" {
+					existing.Nickname = row.Nickname
+				}
+				c.rows[i] = c.named(existing)
+				return c.reply(http.StatusCreated, []contactRow{c.rows[i]})
+			}
+		}
+		row = c.named(row)
+		c.rows = append(c.rows, row)
+		return c.reply(http.StatusCreated, []contactRow{row})
+	}
+	return http.StatusMethodNotAllowed, `{}`
+}
+
+// named is the row with the user names of its users.
+func (c *fakeContacts) named(row contactRow) contactRow {
+	row.OwnerName, row.ContactName = "", ""
+	for _, user := range c.users {
+		if user.id == row.OwnerId {
+			row.OwnerName = user.name
+		}
+		if user.id == row.ContactId {
+			row.ContactName = user.name
+		}
+	}
+	return row
+}
+
+func (c *fakeContacts) matching(query url.Values) []contactRow {
+	rows := []contactRow{}
+	for _, row := range c.rows {
+		if rowMatches(row, query) {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+func (c *fakeContacts) reply(status int, v interface{}) (int, string) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return http.StatusInternalServerError, `{}`
+	}
+	return status, string(data)
+}
+
+// row returns the row of the owner for the contact.
+func (c *fakeContacts) row(ownerId, contactId string) (contactRow, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, row := range c.rows {
+		if row.OwnerId == ownerId && row.ContactId == contactId {
+			return row, true
+		}
+	}
+	return contactRow{}, false
+}
+
+func rowMatches(row contactRow, query url.Values) bool {
+	for key, value := range map[string]string{
+		"owner_id":   row.OwnerId,
+		"contact_id": row.ContactId,
+		"status":     row.Status,
+	} {
+		if filter := query.Get(key); filter != "" && filter != "eq."+value {
+			return false
+		}
+	}
+	return true
+}
+
+func TestAddContact(t *testing.T) {
+	contacts := newFakeContacts()
+	a, fake := newContactsApp(t, contacts)
+
+	contact, err := a.AddContact(" grace ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Contact{UserId: graceId, UserName: "grace", Status: contactPending}
+	if contact != want {
+		t.Errorf("contact %+v, want %+v", contact, want)
+	}
+	if row, ok := contacts.row(testUserId, graceId); !ok || row.Status != contactPending {
+		t.Errorf("row %+v", row)
+	}
+	upserts := fake.find("POST", "/rest/v1/"+contactsTable)
+	if len(upserts) != 1 {
+		t.Fatalf("%d upserts", len(upserts))
+	}
+	// the names come from the database, never from the app
+	if body := string(upserts[0].body); strings.Contains(body, "_name") {
+		t.Errorf("the app sent the names: %s", body)
+	}
+
+	// asking again keeps the request
+	if contact, err := a.AddContact("grace@example.com"); err != nil || contact != want {
+		t.Errorf("asking again: %+v, %v", contact, err)
+	}
+
+	for query, wantErr := range map[string]error{
+		"":                   errUserNotFound,
+		"nobody":             errUserNotFound,
+		"ada":                errSameUser,
+		"alan":               errAmbiguousUser,
+		"turing@example.com": nil,
+	} {
+		if _, err := a.AddContact(query); !errors.Is(err, wantErr) {
+			t.Errorf("%q: %v, want %v", query, err, wantErr)
+		}
+	}
+	if _, ok := contacts.row(testUserId, alanId); ok {
+		t.Error("asked the first of the ambiguous users")
+	}
+	if _, ok := contacts.row(testUserId, alan2Id); !ok {
+		t.Error("the user found by the email address was not asked")
+	}
+}
+
+func TestAddContactAcceptsIncomingRequest(t *testing.T) {
+	contacts := newFakeContacts(contactRow{OwnerId: graceId, ContactId: testUserId, Status: contactPending})
+	a, _ := newContactsApp(t, contacts)
+
+	contact, err := a.AddContact("grace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Contact{UserId: graceId, UserName: "grace", Status: contactAccepted}
+	if contact != want {
+		t.Errorf("contact %+v, want %+v", contact, want)
+	}
+	if row, _ := contacts.row(graceId, testUserId); row.Status != contactAccepted {
+		t.Errorf("the request is %s", row.Status)
+	}
+	if row, _ := contacts.row(testUserId, graceId); row.Status != contactAccepted {
+		t.Errorf("the own row is %s", row.Status)
+	}
+
+	// an accepted contact is returned as it is
+	if contact, err := a.AddContact("grace"); err != nil || contact != want {
+		t.Errorf("adding again: %+v, %v", contact, err)
+	}
+}
+
+func TestDeclineContact(t *testing.T) {
+	contacts := newFakeContacts(contactRow{OwnerId: graceId, ContactId: testUserId, Status: contactPending})
+	a, _ := newContactsApp(t, contacts)
+
+	if err := a.DeclineContact(graceId); err != nil {
+		t.Fatal(err)
+	}
+	if row, _ := contacts.row(graceId, testUserId); row.Status != contactDeclined {
+		t.Errorf("the request is %s", row.Status)
+	}
+	if _, ok := contacts.row(testUserId, graceId); ok {
+		t.Error("declining created a contact")
+	}
+
+	// the request was answered
+	if err := a.DeclineContact(graceId); !errors.Is(err, errNoContactRequest) {
+		t.Errorf("declining twice: %v", err)
+	}
+	if _, err := a.AcceptContact(graceId); !errors.Is(err, errNoContactRequest) {
+		t.Errorf("accepting a declined request: %v", err)
+	}
+	if err := a.DeclineContact("not a user"); !errors.Is(err, errInvalidUserId) {
+		t.Errorf("invalid user id: %v", err)
+	}
+}
+
+func TestSetContactNickname(t *testing.T) {
+	contacts := newFakeContacts(contactRow{OwnerId: testUserId, ContactId: graceId, Status: contactAccepted})
+	a, _ := newContactsApp(t, contacts)
+
+	contact, err := a.SetContactNickname(graceId, " Gracie ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Contact{UserId: graceId, UserName: "grace", Nickname: "Gracie", Status: contactAccepted}
+	if contact != want {
+		t.Errorf("contact %+v, want %+v", contact, want)
+	}
+
+	if contact, err := a.SetContactNickname(graceId, ""); err != nil || contact.Nickname != "" {
+		t.Errorf("removing the nickname: %+v, %v", contact, err)
+	}
+	if _, err := a.SetContactNickname(zoeId, "Zo"); !errors.Is(err, errNoContact) {
+		t.Errorf("nickname of a stranger: %v", err)
+	}
+}
+
+func TestGetContacts(t *testing.T) {
+	contacts := newFakeContacts(
+		contactRow{OwnerId: testUserId, ContactId: zoeId, Status: contactAccepted},
+		contactRow{OwnerId: testUserId, ContactId: alanId, Status: contactPending},
+		contactRow{OwnerId: zoeId, ContactId: testUserId, Status: contactAccepted},
+		contactRow{OwnerId: graceId, ContactId: testUserId, Status: contactPending},
+		contactRow{OwnerId: alan2Id, ContactId: testUserId, Status: contactPending},
+		contactRow{OwnerId: graceId, ContactId: zoeId, Status: contactPending},
+	)
+	a, _ := newSupabaseApp(t, contacts.answer)
+	if _, err := a.GetContacts(); !errors.Is(err, errNotSignedIn) {
+		t.Fatalf("signed out: %v", err)
+	}
+	a, _ = newContactsApp(t, contacts)
+
+	got, err := a.GetContacts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the requests to the user come first, each part by user name
+	want := []Contact{
+		{UserId: alan2Id, UserName: "alan", Status: contactRequested},
+		{UserId: graceId, UserName: "grace", Status: contactRequested},
+		{UserId: alanId, UserName: "alan", Status: contactPending},
+		{UserId: zoeId, UserName: "zoe", Status: contactAccepted},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("contacts %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("contact %d is %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// messageStatusEvent is emitted with a DeliveryStatus
+	// every time the state of a sent message changes.
+	messageStatusEvent = "message:status"
+	// confirmTimeout is how long the broker has to confirm a message.
+	confirmTimeout = 10 * time.Second
+)
+
+// DeliveryState is the state of a sent message.
+// A message starts out pending and becomes either confirmed
+// once the broker acknowledged it or failed. Failed messages
+// can be retried, which makes them pending again.
+type DeliveryState string
+
+const (
+	DeliveryPending   DeliveryState = "pending"
+	DeliveryConfirmed DeliveryState = "confirmed"
+	DeliveryFailed    DeliveryState = "failed"
+)
+
+var (
+	errUnknownMessage = errors.New("unknown message id")
+	errNotConfirmed   = errors.New("the broker did not confirm the message")
+	errConfirmTimeout = errors.New("the broker did not confirm the message in time")
+)
+
+// DeliveryStatus describes where a sent message currently stands.
+type DeliveryStatus struct {
+	MessageId  string        `json:"messageId"`
+	ChatRoomId string        `json:"chatRoomId"`
+	State      DeliveryState `json:"state"`
+	Error      string        `json:"error"`
+}
+
+type trackedMessage struct {
+	status  DeliveryStatus
+	message Message
+}
+
+// deliveryTracker keeps the delivery state of every message sent in
+// this session and notifies emit about each transition.
+type deliveryTracker struct {
+	mu       sync.Mutex
+	messages map[string]*trackedMessage
+	emit     func(DeliveryStatus)
+}
+
+func newDeliveryTracker(emit func(DeliveryStatus)) *deliveryTracker {
+	return &deliveryTracker{
+		messages: make(map[string]*trackedMessage),
+		emit:     emit,
+	}
+}
+
+// canTransition reports whether a message may move from one state to another.
+func canTransition(from, to DeliveryState) bool {
+	switch from {
+	case DeliveryPending:
+		return to == DeliveryConfirmed || to == DeliveryFailed
+	case DeliveryFailed:
+		return to == DeliveryPending
+	}
+	return false
+}
+
+// add starts tracking a message in the pending state.
+func (t *deliveryTracker) add(message Message) {
+	status := DeliveryStatus{
+		MessageId:  message.Id,
+		ChatRoomId: message.ChatRoomId,
+		State:      DeliveryPending,
+	}
+	t.mu.Lock()
+	t.messages[message.Id] = &trackedMessage{status: status, message: message}
+	t.mu.Unlock()
+	t.emit(status)
+}
+
+// set moves a tracked message into a new state,
+// err is recorded when the message failed.
+func (t *deliveryTracker) set(id string, state DeliveryState, err error) error {
+	t.mu.Lock()
+	tracked, ok := t.messages[id]
+	if !ok {
+		t.mu.Unlock()
+		return errUnknownMessage
+	}
+	if !canTransition(tracked.status.State, state) {
+		from := tracked.status.State
+		t.mu.Unlock()
+		return fmt.Errorf("message %s cannot go from %s to %s", id, from, state)
+	}
+	tracked.status.State = state
+	tracked.status.Error = ""
+	if err != nil {
+		tracked.status.Error = err.Error()
+	}
+	status := tracked.status
+	t.mu.Unlock()
+	t.emit(status)
+	return nil
+}
+
+// get returns the current status of a message.
+func (t *deliveryTracker) get(id string) (DeliveryStatus, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tracked, ok := t.messages[id]
+	if !ok {
+		return DeliveryStatus{}, errUnknownMessage
+	}
+	return tracked.status, nil
+}
+
+// message returns the envelope of a tracked message.
+func (t *deliveryTracker) message(id string) (Message, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tracked, ok := t.messages[id]
+	if !ok {
+		return Message{}, errUnknownMessage
+	}
+	return tracked.message, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDeliveryTracker(t *testing.T) {
+	var emitted []DeliveryStatus
+	tracker := newDeliveryTracker(func(status DeliveryStatus) {
+		emitted = append(emitted, status)
+	})
+	msg := newMessage("room", "", "hello")
+	tracker.add(msg)
+
+	steps := []struct {
+		state DeliveryState
+		err   error
+		ok    bool
+	}{
+		{DeliveryConfirmed, nil, true},
+		{DeliveryPending, nil, false},
+		{DeliveryFailed, nil, false},
+	}
+	for _, step := range steps {
+		if err := tracker.set(msg.Id, step.state, step.err); (err == nil) != step.ok {
+			t.Errorf("confirmed to %s: %v", step.state, err)
+		}
+	}
+
+	failing := newMessage("room", "", "again")
+	tracker.add(failing)
+	if err := tracker.set(failing.Id, DeliveryFailed, errNotConfirmed); err != nil {
+		t.Fatal(err)
+	}
+	if status, err := tracker.get(failing.Id); err != nil || status.State != DeliveryFailed || status.Error != errNotConfirmed.Error() {
+		t.Fatalf("failed status %+v, %v", status, err)
+	}
+	// a retry makes it pending again and forgets the error
+	if err := tracker.set(failing.Id, DeliveryPending, nil); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := tracker.get(failing.Id); status.State != DeliveryPending || status.Error != "" {
+		t.Fatalf("retried status %+v", status)
+	}
+	if kept, err := tracker.message(failing.Id); err != nil || kept.Message != "again" {
+		t.Fatalf("kept message %+v, %v", kept, err)
+	}
+
+	want := []DeliveryState{DeliveryPending, DeliveryConfirmed, DeliveryPending, DeliveryFailed, DeliveryPending}
+	if len(emitted) != len(want) {
+		t.Fatalf("emitted %+v", emitted)
+	}
+	for i, state := range want {
+		if emitted[i].State != state {
+			t.Errorf("status %d is %s, want %s", i, emitted[i].State, state)
+		}
+	}
+
+	if err := tracker.set("unknown", DeliveryConfirmed, nil); !errors.Is(err, errUnknownMessage) {
+		t.Errorf("unknown message: %v", err)
+	}
+	if _, err := tracker.get("unknown"); !errors.Is(err, errUnknownMessage) {
+		t.Errorf("status of an unknown message: %v", err)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"strconv"
+	"time"
+
+	utils "github.com/benni347/messengerutils"
+)
+
+// messageErrorEvent is emitted with a MessageError for every
+// message that arrived but cannot be shown.
+const messageErrorEvent = "message:error"
+
+// contactKeysMaxAge is how long the keys of a contact are used before
+// they are fetched and checked against the trust store again, so a key
+// change is noticed while the app runs.
+const contactKeysMaxAge = 10 * time.Minute
+
+// contactKeysRefetchInterval is how soon the keys of a contact are
+// fetched again after a message of theirs failed to verify or decrypt,
+// so a flood of bad messages does not turn into a flood of requests.
+const contactKeysRefetchInterval = time.Minute
+
+var (
+	errUndecryptable = errors.New("the message could not be decrypted")
+	errNoIdentity    = errors.New("no identity key, sign in first")
+)
+
+// MessageError is the payload of the messageErrorEvent.
+type MessageError struct {
+	MessageId  string `json:"messageId"`
+	ChatRoomId string `json:"chatRoomId"`
+	Sender     string `json:"sender"`
+	Error      string `json:"error"`
+}
+
+// hkdfSha256 is HKDF (RFC 5869) with SHA-256.
+func hkdfSha256(secret, salt, info []byte, length int) []byte {
+	if salt == nil {
+		salt = make([]byte, sha256.Size)
+	}
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	var out, block []byte
+	for counter := byte(1); len(out) < length; counter++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(block)
+		expand.Write(info)
+		expand.Write([]byte{counter})
+		block = expand.Sum(nil)
+		out = append(out, block...)
+	}
+	return out[:length]
+}
+
+// messageAad binds the metadata of the envelope to its ciphertext,
+// so it cannot be changed or moved to another room unnoticed.
+func messageAad(m Message) []byte {
+	return []byte(strconv.Itoa(m.Version) + "\x00" + m.Id + "\x00" + m.ChatRoomId + "\x00" + m.Sender + "\x00" + m.Time)
+}
+
+func newGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SetAccessToken hands the Supabase access token of the signed in user
+// to the backend, which verifies it and signs in as the user it belongs
+// to. An empty token signs out
+func (a *App) SetAccessToken(accessToken string) error {
+	a.mu.Lock()
+	if a.session != nil && a.session.AccessToken != accessToken {
+		// the frontend signed in on its own
+		a.session = nil
+	}
+	a.mu.Unlock()
+	if accessToken == "" {
+		a.supabase.setAccessToken("")
+		a.setUser("", time.Time{})
+		return nil
+	}
+	claims, err := a.tokens.verify(accessToken)
+	if err != nil {
+		// never keep acting as a user whose token was refused
+		a.supabase.setAccessToken("")
+		a.setUser("", time.Time{})
+		return err
+	}
+	a.supabase.setAccessToken(accessToken)
+	a.setUser(claims.Subject, claims.expires())
+	a.publishIdentity()
+	return nil
+}
+
+// TrustContactKeys accepts the keys a contact currently publishes,
+// after they changed since the contact was first seen. The contact
+// has to be verified again afterwards
+func (a *App) TrustContactKeys(userId string) error {
+	userId, err := normalizeUserId(userId)
+	if err != nil {
+		return err
+	}
+	trust := a.getTrustStore()
+	if trust == nil {
+		return errNoIdentity
+	}
+	keys, err := a.supabase.fetchPublicKeys(userId)
+	if err != nil {
+		return err
+	}
+	decoded, err := keys.decode()
+	if err != nil {
+		return err
+	}
+	if err := trust.trust(keys); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.contacts[userId] = cachedContactKeys{keys: decoded, fetched: time.Now()}
+	a.mu.Unlock()
+	// the session was set up with the old keys
+	if _, sessions := a.getSessions(); sessions != nil {
+		return sessions.remove(userId)
+	}
+	return nil
+}
+
+// loadIdentity loads the identity, prekeys, sessions and trust store of
+// the signed in user, an empty id forgets the ones of the previous user.
+func (a *App) loadIdentity(userId string) {
+	var id *identity
+	var trust *trustStore
+	var prekeys *prekeyStore
+	var sessions *sessionStore
+	if userId != "" {
+		var err error
+		if id, err = loadOrCreateIdentity(userId); err != nil {
+			utils.PrintError("Failed to load the identity key", err)
+		}
+		if trust, err = loadTrustStore(userId); err != nil {
+			utils.PrintError("Failed to load the trust store", err)
+		}
+		if prekeys, err = loadPrekeyStore(userId); err != nil {
+			utils.PrintError("Failed to load the prekeys", err)
+		}
+		if sessions, err = loadSessionStore(userId); err != nil {
+			utils.PrintError("Failed to load the sessions", err)
+		}
+	}
+	a.mu.Lock()
+	a.identity = id
+	a.trust = trust
+	a.prekeys = prekeys
+	a.sessions = sessions
+	a.contacts = make(map[string]cachedContactKeys)
+	a.refetched = make(map[string]time.Time)
+	a.mu.Unlock()
+	if id != nil {
+		a.publishIdentity()
+	}
+}
+
+func (a *App) getIdentity() *identity {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.identity
+}
+
+func (a *App) getTrustStore() *trustStore {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.trust
+}
+
+// publishIdentity publishes the public keys and prekeys to Supabase,
+// once both the keys and an access token are there.
+func (a *App) publishIdentity() {
+	id := a.getIdentity()
+	userId := a.getSenderId()
+	if id == nil || userId == "" || a.supabase.token() == "" {
+		return
+	}
+	if err := a.supabase.publishPublicKeys(id.publicKeys(userId)); err != nil {
+		utils.PrintError("Failed to publish the public keys", err)
+		return
+	}
+	if prekeys, _ := a.getSessions(); prekeys != nil {
+		if err := prekeys.publish(a.supabase, userId, id.signing); err != nil {
+			utils.PrintError("Failed to publish the prekeys", err)
+		}
+	}
+}
+
+// contactKeys returns the public keys of a user, asking Supabase again
+// once the cached ones are older than contactKeysMaxAge. Keys that
+// differ from the ones in the trust store are reported to the frontend
+// and refused with errKeyChanged, with a stronger warning if the user
+// had verified the old ones.
+func (a *App) contactKeys(userId string) (contactKeys, error) {
+	a.mu.Lock()
+	cached, ok := a.contacts[userId]
+	trust := a.trust
+	a.mu.Unlock()
+	if ok && time.Since(cached.fetched) < contactKeysMaxAge {
+		return cached.keys, nil
+	}
+	if trust == nil {
+		return contactKeys{}, errNoIdentity
+	}
+
+	published, err := a.supabase.fetchPublicKeys(userId)
+	if err != nil {
+		return contactKeys{}, err
+	}
+	keys, err := published.decode()
+	if err != nil {
+		return contactKeys{}, err
+	}
+	changed, err := trust.check(published)
+	if err != nil {
+		return contactKeys{}, err
+	}
+	if changed {
+		event := contactKeyChangedEvent
+		if trust.isVerified(userId) {
+			event = verifiedKeyChangedEvent
+		}
+		a.emit(event, KeyChange{UserId: userId})
+		return contactKeys{}, errKeyChanged
+	}
+
+	a.mu.Lock()
+	a.contacts[userId] = cachedContactKeys{keys: keys, fetched: time.Now()}
+	a.mu.Unlock()
+	return keys, nil
+}
+
+// refetchContactKeys forgets the cached keys of the user and fetches
+// them again. It is called when a message of the user does not verify
+// or decrypt, which is how a key change usually shows first. Within
+// contactKeysRefetchInterval of the last time the cached keys are kept.
+func (a *App) refetchContactKeys(userId string) (contactKeys, error) {
+	a.mu.Lock()
+	if time.Since(a.refetched[userId]) >= contactKeysRefetchInterval {
+		delete(a.contacts, userId)
+		a.refetched[userId] = time.Now()
+	}
+	a.mu.Unlock()
+	return a.contactKeys(userId)
+}
+
+// emitMessageError tells the frontend about a message it cannot show.
+func (a *App) emitMessageError(msg Message, err error) {
+	a.emit(messageErrorEvent, MessageError{
+		MessageId:  msg.Id,
+		ChatRoomId: msg.ChatRoomId,
+		Sender:     msg.Sender,
+		Error:      err.Error(),
+	})
+}
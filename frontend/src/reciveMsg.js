@@ -1,21 +1,130 @@
 "use strict";
 
-const socket = new WebSocket("ws://s.rabbitmq.cedric.5y5.one/websocket");
+import {
+  GetBrokerStatus,
+  GetConfigProblems,
+  GetSafetyNumber,
+  SetQueuName,
+  TrustContactKeys,
+  VerifyContact,
+} from "../wailsjs/go/main/App.js";
+import { EventsOn } from "../wailsjs/runtime/runtime.js";
 
-socket.onmessage = function (event) {
-  const otherMessage = event.data;
+EventsOn("message:received", (incoming) => {
+  const chatRoomId =
+    document.getElementById("body").attributes["data-current-chat-room-id"]
+      .value;
+  const currentUserId =
+    document.getElementById("body").attributes["data-current-user-id"].value;
+  if (incoming.chatRoomId !== chatRoomId || incoming.sender === currentUserId) {
+    return;
+  }
+  const otherMessage = incoming.message;
   const messageLog = document.getElementById("message-log");
   const messageDiv = document.createElement("div");
   const messageUsernameDiv = document.createElement("div");
   const messageTextDiv = document.createElement("div");
-  const otherUsername = "other";
-  messageUsernameDiv.innerHTML = otherUsername;
-  messageTextDiv.innerHTML = otherMessage;
+  const otherUsername = incoming.sender || "other";
+  messageUsernameDiv.innerText = otherUsername;
+  messageTextDiv.innerText = otherMessage;
   messageTextDiv.className = "text";
   messageUsernameDiv.className = "username";
   messageDiv.className = "message";
+  messageDiv.title = incoming.encrypted
+    ? `${incoming.time} (end-to-end encrypted)`
+    : incoming.time;
+  if (!incoming.verified) {
+    messageDiv.classList.add("unverified");
+    messageDiv.title += ` - unverified sender: ${incoming.warning}`;
+  }
   messageDiv.appendChild(messageUsernameDiv);
   messageDiv.appendChild(messageTextDiv);
   messageLog.appendChild(messageDiv);
   messageLog.scrollTop = messageLog.scrollHeight;
-};
+});
+
+EventsOn("message:error", (failure) => {
+  console.error(
+    `A message from ${failure.sender} could not be shown: ${failure.error}`
+  );
+  const messageLog = document.getElementById("message-log");
+  const messageDiv = document.createElement("div");
+  messageDiv.className = "message failed";
+  messageDiv.innerText = "A message could not be decrypted.";
+  messageDiv.title = failure.error;
+  messageLog.appendChild(messageDiv);
+});
+
+EventsOn("contact:key-changed", (change) => {
+  const accept = window.confirm(
+    `The keys of ${change.userId} changed. This happens when they use a new ` +
+      "device, but could also mean someone is trying to read your messages. " +
+      "Do you want to trust the new keys?"
+  );
+  if (accept) {
+    TrustContactKeys(change.userId);
+  }
+});
+
+EventsOn("contact:verified-key-changed", (change) => {
+  const accept = window.confirm(
+    `Warning: the keys of ${change.userId} changed after you verified ` +
+      "their safety number. Do not trust the new keys unless they confirm " +
+      "the change in person. Trust them anyway?"
+  );
+  if (accept) {
+    TrustContactKeys(change.userId);
+  }
+});
+
+async function showSafetyNumber() {
+  const chatRoomId =
+    document.getElementById("body").attributes["data-current-chat-room-id"]
+      .value;
+  try {
+    const number = await GetSafetyNumber(chatRoomId);
+    const status = number.verified ? "verified" : "not verified yet";
+    const confirmed = window.confirm(
+      `Safety number with ${number.userId} (${status}):\n\n` +
+        `${number.digits}\n\n` +
+        "Compare it with the one your contact sees. Do they match?"
+    );
+    if (confirmed && !number.verified) {
+      await VerifyContact(chatRoomId);
+    }
+  } catch (error) {
+    window.alert(`No safety number: ${error}`);
+  }
+}
+
+function showBrokerStatus(status) {
+  const form = document.getElementById("publish-form-container");
+  form.title = status.connected
+    ? `Connected to ${status.broker}`
+    : "Not connected, messages are sent once the connection is back";
+}
+
+EventsOn("broker:status", showBrokerStatus);
+
+async function showConfigProblems() {
+  const problems = await GetConfigProblems();
+  if (!problems || problems.length === 0) {
+    return;
+  }
+  const lines = problems.map(
+    (problem) => `- ${problem.field} (${problem.source}): ${problem.message}`
+  );
+  window.alert(`The configuration has problems:\n\n${lines.join("\n")}`);
+}
+
+window.addEventListener("DOMContentLoaded", () => {
+  showConfigProblems();
+  GetBrokerStatus().then(showBrokerStatus);
+  SetQueuName(
+    document.getElementById("body").attributes["data-current-chat-room-id"]
+      .value
+  );
+  document
+    .getElementById("safety-number-button")
+    .addEventListener("click", showSafetyNumber);
+});
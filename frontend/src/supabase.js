@@ -1,13 +1,35 @@
 "use strict";
 
 import {
-  RetrieveEnvValues,
+  AcceptContact,
+  AddContact,
+  DeclineContact,
+  GetContacts,
+  GetCurrentUser,
+  GetPublicConfig,
+  HasSavedSession,
   ValidateEmail,
   GenerateUserName,
   CreateChatRoomId,
+  GetMessageStatus,
   Send,
+  RetryMessage,
+  SaveSession,
+  SetAccessToken,
+  SetContactNickname,
+  SetQueuName,
+  SignIn,
+  SignInWithGithub,
+  SignInWithRecoveryCode,
+  SignOut,
+  SignUp,
+  RecoverPassword,
+  UnlockSession,
+  VerifySignIn,
 } from "../wailsjs/go/main/App.js";
 
+import { EventsOn } from "../wailsjs/runtime/runtime.js";
+
 // Solved the fix me through importing it as a npm module
 import { createClient } from "@supabase/supabase-js";
 
@@ -15,10 +37,11 @@ const options = {
   db: {
     schema: "public",
   },
+  // the backend keeps and refreshes the session
   auth: {
-    autoRefreshToken: true,
-    persistSession: true,
-    detectSessionInUrl: true,
+    autoRefreshToken: false,
+    persistSession: false,
+    detectSessionInUrl: false,
   },
 };
 
@@ -26,21 +49,22 @@ let supabaseKey = "";
 let supabaseUrl = "";
 let supabase = "";
 let authenticated = false;
+// the generated name of a user who is not signed in
+let anonymousUsername = "";
 
 const messageLog = document.getElementById("message-log");
 /**
  * Asynchronously signs in a user through email using Supabase authentication.
  *
- * This function first retrieves user input from the HTML elements with ids 'email-input',
- * 'password-input', and 'username'. It then attempts to sign the user in via Supabase's
- * auth.signIn method with the retrieved user input data. If an error occurs during the
- * signIn process, the error is logged to the console. Otherwise, the data received from
- * the signIn request is logged to the console.
+ * This function first retrieves user input from the HTML elements with ids 'email-input'
+ * and 'password-input'. It then attempts to sign the user in through the backend. If an
+ * error occurs during the signIn process, the error is logged to the console and the user
+ * stays signed out.
  *
  * The function does not return anything.
  *
  * Note: The HTML elements used in this function must exist in the HTML document and be
- * populated with appropriate user input data (email, password, and username) before this
+ * populated with appropriate user input data (email and password) before this
  * function is called.
  *
  * @async
@@ -54,27 +78,115 @@ async function signInThroughMail() {
     return;
   }
   const password = document.getElementById("password-input").value;
-  const user_name = document.getElementById("username").value;
-
-  const { data, error } = await supabase.auth.signInWithPassword({
-    email, // equals to email: email
-    password, // equals to password: password
-    options: {
-      data: {
-        user_name, // equals to user_name: user_name
-      },
-    },
-  });
-  authenticated = true;
 
-  localStorage.setItem("authenticated", authenticated);
-  changeButton();
-  if (error) {
+  try {
+    await verifySecondFactor(await SignIn(email, password));
+  } catch (error) {
     console.error(`An error occured during the login: ${error}`);
+    return;
   }
+  authenticated = true;
+  await offerToSaveSession();
+  changeButton();
 
   location.reload();
 }
+
+/**
+ * Finishes signing in if the user has a second factor, by asking for the
+ * code of the authenticator app. A recovery code is accepted instead, it
+ * removes the second factor.
+ *
+ * @async
+ * @function verifySecondFactor
+ * @param {object} user - The user signing in returned.
+ * @throws Will throw an error if the code is wrong or the user gave none.
+ */
+async function verifySecondFactor(user) {
+  if (!user.mfaRequired) {
+    return;
+  }
+  const code = (
+    window.prompt(
+      "Enter the code of your authenticator app, or one of your recovery codes."
+    ) || ""
+  ).trim();
+  if (code === "") {
+    throw new Error("no verification code was entered");
+  }
+  if (/^\d{6}$/.test(code)) {
+    await VerifySignIn(code);
+  } else {
+    await SignInWithRecoveryCode(code);
+  }
+}
+
+/**
+ * Asks the user for a passphrase to keep the session on this device with.
+ * The backend stores it encrypted with a key derived from the passphrase.
+ * Without a passphrase the user has to sign in again after a restart.
+ *
+ * @async
+ * @function offerToSaveSession
+ */
+async function offerToSaveSession() {
+  const passphrase = window.prompt(
+    "Enter a passphrase to stay signed in on this device, or leave it empty to sign in again next time."
+  );
+  if (!passphrase) {
+    return;
+  }
+  try {
+    await SaveSession(passphrase);
+  } catch (error) {
+    console.error(`The session could not be saved: ${error}`);
+  }
+}
+
+/**
+ * Asynchronously takes over the signed in state of the backend, which keeps
+ * the session across reloads. If nobody is signed in but a session is saved
+ * on this device, the user is asked for the passphrase it was saved with.
+ *
+ * @async
+ * @function restoreSession
+ */
+async function restoreSession() {
+  const user = await GetCurrentUser().catch(() => null);
+  authenticated = Boolean(user && user.id);
+  if (!authenticated && (await HasSavedSession())) {
+    const passphrase = window.prompt(
+      "Enter your passphrase to restore your session."
+    );
+    if (passphrase) {
+      try {
+        await UnlockSession(passphrase);
+        authenticated = true;
+      } catch (error) {
+        console.error(`The saved session could not be restored: ${error}`);
+      }
+    }
+  }
+  changeButton();
+}
+
+/**
+ * Asynchronously sends a mail to reset the password of the email address
+ * entered in the sign in window.
+ *
+ * @async
+ * @function recoverPassword
+ */
+async function recoverPassword() {
+  const email = document.getElementById("email-input").value;
+  try {
+    await RecoverPassword(email);
+  } catch (error) {
+    console.error(`The recovery mail could not be sent: ${error}`);
+    return;
+  }
+  window.alert(`A mail to reset your password was sent to ${email}.`);
+}
 /**
  * Gets the current username. If it doesn't exist, generates a new one.
  *
@@ -82,31 +194,22 @@ async function signInThroughMail() {
  * @returns {Promise<string>} The username.
  */
 const getUsername = async () => {
-  const previousUsername = localStorage.getItem("username");
-  const user = await supabase.auth.getUser();
-  if (
-    user &&
-    user.data &&
-    user.data.user &&
-    user.data.user.user_metadata &&
-    user.data.user.user_metadata.user_name
-  ) {
-    const username = user.data.user.user_metadata.user_name;
-    return username;
+  const user = await GetCurrentUser().catch(() => null);
+  if (user && user.userName) {
+    return user.userName;
   } else {
-    const username = previousUsername || GenerateUserName(4);
-    return username;
+    anonymousUsername = anonymousUsername || (await GenerateUserName(4));
+    return anonymousUsername;
   }
 };
 /**
- * Sets the current username in local storage and updates the username field in the document.
+ * Updates the username field in the document with the current username.
  *
  * @async
  * @returns {Promise<string>} The username.
  */
 const setUsername = async () => {
   const username = await getUsername();
-  localStorage.setItem("username", username);
   const usernameParagraph = document.createElement("p");
   usernameParagraph.style.gridArea = "username";
   usernameParagraph.innerHTML = username;
@@ -132,13 +235,17 @@ const setUsername = async () => {
  * @throws Will throw an error if the sign out process encounters any issues.
  */
 async function signOut() {
+  try {
+    await SignOut();
+  } catch (error) {
+    console.error(`An error occured during the logout: ${error}`);
+  }
+  // a GitHub session lives in the Supabase client
   const { error } = await supabase.auth.signOut();
   if (error) {
     console.error(`An error occured during the logout: ${error}`);
   }
   authenticated = false;
-  localStorage.setItem("authenticated", authenticated);
-  localStorage.removeItem("username");
   setUsername();
   const body = document.getElementById("body");
   body.setAttribute("data-current-user-id", "");
@@ -149,46 +256,62 @@ async function signOut() {
 /**
  * Asynchronously signs in a user using GitHub as OAuth provider via Supabase authentication.
  *
- * This function attempts to sign the user in via Supabase's auth.signInWithOAuth method with
- * 'github' as the OAuth provider. If an error occurs during the signIn process, the error
- * is logged to the console. Otherwise, the data received from the signIn request is logged
- * to the console.
+ * The backend opens GitHub in the browser and waits for it to redirect back to the app.
+ * If an error occurs during the signIn process, the error is logged to the console and
+ * the user stays signed out.
  *
  * The function does not return anything.
  *
  * @async
  * @function signInTroughGithub
- * @throws Will throw an error if the sign in process encounters any issues.
  */
 async function signInTroughGithub() {
-  const { _, error } = await supabase.auth.signInWithOAuth({
-    provider: "github",
-  });
-  if (error) {
+  try {
+    await verifySecondFactor(await SignInWithGithub());
+  } catch (error) {
     console.error(`An error occured during the login: ${error}`);
+    return;
   }
   authenticated = true;
-  localStorage.setItem("authenticated", authenticated);
+  await offerToSaveSession();
   changeButton();
+  location.reload();
 }
 
-RetrieveEnvValues().then((env) => {
-  supabaseKey = env.supaBaseApiKey;
-  supabaseUrl = env.supaBaseUrl;
+GetPublicConfig().then(async (config) => {
+  supabaseKey = config.supaBaseAnonKey;
+  supabaseUrl = config.supaBaseUrl;
   supabase = createClient(supabaseUrl, supabaseKey, options);
+  supabase.auth.onAuthStateChange((event, session) => {
+    // without a session of its own the client must not sign out
+    // a session the backend signed in with
+    if (!session && event !== "SIGNED_OUT") {
+      return;
+    }
+    SetAccessToken(session ? session.access_token : "").catch((error) => {
+      console.error(`The session could not be verified: ${error}`);
+    });
+  });
 
+  await restoreSession();
   setUsername();
   addUserIdNote();
+  showContacts();
+});
+
+EventsOn("auth:state", (user) => {
+  authenticated = Boolean(user.id);
+  changeButton();
+  showContacts();
 });
 
 /**
  * Asynchronously registers a new user with Supabase authentication.
  *
  * This function first retrieves user input from the HTML elements with ids 'email-input',
- * 'password-input', and 'username'. It then attempts to sign the user up via Supabase's
- * auth.signUp method with the retrieved user input data. If an error occurs during the
- * signUp process, the error is logged to the console. Otherwise, the data received from
- * the signUp request is logged to the console.
+ * 'password-input', and 'username'. It then attempts to sign the user up through the
+ * backend, which stores the user name with the account. If an error occurs during the
+ * signUp process, the error is logged to the console.
  *
  * The function does not return anything.
  *
@@ -203,22 +326,16 @@ RetrieveEnvValues().then((env) => {
 async function signUp() {
   const email = document.getElementById("email-input-signup").value;
   const password = document.getElementById("password-signup").value;
-  const user_name = document.getElementById("username").value;
+  const user_name =
+    document.getElementById("username").value || anonymousUsername;
 
   if (!ValidateEmail(email)) {
     console.error(`The email ${email} is not valid.`);
     return;
   }
-  const { data, error } = await supabase.auth.signUp({
-    email, // equals to email: email
-    password, // equals to password: password
-    options: {
-      data: {
-        user_name, // equals to user_name: user_name
-      },
-    },
-  });
-  if (error) {
+  try {
+    await SignUp(email, password, user_name);
+  } catch (error) {
     console.error(`An error occured during the creation of the user: ${error}`);
   }
 }
@@ -226,7 +343,7 @@ async function signUp() {
 /**
  * Asynchronously retrieves the authenticated user's ID from the Supabase database.
  *
- * If the user is authenticated according to the local storage, the function
+ * If the user is authenticated according to the backend, the function
  * attempts to retrieve the user object from Supabase. If the user object exists
  * and it contains the `id` field in its `data.user` property, this `id` is returned.
  * If the user is not authenticated or the user object doesn't have an `id` field,
@@ -245,13 +362,10 @@ async function signUp() {
  * }
  */
 const getId = async () => {
-  if (
-    localStorage.getItem("authenticated") === "true" ||
-    localStorage.getItem("authenticated") === true
-  ) {
-    const user = await supabase.auth.getUser();
-    if (user && user.data && user.data.user && user.data.user.id) {
-      return user.data.user.id;
+  if (authenticated) {
+    const user = await GetCurrentUser().catch(() => null);
+    if (user && user.id) {
+      return user.id;
     } else {
       return null;
     }
@@ -262,15 +376,12 @@ const getId = async () => {
 
 /**
  * Toggles the visibility of the sign-in and sign-out buttons.
- * The visibility is determined based on the 'authenticated' flag stored in local storage.
+ * The visibility is determined based on the 'authenticated' flag, which follows the backend.
  * If the flag is 'true', the sign-in button is hidden and the sign-out button is displayed.
  * Otherwise, the sign-out button is hidden and the sign-in button is displayed.
  */
 function changeButton() {
-  if (
-    localStorage.getItem("authenticated") === true ||
-    localStorage.getItem("authenticated") === "true"
-  ) {
+  if (authenticated) {
     document.getElementById("signin-main-wrapper").style.display = "none";
     document.getElementById("signout-main-wrapper").style.display = "block";
   } else {
@@ -288,11 +399,64 @@ async function sendMessage() {
 
     const chatRoomId = getChatRoomId();
     console.info("Chat room ID is", chatRoomId);
-    messageLog.appendChild(createMessageElement(message, "You"));
-    await Send(message, chatRoomId);
+    const messageElement = createMessageElement(message, "You");
+    messageLog.appendChild(messageElement);
+    await sendMessageElement(messageElement, message, chatRoomId);
+  }
+}
+
+/**
+ * Sends a message and keeps the delivery status of its element up to date.
+ * If the message could not be handed to the broker at all, the element is
+ * marked as failed and clicking it sends the message again.
+ *
+ * @async
+ * @param {HTMLElement} messageElement - The element showing the message.
+ * @param {string} message - The text of the message.
+ * @param {string} chatRoomId - The chat room to send the message to.
+ */
+async function sendMessageElement(messageElement, message, chatRoomId) {
+  setMessageState(messageElement, "pending", "");
+  try {
+    const messageId = await Send(message, chatRoomId);
+    messageElement.setAttribute("data-message-id", messageId);
+    const status = await GetMessageStatus(messageId);
+    setMessageState(messageElement, status.state, status.error);
+  } catch (error) {
+    console.error(`An error occured while sending the message: ${error}`);
+    setMessageState(messageElement, "failed", `${error}`);
+    messageElement.onclick = () =>
+      sendMessageElement(messageElement, message, chatRoomId);
   }
 }
 
+/**
+ * Shows the delivery state of a sent message on its element.
+ *
+ * @param {HTMLElement} messageElement - The element showing the message.
+ * @param {string} state - One of "pending", "confirmed" or "failed".
+ * @param {string} error - The reason the message failed, if it did.
+ */
+function setMessageState(messageElement, state, error) {
+  messageElement.classList.remove("pending", "confirmed", "failed");
+  messageElement.classList.add(state);
+  messageElement.title = error;
+  messageElement.onclick = null;
+}
+
+EventsOn("message:status", (status) => {
+  const messageElement = messageLog.querySelector(
+    `[data-message-id="${status.messageId}"]`
+  );
+  if (!messageElement) {
+    return;
+  }
+  setMessageState(messageElement, status.state, status.error);
+  if (status.state === "failed") {
+    messageElement.onclick = () => RetryMessage(status.messageId);
+  }
+});
+
 function createMessageElement(message, username) {
   const messageElement = document.createElement("div");
   messageElement.classList.add("message");
@@ -320,54 +484,133 @@ function newChatRoom() {
 }
 
 /**
- * Creates a new chat room.
- * The function first gets the user id of the other person involved in the chat.
- * Then, it retrieves the current user's id by awaiting the result of the 'getId' function.
- * The retrieved ids (which may include dashes) are cleaned by removing all dashes.
- * A chat room id is then created using the cleaned ids, and this id is printed to the console.
+ * Adds the user with the entered user name or email address to the contacts.
+ * If that user is already a contact, or asked to become one first, the chat
+ * with the user is opened. Otherwise the user has to accept the request first.
  *
  * @async
  * @returns {Promise<void>} This function returns a promise that resolves to undefined.
- * It has no return value because the created chat room id is not returned, only logged.
  */
 async function createNewChatRoom() {
-  const other_user_id = document.getElementById("other_persons_uid").value;
-  const myId = await getId(); // Await the promise returned by getId()
+  const query = document.getElementById("other_persons_uid").value;
 
-  const myIdWithoutDashes = myId.replace(/-/g, "");
-  const otherIdWithoutDashes = other_user_id.replace(/-/g, "");
+  let contact;
+  try {
+    contact = await AddContact(query);
+  } catch (error) {
+    console.error(`The contact could not be added: ${error}`);
+    return;
+  }
+  await showContacts();
+  if (contact.status === "accepted") {
+    await openChat(contact.userId);
+  } else {
+    window.alert(
+      `${contact.userName || query} has to accept your request before you can chat.`
+    );
+  }
+}
 
-  const combindedIds = await CreateChatRoomId(
-    myIdWithoutDashes,
-    otherIdWithoutDashes
-  );
+/**
+ * Opens the direct chat room with a contact.
+ *
+ * @async
+ * @param {string} otherUserId - The id of the contact.
+ * @returns {Promise<void>} This function returns a promise that resolves to undefined.
+ */
+async function openChat(otherUserId) {
+  const myId = await getId(); // Await the promise returned by getId()
+
+  let combindedIds;
+  try {
+    combindedIds = await CreateChatRoomId(otherUserId, myId);
+  } catch (error) {
+    console.error(`The chat room could not be created: ${error}`);
+    return;
+  }
   console.info(combindedIds);
   const body = document.querySelector("body");
   body.setAttribute("data-current-chat-room-id", combindedIds);
   localStorage.setItem("current-chat-room-id", combindedIds);
-  addChatRoomId(combindedIds);
+  await SetQueuName(combindedIds);
   addNote();
-  appendChatRoomIdToSidebar(other_user_id);
 }
 
-function appendChatRoomIdToSidebar(id) {
+/**
+ * Lists the contacts of the signed in user in the sidebar. Clicking an
+ * accepted contact opens the chat with it, clicking a request answers it.
+ * Double clicking a contact gives it a nickname.
+ *
+ * @async
+ * @returns {Promise<void>} This function returns a promise that resolves to undefined.
+ */
+async function showContacts() {
   const sidebar = document.getElementById("sidebar");
-  const chatRoomId = id;
-  const chatRoomIdElement = document.createElement("p");
-  chatRoomIdElement.innerText = chatRoomId;
-  sidebar.appendChild(chatRoomIdElement);
-}
+  sidebar.querySelectorAll(".contact").forEach((element) => element.remove());
+  if (!authenticated) {
+    return;
+  }
 
-function addChatRoomId(newId) {
-  // get existing ids
-  const storedChatRoomIds = localStorage.getItem("all_chat_room_ids");
-  const chatRoomIds = storedChatRoomIds ? JSON.parse(storedChatRoomIds) : [];
+  let contacts;
+  try {
+    contacts = await GetContacts();
+  } catch (error) {
+    console.error(`The contacts could not be loaded: ${error}`);
+    return;
+  }
+  for (const contact of contacts) {
+    sidebar.appendChild(createContactElement(contact));
+  }
+}
 
-  // add new id
-  chatRoomIds.push(newId);
+function createContactElement(contact) {
+  const contactElement = document.createElement("p");
+  contactElement.classList.add("contact", contact.status);
+  const name = contact.nickname || contact.userName || contact.userId;
+  contactElement.innerText =
+    contact.status === "accepted" ? name : `${name} (${contact.status})`;
+
+  contactElement.onclick = async () => {
+    if (contact.status === "accepted") {
+      await openChat(contact.userId);
+    } else if (contact.status === "requested") {
+      await answerContactRequest(contact, name);
+    }
+  };
+  contactElement.ondblclick = async () => {
+    const nickname = window.prompt(`Nickname for ${name}`, contact.nickname);
+    if (nickname === null) {
+      return;
+    }
+    try {
+      await SetContactNickname(contact.userId, nickname);
+    } catch (error) {
+      console.error(`The nickname could not be set: ${error}`);
+    }
+    await showContacts();
+  };
+  return contactElement;
+}
 
-  // store updated ids
-  localStorage.setItem("all_chat_room_ids", JSON.stringify(chatRoomIds));
+/**
+ * Asks whether to accept the contact request of another user and
+ * accepts or declines it.
+ *
+ * @async
+ * @param {object} contact - The contact that sent the request.
+ * @param {string} name - The name the contact is shown with.
+ */
+async function answerContactRequest(contact, name) {
+  try {
+    if (window.confirm(`Do you want to chat with ${name}?`)) {
+      await AcceptContact(contact.userId);
+    } else {
+      await DeclineContact(contact.userId);
+    }
+  } catch (error) {
+    console.error(`The contact request could not be answered: ${error}`);
+  }
+  await showContacts();
 }
 
 /**
@@ -431,17 +674,14 @@ function addNote() {
 addNote();
 /**
  * Checks if the user is authenticated and if so, retrieves their user ID and adds a note on the page.
- * The authentication is based on the 'authenticated' flag stored in local storage.
+ * The authentication is based on the 'authenticated' flag, which follows the backend.
  * If authenticated, the user ID is fetched using 'getId' function, which returns a Promise.
  * Once the Promise is resolved, the ID is added as a data attribute to the body element.
  * Furthermore, a paragraph element is created containing a user-friendly message which includes the user ID.
  * This paragraph is appended to the '.note' element on the page.
  */
 function addUserIdNote() {
-  if (
-    localStorage.getItem("authenticated") === true ||
-    localStorage.getItem("authenticated") === "true"
-  ) {
+  if (authenticated) {
     getId().then((id) => {
       const body = document.getElementById("body");
       body.setAttribute("data-current-user-id", id);
@@ -475,6 +715,7 @@ window.addEventListener("DOMContentLoaded", () => {
   const signInBtnInMainContentWrapper = document.getElementById(
     "signin-main-wrapper"
   );
+  const forgotPasswordBtn = document.getElementById("forgot-password");
   const githubBtn = document.getElementById("github-button");
   const githubBtnSignUp = document.getElementById("github-button-signup");
   const newChatRoomButtonOnMainContentWrapper = document.getElementById(
@@ -548,6 +789,12 @@ window.addEventListener("DOMContentLoaded", () => {
       signInWindow.classList.remove("hidden");
     });
   }
+  if (forgotPasswordBtn) {
+    forgotPasswordBtn.addEventListener("click", (event) => {
+      event.preventDefault();
+      recoverPassword();
+    });
+  }
   if (githubBtn) {
     githubBtn.addEventListener("click", (event) => {
       event.preventDefault();
@@ -2,34 +2,96 @@
 // This file is automatically generated. DO NOT EDIT
 import {main} from '../models';
 
+export function AcceptContact(arg1:string):Promise<main.Contact>;
+
+export function AddContact(arg1:string):Promise<main.Contact>;
+
+export function AddMember(arg1:string,arg2:string):Promise<main.Room>;
+
+export function CancelMessage(arg1:string):Promise<void>;
+
+export function CancelSignIn():Promise<void>;
+
+export function CompareSafetyNumber(arg1:string,arg2:string):Promise<boolean>;
+
+export function ConfirmTotp(arg1:string):Promise<Array<string>>;
+
 export function CreateChatRoomId(arg1:string,arg2:string):Promise<string>;
 
+export function CreateGroup(arg1:string,arg2:Array<string>):Promise<main.Room>;
+
+export function DeclineContact(arg1:string):Promise<void>;
+
+export function EnrollTotp(arg1:string):Promise<main.TotpEnrollment>;
+
 export function GenerateUserName(arg1:number):Promise<string>;
 
-export function GetAppId():Promise<string>;
+export function GetBrokerStatus():Promise<main.BrokerStatus>;
+
+export function GetConfigProblems():Promise<Array<main.ConfigProblem>>;
+
+export function GetContacts():Promise<Array<main.Contact>>;
 
-export function GetAppKey():Promise<string>;
+export function GetCurrentUser():Promise<main.AuthUser>;
 
-export function GetAppSecret():Promise<string>;
+export function GetMessageStatus(arg1:string):Promise<main.DeliveryStatus>;
 
-export function GetClusterId():Promise<string>;
+export function GetMfaFactors():Promise<Array<main.MfaFactor>>;
 
 export function GetOtherUserId(arg1:string,arg2:string):Promise<string>;
 
-export function GetRabbitMqAdmin():Promise<string>;
+export function GetPendingMessages():Promise<Array<main.OutboxEntry>>;
+
+export function GetPublicConfig():Promise<main.PublicConfig>;
+
+export function GetRoom(arg1:string):Promise<main.Room>;
+
+export function GetRooms():Promise<Array<main.Room>>;
+
+export function GetSafetyNumber(arg1:string):Promise<main.SafetyNumber>;
 
-export function GetRabbitMqHost():Promise<string>;
+export function HasSavedSession():Promise<boolean>;
 
-export function GetRabbitMqPassword():Promise<string>;
+export function LeaveRoom(arg1:string):Promise<void>;
 
-export function GetSupaBaseApiKey():Promise<string>;
+export function RecoverPassword(arg1:string):Promise<void>;
 
-export function GetSupaBaseUrl():Promise<string>;
+export function RefreshSession():Promise<void>;
 
-export function RetrieveEnvValues():Promise<main.Config>;
+export function RegenerateRecoveryCodes():Promise<Array<string>>;
 
-export function Send(arg1:string,arg2:string):Promise<void>;
+export function RemoveMember(arg1:string,arg2:string):Promise<main.Room>;
+
+export function RetryMessage(arg1:string):Promise<void>;
+
+export function SaveSession(arg1:string):Promise<void>;
+
+export function Send(arg1:string,arg2:string):Promise<string>;
+
+export function SetAccessToken(arg1:string):Promise<void>;
+
+export function SetContactNickname(arg1:string,arg2:string):Promise<main.Contact>;
 
 export function SetQueuName(arg1:string):Promise<void>;
 
+export function SignIn(arg1:string,arg2:string):Promise<main.AuthUser>;
+
+export function SignInWithGithub():Promise<main.AuthUser>;
+
+export function SignInWithRecoveryCode(arg1:string):Promise<main.AuthUser>;
+
+export function SignOut():Promise<void>;
+
+export function SignUp(arg1:string,arg2:string,arg3:string):Promise<main.AuthUser>;
+
+export function TrustContactKeys(arg1:string):Promise<void>;
+
+export function UnenrollFactor(arg1:string):Promise<void>;
+
+export function UnlockSession(arg1:string):Promise<main.AuthUser>;
+
 export function ValidateEmail(arg1:string):Promise<boolean>;
+
+export function VerifySignIn(arg1:string):Promise<main.AuthUser>;
+
+export function VerifyContact(arg1:string):Promise<void>;
@@ -2,66 +2,190 @@
 // Cynhyrchwyd y ffeil hon yn awtomatig. PEIDIWCH Â MODIWL
 // This file is automatically generated. DO NOT EDIT
 
+export function AcceptContact(arg1) {
+  return window['go']['main']['App']['AcceptContact'](arg1);
+}
+
+export function AddContact(arg1) {
+  return window['go']['main']['App']['AddContact'](arg1);
+}
+
+export function AddMember(arg1, arg2) {
+  return window['go']['main']['App']['AddMember'](arg1, arg2);
+}
+
+export function CancelMessage(arg1) {
+  return window['go']['main']['App']['CancelMessage'](arg1);
+}
+
+export function CancelSignIn() {
+  return window['go']['main']['App']['CancelSignIn']();
+}
+
+export function CompareSafetyNumber(arg1, arg2) {
+  return window['go']['main']['App']['CompareSafetyNumber'](arg1, arg2);
+}
+
+export function ConfirmTotp(arg1) {
+  return window['go']['main']['App']['ConfirmTotp'](arg1);
+}
+
 export function CreateChatRoomId(arg1, arg2) {
   return window['go']['main']['App']['CreateChatRoomId'](arg1, arg2);
 }
 
+export function CreateGroup(arg1, arg2) {
+  return window['go']['main']['App']['CreateGroup'](arg1, arg2);
+}
+
+export function DeclineContact(arg1) {
+  return window['go']['main']['App']['DeclineContact'](arg1);
+}
+
+export function EnrollTotp(arg1) {
+  return window['go']['main']['App']['EnrollTotp'](arg1);
+}
+
 export function GenerateUserName(arg1) {
   return window['go']['main']['App']['GenerateUserName'](arg1);
 }
 
-export function GetAppId() {
-  return window['go']['main']['App']['GetAppId']();
+export function GetBrokerStatus() {
+  return window['go']['main']['App']['GetBrokerStatus']();
+}
+
+export function GetConfigProblems() {
+  return window['go']['main']['App']['GetConfigProblems']();
+}
+
+export function GetContacts() {
+  return window['go']['main']['App']['GetContacts']();
 }
 
-export function GetAppKey() {
-  return window['go']['main']['App']['GetAppKey']();
+export function GetCurrentUser() {
+  return window['go']['main']['App']['GetCurrentUser']();
 }
 
-export function GetAppSecret() {
-  return window['go']['main']['App']['GetAppSecret']();
+export function GetMessageStatus(arg1) {
+  return window['go']['main']['App']['GetMessageStatus'](arg1);
 }
 
-export function GetClusterId() {
-  return window['go']['main']['App']['GetClusterId']();
+export function GetMfaFactors() {
+  return window['go']['main']['App']['GetMfaFactors']();
 }
 
 export function GetOtherUserId(arg1, arg2) {
   return window['go']['main']['App']['GetOtherUserId'](arg1, arg2);
 }
 
-export function GetRabbitMqAdmin() {
-  return window['go']['main']['App']['GetRabbitMqAdmin']();
+export function GetPendingMessages() {
+  return window['go']['main']['App']['GetPendingMessages']();
+}
+
+export function GetPublicConfig() {
+  return window['go']['main']['App']['GetPublicConfig']();
+}
+
+export function GetRoom(arg1) {
+  return window['go']['main']['App']['GetRoom'](arg1);
+}
+
+export function GetRooms() {
+  return window['go']['main']['App']['GetRooms']();
+}
+
+export function GetSafetyNumber(arg1) {
+  return window['go']['main']['App']['GetSafetyNumber'](arg1);
+}
+
+export function HasSavedSession() {
+  return window['go']['main']['App']['HasSavedSession']();
+}
+
+export function LeaveRoom(arg1) {
+  return window['go']['main']['App']['LeaveRoom'](arg1);
+}
+
+export function RecoverPassword(arg1) {
+  return window['go']['main']['App']['RecoverPassword'](arg1);
 }
 
-export function GetRabbitMqHost() {
-  return window['go']['main']['App']['GetRabbitMqHost']();
+export function RefreshSession() {
+  return window['go']['main']['App']['RefreshSession']();
 }
 
-export function GetRabbitMqPassword() {
-  return window['go']['main']['App']['GetRabbitMqPassword']();
+export function RegenerateRecoveryCodes() {
+  return window['go']['main']['App']['RegenerateRecoveryCodes']();
 }
 
-export function GetSupaBaseApiKey() {
-  return window['go']['main']['App']['GetSupaBaseApiKey']();
+export function RemoveMember(arg1, arg2) {
+  return window['go']['main']['App']['RemoveMember'](arg1, arg2);
 }
 
-export function GetSupaBaseUrl() {
-  return window['go']['main']['App']['GetSupaBaseUrl']();
+export function RetryMessage(arg1) {
+  return window['go']['main']['App']['RetryMessage'](arg1);
 }
 
-export function RetrieveEnvValues() {
-  return window['go']['main']['App']['RetrieveEnvValues']();
+export function SaveSession(arg1) {
+  return window['go']['main']['App']['SaveSession'](arg1);
 }
 
 export function Send(arg1, arg2) {
   return window['go']['main']['App']['Send'](arg1, arg2);
 }
 
+export function SetAccessToken(arg1) {
+  return window['go']['main']['App']['SetAccessToken'](arg1);
+}
+
+export function SetContactNickname(arg1, arg2) {
+  return window['go']['main']['App']['SetContactNickname'](arg1, arg2);
+}
+
 export function SetQueuName(arg1) {
   return window['go']['main']['App']['SetQueuName'](arg1);
 }
 
+export function SignIn(arg1, arg2) {
+  return window['go']['main']['App']['SignIn'](arg1, arg2);
+}
+
+export function SignInWithGithub() {
+  return window['go']['main']['App']['SignInWithGithub']();
+}
+
+export function SignInWithRecoveryCode(arg1) {
+  return window['go']['main']['App']['SignInWithRecoveryCode'](arg1);
+}
+
+export function SignOut() {
+  return window['go']['main']['App']['SignOut']();
+}
+
+export function SignUp(arg1, arg2, arg3) {
+  return window['go']['main']['App']['SignUp'](arg1, arg2, arg3);
+}
+
+export function TrustContactKeys(arg1) {
+  return window['go']['main']['App']['TrustContactKeys'](arg1);
+}
+
+export function UnenrollFactor(arg1) {
+  return window['go']['main']['App']['UnenrollFactor'](arg1);
+}
+
+export function UnlockSession(arg1) {
+  return window['go']['main']['App']['UnlockSession'](arg1);
+}
+
 export function ValidateEmail(arg1) {
   return window['go']['main']['App']['ValidateEmail'](arg1);
 }
+
+export function VerifySignIn(arg1) {
+  return window['go']['main']['App']['VerifySignIn'](arg1);
+}
+
+export function VerifyContact(arg1) {
+  return window['go']['main']['App']['VerifyContact'](arg1);
+}
@@ -1,31 +1,252 @@
 export namespace main {
 	
-	export class Config {
+	export class AuthUser {
+	    id: string;
+	    email: string;
+	    userName: string;
+	    emailConfirmed: boolean;
+	    mfaRequired: boolean;
+	
+	    static createFrom(source: any = {}) {
+	        return new AuthUser(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.id = source["id"];
+	        this.email = source["email"];
+	        this.userName = source["userName"];
+	        this.emailConfirmed = source["emailConfirmed"];
+	        this.mfaRequired = source["mfaRequired"];
+	    }
+	}
+	
+	export class BrokerStatus {
+	    connected: boolean;
+	    blocked: boolean;
+	    broker: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new BrokerStatus(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.connected = source["connected"];
+	        this.blocked = source["blocked"];
+	        this.broker = source["broker"];
+	    }
+	}
+	
+	export class ConfigProblem {
+	    field: string;
+	    source: string;
+	    message: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new ConfigProblem(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.field = source["field"];
+	        this.source = source["source"];
+	        this.message = source["message"];
+	    }
+	}
+	
+	export class Contact {
+	    userId: string;
+	    userName: string;
+	    nickname: string;
+	    status: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new Contact(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.userId = source["userId"];
+	        this.userName = source["userName"];
+	        this.nickname = source["nickname"];
+	        this.status = source["status"];
+	    }
+	}
+	
+	export class DeliveryStatus {
+	    messageId: string;
+	    chatRoomId: string;
+	    state: string;
+	    error: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new DeliveryStatus(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.messageId = source["messageId"];
+	        this.chatRoomId = source["chatRoomId"];
+	        this.state = source["state"];
+	        this.error = source["error"];
+	    }
+	}
+	
+	export class MfaFactor {
+	    id: string;
+	    friendlyName: string;
+	    type: string;
+	    verified: boolean;
+	
+	    static createFrom(source: any = {}) {
+	        return new MfaFactor(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.id = source["id"];
+	        this.friendlyName = source["friendlyName"];
+	        this.type = source["type"];
+	        this.verified = source["verified"];
+	    }
+	}
+	
+	export class OutboxEntry {
+	    messageId: string;
+	    chatRoomId: string;
+	    message: string;
+	    time: string;
+	    attempts: number;
+	    nextAttempt: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new OutboxEntry(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.messageId = source["messageId"];
+	        this.chatRoomId = source["chatRoomId"];
+	        this.message = source["message"];
+	        this.time = source["time"];
+	        this.attempts = source["attempts"];
+	        this.nextAttempt = source["nextAttempt"];
+	    }
+	}
+	
+	export class PublicConfig {
 	    appId: string;
-	    appSecret: string;
 	    appKey: string;
 	    clusterId: string;
-	    supaBaseApiKey: string;
 	    supaBaseUrl: string;
-	    rabbitMqAdmin: string;
-	    rabbitMqPassword: string;
-	    rabbitMqHost: string;
+	    supaBaseAnonKey: string;
 	
 	    static createFrom(source: any = {}) {
-	        return new Config(source);
+	        return new PublicConfig(source);
 	    }
 	
 	    constructor(source: any = {}) {
 	        if ('string' === typeof source) source = JSON.parse(source);
 	        this.appId = source["appId"];
-	        this.appSecret = source["appSecret"];
 	        this.appKey = source["appKey"];
 	        this.clusterId = source["clusterId"];
-	        this.supaBaseApiKey = source["supaBaseApiKey"];
 	        this.supaBaseUrl = source["supaBaseUrl"];
-	        this.rabbitMqAdmin = source["rabbitMqAdmin"];
-	        this.rabbitMqPassword = source["rabbitMqPassword"];
-	        this.rabbitMqHost = source["rabbitMqHost"];
+	        this.supaBaseAnonKey = source["supaBaseAnonKey"];
+	    }
+	}
+	
+	export class Room {
+	    id: string;
+	    name: string;
+	    createdBy: string;
+	    direct: boolean;
+	    members: Array<main.RoomMember>;
+	
+	    static createFrom(source: any = {}) {
+	        return new Room(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.id = source["id"];
+	        this.name = source["name"];
+	        this.createdBy = source["createdBy"];
+	        this.direct = source["direct"];
+	        this.members = this.convertValues(source["members"], main.RoomMember);
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	
+	export class RoomMember {
+	    userId: string;
+	    role: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new RoomMember(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.userId = source["userId"];
+	        this.role = source["role"];
+	    }
+	}
+	
+	export class SafetyNumber {
+	    chatRoomId: string;
+	    userId: string;
+	    digits: string;
+	    qrPayload: string;
+	    verified: boolean;
+	
+	    static createFrom(source: any = {}) {
+	        return new SafetyNumber(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.chatRoomId = source["chatRoomId"];
+	        this.userId = source["userId"];
+	        this.digits = source["digits"];
+	        this.qrPayload = source["qrPayload"];
+	        this.verified = source["verified"];
+	    }
+	}
+	
+	export class TotpEnrollment {
+	    factorId: string;
+	    secret: string;
+	    uri: string;
+	    qrCode: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new TotpEnrollment(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.factorId = source["factorId"];
+	        this.secret = source["secret"];
+	        this.uri = source["uri"];
+	        this.qrCode = source["qrCode"];
 	    }
 	}
 
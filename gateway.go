@@ -0,0 +1,865 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	utils "github.com/benni347/messengerutils"
+	"github.com/gorilla/websocket"
+)
+
+// The gateway lets web clients, which cannot speak AMQP, take part in
+// the chat rooms over a WebSocket. A client connects to /ws with its
+// Supabase access token in the Authorization header or, since browsers
+// cannot set headers on WebSockets, sends it in an auth frame right
+// after connecting. Tokens in the URL are not accepted, proxies and
+// access logs keep them. The client then exchanges JSON frames:
+//
+//	-> {"type":"subscribe","room":"<room id>","peer":"<user id>","message":{...}}
+//	<- {"type":"subscribed","room":"<room id>"}
+//	-> {"type":"unsubscribe","room":"<room id>"}
+//	<- {"type":"unsubscribed","room":"<room id>"}
+//	-> {"type":"publish","message":{...}}
+//	<- {"type":"ack","id":"<message id>"} once the broker took it over
+//	<- {"type":"nack","id":"<message id>","error":"..."} if it did not
+//	<- {"type":"message","message":{...}} for every message of a room
+//	-> {"type":"auth","token":"<access token>"} before the token expires
+//	<- {"type":"authenticated"}
+//	<- {"type":"error","error":"..."} for frames that make no sense
+//
+// Messages are the same envelopes the app sends, the sender has to be
+// the user the token belongs to. A client may subscribe to the public
+// room, to its direct rooms, named by the other user as peer, and to the
+// groups it is a member of, and only publish to rooms it subscribed to.
+// The gateway learns the groups from the signed announcements passing
+// through it, a client subscribing to a group the gateway does not know
+// yet sends the latest announcement of the group along as message. The
+// members a message is delivered to are the two users of a direct room,
+// the members of a group, or nobody in particular for the public room.
+//
+// Like the app, the gateway drops messages of senders who are not
+// members of the room and checks the signature of every message against
+// the key its sender published, the outcome is in verified and warning.
+// It pins no keys, a client that does compares them itself. Messages
+// are forwarded as they were sent, so encrypted is never set. The
+// connection is closed once the token expired. All clients share one
+// temporary inbox that receives every room somebody subscribed to.
+const (
+	gatewayPath = "/ws"
+
+	gatewaySubscribe    = "subscribe"
+	gatewaySubscribed   = "subscribed"
+	gatewayUnsubscribe  = "unsubscribe"
+	gatewayUnsubscribed = "unsubscribed"
+	gatewayPublish      = "publish"
+	gatewayAck          = "ack"
+	gatewayNack         = "nack"
+	gatewayMessage      = "message"
+	gatewayError        = "error"
+	gatewayAuth         = "auth"
+	gatewayAuthed       = "authenticated"
+
+	gatewayMaxFrame     = 64 * 1024
+	gatewayAuthTimeout  = 10 * time.Second
+	gatewaySendBuffer   = 64
+	gatewayWriteTimeout = 10 * time.Second
+	gatewayPongTimeout  = 60 * time.Second
+	gatewayPingInterval = 25 * time.Second
+)
+
+var (
+	errUnknownFrame  = errors.New("unknown frame type")
+	errForeignSender = errors.New("the sender of the message is not the signed in user")
+	errSlowClient    = errors.New("the client does not keep up with its messages")
+	errOtherUser     = errors.New("the access token belongs to another user")
+	errMissingToken  = errors.New("the first frame has to be an auth frame with the access token")
+	errStaleRoom     = errors.New("the room announcement is older than the known room")
+)
+
+// gatewayFrame is a frame in either direction, see above.
+type gatewayFrame struct {
+	Type    string          `json:"type"`
+	Room    string          `json:"room,omitempty"`
+	Id      string          `json:"id,omitempty"`
+	Message json.RawMessage `json:"message,omitempty"`
+	Peer    string          `json:"peer,omitempty"`
+	Token   string          `json:"token,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// gateway bridges the transport to the connected WebSocket clients.
+type gateway struct {
+	transport Transport
+	tokens    *tokenVerifier
+	supabase  *supabaseClient
+	roomIdKey []byte
+	upgrader  websocket.Upgrader
+	// groups are the group rooms as last announced, in memory only
+	groups *roomDirectory
+
+	// membership serializes join and leave, so the inbox joins a room
+	// exactly when it gets its first client and leaves it with the last
+	membership sync.Mutex
+
+	mu sync.Mutex
+	// rooms holds the clients subscribed to each room along with the
+	// other user of the room, empty for the public room and groups
+	rooms map[string]map[*gatewayClient]string
+	// announced is the time of the announcement each group is known by
+	announced map[string]time.Time
+	// keys caches the public keys of the senders, refetched records
+	// when they were last fetched because a signature did not match
+	keys      map[string]cachedContactKeys
+	refetched map[string]time.Time
+}
+
+// gatewayClient is a single WebSocket connection of a signed in user.
+type gatewayClient struct {
+	gateway *gateway
+	conn    *websocket.Conn
+	userId  string
+	send    chan gatewayFrame
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// runGateway serves the WebSocket gateway on the configured address
+// until the process is interrupted.
+func runGateway(c Config, problems []ConfigProblem) error {
+	for _, problem := range problems {
+		utils.PrintError("Invalid configuration", fmt.Errorf("%s (%s): %s", problem.Field, problem.Source, problem.Message))
+	}
+	if len(problems) > 0 {
+		return errInvalidConfig
+	}
+	m := &utils.MessengerUtils{
+		Verbose: true,
+	}
+
+	transport, err := newTransport(c, true)
+	if err != nil {
+		return err
+	}
+	supabase := newSupabaseClient(c.SupaBaseUrl, c.SupaBaseApiKey)
+	g := newGateway(transport, newTokenVerifier(c), supabase, []byte(c.RoomIdKey), splitList(c.GatewayOrigins))
+	transport.Connect()
+	stop := transport.Subscribe("", g.subscribedRooms, g.dispatch)
+	defer transport.Close()
+	defer stop()
+
+	mux := http.NewServeMux()
+	mux.Handle(gatewayPath, g)
+	server := &http.Server{
+		Addr:              c.GatewayAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		shutdown, done := context.WithTimeout(context.Background(), 5*time.Second)
+		defer done()
+		if err := server.Shutdown(shutdown); err != nil {
+			utils.PrintError("Failed to shut the gateway down", err)
+		}
+	}()
+
+	m.PrintInfo("Serving the gateway on " + gatewayUrl(c.GatewayAddr))
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func newGateway(transport Transport, tokens *tokenVerifier, supabase *supabaseClient, roomIdKey []byte, origins []string) *gateway {
+	g := &gateway{
+		transport: transport,
+		tokens:    tokens,
+		supabase:  supabase,
+		roomIdKey: roomIdKey,
+		groups:    newRoomDirectory(),
+		rooms:     make(map[string]map[*gatewayClient]string),
+		announced: make(map[string]time.Time),
+		keys:      make(map[string]cachedContactKeys),
+		refetched: make(map[string]time.Time),
+	}
+	g.upgrader = websocket.Upgrader{
+		CheckOrigin: checkOrigin(origins),
+	}
+	return g
+}
+
+// checkOrigin accepts the listed origins, * accepts any. Without a list
+// only same origin requests and clients that send no origin are accepted.
+func checkOrigin(origins []string) func(r *http.Request) bool {
+	if len(origins) == 0 {
+		return nil
+	}
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		for _, allowed := range origins {
+			if allowed == "*" || strings.EqualFold(allowed, origin) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// ServeHTTP authenticates the client and upgrades the connection. A
+// client without an Authorization header authenticates with its first
+// frame instead.
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := bearerToken(r)
+	var claims tokenClaims
+	if token != "" {
+		var err error
+		if claims, err = g.tokens.verify(token); err != nil {
+			utils.PrintError("Refused a gateway client", err)
+			http.Error(w, "invalid access token", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	conn, err := g.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader already answered the request
+		return
+	}
+	fromFrame := token == ""
+	if fromFrame {
+		if token, claims, err = g.firstAuth(conn); err != nil {
+			utils.PrintError("Refused a gateway client", err)
+			closing := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error())
+			_ = conn.WriteControl(websocket.CloseMessage, closing, time.Now().Add(gatewayWriteTimeout))
+			_ = conn.Close()
+			return
+		}
+	}
+	client := &gatewayClient{
+		gateway: g,
+		conn:    conn,
+		userId:  claims.Subject,
+		token:   token,
+		expires: claims.expires(),
+		send:    make(chan gatewayFrame, gatewaySendBuffer),
+		done:    make(chan struct{}),
+	}
+	go client.writeLoop()
+	if fromFrame {
+		client.deliver(gatewayFrame{Type: gatewayAuthed})
+	}
+	client.readLoop()
+}
+
+// bearerToken takes the access token from the Authorization header.
+func bearerToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	}
+	return ""
+}
+
+// firstAuth waits gatewayAuthTimeout for the auth frame of a client that
+// did not send its token as header and verifies the token.
+func (g *gateway) firstAuth(conn *websocket.Conn) (string, tokenClaims, error) {
+	conn.SetReadLimit(gatewayMaxFrame)
+	_ = conn.SetReadDeadline(time.Now().Add(gatewayAuthTimeout))
+	var frame gatewayFrame
+	if err := conn.ReadJSON(&frame); err != nil {
+		return "", tokenClaims{}, err
+	}
+	if frame.Type != gatewayAuth || frame.Token == "" {
+		return "", tokenClaims{}, errMissingToken
+	}
+	claims, err := g.tokens.verify(frame.Token)
+	if err != nil {
+		return "", tokenClaims{}, err
+	}
+	return frame.Token, claims, nil
+}
+
+// subscribedRooms lists the rooms at least one client subscribed to.
+func (g *gateway) subscribedRooms() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	rooms := make([]string, 0, len(g.rooms))
+	for roomId := range g.rooms {
+		rooms = append(rooms, roomId)
+	}
+	return rooms
+}
+
+// dispatch verifies a message from the broker and hands it to the
+// clients of its room whose room the sender belongs to. Room
+// announcements update the known groups and are dropped unless they
+// verify and the sender was allowed to make the change, clients no
+// longer in the group are unsubscribed once they got the announcement.
+func (g *gateway) dispatch(msg Message) {
+	isRoom := msg.ContentType == roomContentType
+	g.mu.Lock()
+	clients := make([]*gatewayClient, 0, len(g.rooms[msg.ChatRoomId]))
+	for client, peerId := range g.rooms[msg.ChatRoomId] {
+		// room updates check the sender against the known room themselves
+		if isRoom || g.checkSender(msg, client.userId, peerId) == nil {
+			clients = append(clients, client)
+		}
+	}
+	g.mu.Unlock()
+	if len(clients) == 0 {
+		return
+	}
+
+	err := g.verify(&msg, clients[0].accessToken())
+	msg.Encrypted = false
+	if isRoom {
+		if err == nil {
+			err = g.applyRoomUpdate(msg)
+		}
+		if err != nil {
+			utils.PrintError("Dropping a room update from "+msg.Sender, err)
+			return
+		}
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		utils.PrintError("Dropping a message", err)
+		return
+	}
+	frame := gatewayFrame{Type: gatewayMessage, Message: body}
+	for _, client := range clients {
+		client.deliver(frame)
+	}
+	if isRoom {
+		g.unsubscribeRemoved(msg.ChatRoomId)
+	}
+}
+
+// checkSender makes sure the sender of the message belongs to the room
+// the way the client was authorized for it, see App.checkSender. The
+// caller must hold the lock.
+func (g *gateway) checkSender(msg Message, userId, peerId string) error {
+	switch {
+	case msg.ChatRoomId == publicChatRoomId:
+		return nil
+	case peerId != "":
+		if msg.Sender == userId || msg.Sender == peerId {
+			return nil
+		}
+	default:
+		if room, ok := g.groups.get(msg.ChatRoomId); ok {
+			if _, ok := room.member(msg.Sender); ok {
+				return nil
+			}
+		}
+	}
+	return errSenderNotAMember
+}
+
+// verify checks the signature of a message against the key its sender
+// published and records the outcome on the message, like App.verify.
+// The keys are read with the access token of a client.
+func (g *gateway) verify(msg *Message, token string) error {
+	msg.Verified = false
+	msg.Warning = ""
+	err := errUnsigned
+	if msg.Sender != "" {
+		var keys contactKeys
+		if keys, err = g.senderKeys(msg.Sender, token, false); err == nil {
+			if err = verifyMessage(keys.signing, *msg); err != nil {
+				// the sender may have new keys since they were fetched
+				if keys, err = g.senderKeys(msg.Sender, token, true); err == nil {
+					err = verifyMessage(keys.signing, *msg)
+				}
+			}
+		}
+	}
+	if err != nil {
+		msg.Warning = err.Error()
+		return err
+	}
+	msg.Verified = true
+	return nil
+}
+
+// senderKeys returns the public keys of the user, cached for
+// contactKeysMaxAge. With refetch set they are fetched again, unless
+// that already happened within contactKeysRefetchInterval.
+func (g *gateway) senderKeys(userId, token string, refetch bool) (contactKeys, error) {
+	g.mu.Lock()
+	cached, ok := g.keys[userId]
+	if refetch && time.Since(g.refetched[userId]) >= contactKeysRefetchInterval {
+		ok = false
+		g.refetched[userId] = time.Now()
+	}
+	g.mu.Unlock()
+	if ok && time.Since(cached.fetched) < contactKeysMaxAge {
+		return cached.keys, nil
+	}
+
+	published, err := g.supabase.fetchPublicKeysAs(token, userId)
+	if err != nil {
+		return contactKeys{}, err
+	}
+	keys, err := published.decode()
+	if err != nil {
+		return contactKeys{}, err
+	}
+	g.mu.Lock()
+	for id, old := range g.keys {
+		if time.Since(old.fetched) >= contactKeysMaxAge {
+			delete(g.keys, id)
+			delete(g.refetched, id)
+		}
+	}
+	g.keys[userId] = cachedContactKeys{keys: keys, fetched: time.Now()}
+	g.mu.Unlock()
+	return keys, nil
+}
+
+// applyRoomUpdate takes over a verified room announcement under the
+// rules of App.applyRoomUpdate. An announcement older than the one the
+// group is known by is refused, so an old announcement cannot bring
+// back a member who was removed since.
+func (g *gateway) applyRoomUpdate(msg Message) error {
+	room, err := decodeRoom(msg)
+	if err != nil {
+		return err
+	}
+	sent, err := time.Parse(time.RFC3339, msg.Time)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errMalformedMessage, err)
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	known, ok := g.groups.get(room.Id)
+	switch {
+	case ok && known.equal(room):
+		return nil
+	case ok && sent.Before(g.announced[room.Id]):
+		return errStaleRoom
+	case ok && !known.allowsUpdate(room, msg.Sender):
+		return errNotPermitted
+	case !ok && !room.isNewGroup(msg.Sender):
+		return errNotPermitted
+	}
+	g.groups.put(room)
+	g.announced[room.Id] = sent
+	return nil
+}
+
+// announce takes over a room announcement a client publishes to the
+// group with the given members, the way the app changes its room before
+// announcing it. It returns the users the announcement goes to, the
+// members before and after, and the ones it removed.
+func (g *gateway) announce(client *gatewayClient, msg Message, members []string) ([]string, []string, error) {
+	if err := g.verify(&msg, client.accessToken()); err != nil {
+		return nil, nil, err
+	}
+	if err := g.applyRoomUpdate(msg); err != nil {
+		return nil, nil, err
+	}
+	room, _ := g.groups.get(msg.ChatRoomId)
+	before := make(map[string]bool, len(members))
+	var removed []string
+	for _, userId := range members {
+		before[userId] = true
+		if _, ok := room.member(userId); !ok {
+			removed = append(removed, userId)
+		}
+	}
+	for _, m := range room.Members {
+		if !before[m.UserId] {
+			members = append(members, m.UserId)
+		}
+	}
+	return members, removed, nil
+}
+
+// unsubscribeRemoved unsubscribes the clients of a group who are no
+// longer its members.
+func (g *gateway) unsubscribeRemoved(roomId string) {
+	room, _ := g.groups.get(roomId)
+	g.mu.Lock()
+	var removed []*gatewayClient
+	for client := range g.rooms[roomId] {
+		if _, ok := room.member(client.userId); !ok {
+			removed = append(removed, client)
+		}
+	}
+	g.mu.Unlock()
+	for _, client := range removed {
+		if err := g.leave(client, roomId); err != nil {
+			utils.PrintError("Failed to leave "+roomId, err)
+		}
+		client.deliver(gatewayFrame{Type: gatewayUnsubscribed, Room: roomId})
+	}
+}
+
+// authorize checks that the client may use the room: the public room
+// is open to everybody, a direct room only to the two users it was
+// derived for and a group only to its members. A group the gateway does
+// not know yet is taken over from the announcement the client sent
+// along. It returns the other user of a direct room.
+func (g *gateway) authorize(client *gatewayClient, frame gatewayFrame) (string, error) {
+	roomId := frame.Room
+	if roomId == publicChatRoomId {
+		return "", nil
+	}
+	if frame.Peer != "" {
+		direct, err := directRoomId(g.roomIdKey, client.userId, frame.Peer)
+		if err != nil {
+			return "", err
+		}
+		if direct != roomId {
+			return "", errNotAMember
+		}
+		return normalizeUserId(frame.Peer)
+	}
+
+	if len(frame.Message) > 0 {
+		msg, err := decodeMessage(frame.Message)
+		if err != nil {
+			return "", err
+		}
+		if msg.ContentType != roomContentType || msg.ChatRoomId != roomId {
+			return "", fmt.Errorf("%w: not an announcement of the room", errMalformedMessage)
+		}
+		if err := g.verify(&msg, client.accessToken()); err != nil {
+			return "", err
+		}
+		if err := g.applyRoomUpdate(msg); err != nil {
+			return "", err
+		}
+	}
+	room, ok := g.groups.get(roomId)
+	if !ok {
+		return "", errUnknownRoom
+	}
+	if _, ok := room.member(client.userId); !ok {
+		return "", errNotAMember
+	}
+	return "", nil
+}
+
+// subscribed reports whether the client subscribed to the room and
+// returns the other user of the room the client was authorized for.
+func (g *gateway) subscribed(client *gatewayClient, roomId string) (string, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	peerId, ok := g.rooms[roomId][client]
+	return peerId, ok
+}
+
+// members are the users a message of the client to the room goes to:
+// the client and the other user of a direct room, the members of a
+// group, nobody in particular for the public room.
+func (g *gateway) members(client *gatewayClient, roomId string) ([]string, error) {
+	if roomId == publicChatRoomId {
+		return nil, nil
+	}
+	peerId, ok := g.subscribed(client, roomId)
+	if !ok {
+		return nil, errNotAMember
+	}
+	if peerId != "" {
+		return []string{client.userId, peerId}, nil
+	}
+	room, ok := g.groups.get(roomId)
+	if !ok {
+		return nil, errUnknownRoom
+	}
+	if _, ok := room.member(client.userId); !ok {
+		return nil, errNotAMember
+	}
+	members := make([]string, 0, len(room.Members))
+	for _, m := range room.Members {
+		members = append(members, m.UserId)
+	}
+	return members, nil
+}
+
+// join adds the client to the room it was authorized for with the other
+// user, the inbox receives the room from the first client on. If the
+// inbox cannot join the room, the client is not added.
+func (g *gateway) join(client *gatewayClient, roomId, peerId string) error {
+	g.membership.Lock()
+	defer g.membership.Unlock()
+	g.mu.Lock()
+	clients, ok := g.rooms[roomId]
+	if ok {
+		clients[client] = peerId
+	}
+	g.mu.Unlock()
+	if ok {
+		return nil
+	}
+
+	if err := g.transport.Join(roomId); err != nil {
+		return err
+	}
+	g.mu.Lock()
+	g.rooms[roomId] = map[*gatewayClient]string{client: peerId}
+	g.mu.Unlock()
+	return nil
+}
+
+// leave removes the client from the room, the inbox stops receiving
+// the room once the last client left it.
+func (g *gateway) leave(client *gatewayClient, roomId string) error {
+	g.membership.Lock()
+	defer g.membership.Unlock()
+	g.mu.Lock()
+	clients := g.rooms[roomId]
+	if _, ok := clients[client]; !ok {
+		g.mu.Unlock()
+		return nil
+	}
+	delete(clients, client)
+	empty := len(clients) == 0
+	if empty {
+		delete(g.rooms, roomId)
+	}
+	g.mu.Unlock()
+	if !empty {
+		return nil
+	}
+	return g.transport.Leave("", roomId)
+}
+
+// leaveAll removes the client from every room it subscribed to.
+func (g *gateway) leaveAll(client *gatewayClient) {
+	g.mu.Lock()
+	var rooms []string
+	for roomId, clients := range g.rooms {
+		if _, ok := clients[client]; ok {
+			rooms = append(rooms, roomId)
+		}
+	}
+	g.mu.Unlock()
+	for _, roomId := range rooms {
+		if err := g.leave(client, roomId); err != nil {
+			utils.PrintError("Failed to leave "+roomId, err)
+		}
+	}
+}
+
+// readLoop handles the frames of the client until the connection closes.
+func (c *gatewayClient) readLoop() {
+	defer c.close()
+	c.conn.SetReadLimit(gatewayMaxFrame)
+	_ = c.conn.SetReadDeadline(time.Now().Add(gatewayPongTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(gatewayPongTimeout))
+	})
+
+	for {
+		var frame gatewayFrame
+		if err := c.conn.ReadJSON(&frame); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				utils.PrintError("Gateway client "+c.userId+" went away", err)
+			}
+			return
+		}
+		c.handle(frame)
+	}
+}
+
+func (c *gatewayClient) handle(frame gatewayFrame) {
+	if frame.Type != gatewayAuth && c.expired() {
+		c.deliver(gatewayFrame{Type: gatewayError, Error: errTokenExpired.Error()})
+		return
+	}
+	switch frame.Type {
+	case gatewayAuth:
+		if err := c.authenticate(frame.Token); err != nil {
+			c.deliver(gatewayFrame{Type: gatewayError, Error: err.Error()})
+			return
+		}
+		c.deliver(gatewayFrame{Type: gatewayAuthed})
+	case gatewaySubscribe:
+		if err := validateRoomId(frame.Room); err != nil {
+			c.deliver(gatewayFrame{Type: gatewayError, Room: frame.Room, Error: err.Error()})
+			return
+		}
+		peerId, err := c.gateway.authorize(c, frame)
+		if err != nil {
+			c.deliver(gatewayFrame{Type: gatewayError, Room: frame.Room, Error: err.Error()})
+			return
+		}
+		if err := c.gateway.join(c, frame.Room, peerId); err != nil {
+			c.deliver(gatewayFrame{Type: gatewayError, Room: frame.Room, Error: err.Error()})
+			return
+		}
+		c.deliver(gatewayFrame{Type: gatewaySubscribed, Room: frame.Room})
+	case gatewayUnsubscribe:
+		if err := c.gateway.leave(c, frame.Room); err != nil {
+			c.deliver(gatewayFrame{Type: gatewayError, Room: frame.Room, Error: err.Error()})
+			return
+		}
+		c.deliver(gatewayFrame{Type: gatewayUnsubscribed, Room: frame.Room})
+	case gatewayPublish:
+		c.publish(frame)
+	default:
+		c.deliver(gatewayFrame{Type: gatewayError, Error: fmt.Sprintf("%v: %q", errUnknownFrame, frame.Type)})
+	}
+}
+
+// authenticate extends the connection with a fresh token of the same user.
+func (c *gatewayClient) authenticate(token string) error {
+	claims, err := c.gateway.tokens.verify(token)
+	if err != nil {
+		return err
+	}
+	if claims.Subject != c.userId {
+		return errOtherUser
+	}
+	c.mu.Lock()
+	c.token = token
+	c.expires = claims.expires()
+	c.mu.Unlock()
+	return nil
+}
+
+// accessToken is the latest access token of the client.
+func (c *gatewayClient) accessToken() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.token
+}
+
+// expired reports whether the token of the client expired.
+func (c *gatewayClient) expired() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Now().After(c.expires)
+}
+
+// publish validates the message and publishes it for the client,
+// the client is told once the broker confirmed it.
+func (c *gatewayClient) publish(frame gatewayFrame) {
+	msg, err := decodeMessage(frame.Message)
+	if err != nil {
+		c.deliver(gatewayFrame{Type: gatewayError, Error: err.Error()})
+		return
+	}
+	if msg.Sender != c.userId {
+		c.deliver(gatewayFrame{Type: gatewayNack, Id: msg.Id, Error: errForeignSender.Error()})
+		return
+	}
+	members, err := c.gateway.members(c, msg.ChatRoomId)
+	var removed []string
+	if err == nil && msg.ContentType == roomContentType {
+		members, removed, err = c.gateway.announce(c, msg, members)
+	}
+	if err != nil {
+		c.deliver(gatewayFrame{Type: gatewayNack, Id: msg.Id, Error: err.Error()})
+		return
+	}
+	confirmation, err := c.gateway.transport.Publish(msg, members)
+	if err != nil {
+		c.deliver(gatewayFrame{Type: gatewayNack, Id: msg.Id, Error: err.Error()})
+		return
+	}
+	for _, userId := range removed {
+		if err := c.gateway.transport.Leave(userId, msg.ChatRoomId); err != nil {
+			utils.PrintError("Failed to stop delivering the room to "+userId, err)
+		}
+	}
+	go func() {
+		select {
+		case err := <-confirmation:
+			if err != nil {
+				c.deliver(gatewayFrame{Type: gatewayNack, Id: msg.Id, Error: err.Error()})
+				return
+			}
+			c.deliver(gatewayFrame{Type: gatewayAck, Id: msg.Id})
+		case <-time.After(confirmTimeout):
+			c.deliver(gatewayFrame{Type: gatewayNack, Id: msg.Id, Error: errConfirmTimeout.Error()})
+		case <-c.done:
+		}
+	}()
+}
+
+// deliver queues a frame for the client. A client whose queue is full
+// is disconnected rather than holding up everybody else.
+func (c *gatewayClient) deliver(frame gatewayFrame) {
+	select {
+	case <-c.done:
+	case c.send <- frame:
+	default:
+		utils.PrintError("Disconnecting gateway client "+c.userId, errSlowClient)
+		c.close()
+	}
+}
+
+// writeLoop writes the queued frames and keeps the connection alive.
+func (c *gatewayClient) writeLoop() {
+	ticker := time.NewTicker(gatewayPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case frame := <-c.send:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(gatewayWriteTimeout))
+			if err := c.conn.WriteJSON(frame); err != nil {
+				c.close()
+				return
+			}
+		case <-ticker.C:
+			deadline := time.Now().Add(gatewayWriteTimeout)
+			if c.expired() {
+				closing := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, errTokenExpired.Error())
+				_ = c.conn.WriteControl(websocket.CloseMessage, closing, deadline)
+				c.close()
+				return
+			}
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+// close leaves all rooms and closes the connection, only once.
+func (c *gatewayClient) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.gateway.leaveAll(c)
+		if err := c.conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			utils.PrintError("closing gateway connection", err)
+		}
+	})
+}
+
+// gatewayUrl is where a client on this machine reaches the gateway.
+func gatewayUrl(addr string) string {
+	u := url.URL{Scheme: "ws", Host: addr, Path: gatewayPath}
+	if strings.HasPrefix(addr, ":") {
+		u.Host = "localhost" + addr
+	}
+	return u.String()
+}
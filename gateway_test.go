@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testGateway is a gateway on a memory broker whose users publish the
+// keys of the given identities.
+type testGateway struct {
+	url    string
+	broker *memoryBroker
+	key    []byte
+}
+
+func newTestGateway(t *testing.T, users map[string]*identity) *testGateway {
+	t.Helper()
+	profiles := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		found := []profileKeys{}
+		userId := strings.TrimPrefix(r.URL.Query().Get("id"), "eq.")
+		if id, ok := users[userId]; ok && r.URL.Path == "/rest/v1/"+profilesTable {
+			found = append(found, id.publicKeys(userId))
+		}
+		_ = json.NewEncoder(w).Encode(found)
+	}))
+	t.Cleanup(profiles.Close)
+
+	config := Config{SupaBaseUrl: profiles.URL, SupaBaseApiKey: "anon-key", SupaBaseJwtSecret: testJwtSecret}
+	broker := newMemoryBroker()
+	transport := broker.transport()
+	key := []byte("a room id key for the tests")
+	g := newGateway(transport, newTokenVerifier(config), newSupabaseClient(profiles.URL, "anon-key"), key, nil)
+	transport.Connect()
+	stop := transport.Subscribe("", g.subscribedRooms, g.dispatch)
+	server := httptest.NewServer(g)
+	t.Cleanup(func() {
+		server.Close()
+		stop()
+		transport.Close()
+	})
+	return &testGateway{url: "ws" + strings.TrimPrefix(server.URL, "http") + gatewayPath, broker: broker, key: key}
+}
+
+// dial connects as the user, with the token as header if asked to and
+// else in the first frame.
+func (g *testGateway) dial(t *testing.T, userId string, header bool) *websocket.Conn {
+	t.Helper()
+	token := testToken(t, userId, "aal1")
+	var headers http.Header
+	if header {
+		headers = http.Header{"Authorization": {"Bearer " + token}}
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(g.url, headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if !header {
+		sendFrame(t, conn, gatewayFrame{Type: gatewayAuth, Token: token})
+		expectFrame(t, conn, gatewayAuthed, "")
+	}
+	return conn
+}
+
+func sendFrame(t *testing.T, conn *websocket.Conn, frame gatewayFrame) {
+	t.Helper()
+	if err := conn.WriteJSON(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// nextFrame reads the next frame that is not an ack.
+func nextFrame(t *testing.T, conn *websocket.Conn) gatewayFrame {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var frame gatewayFrame
+		if err := conn.ReadJSON(&frame); err != nil {
+			t.Fatal(err)
+		}
+		if frame.Type != gatewayAck {
+			return frame
+		}
+	}
+}
+
+func expectFrame(t *testing.T, conn *websocket.Conn, frameType, room string) gatewayFrame {
+	t.Helper()
+	frame := nextFrame(t, conn)
+	if frame.Type != frameType || frame.Room != room {
+		t.Fatalf("got %+v, want a %s frame for %q", frame, frameType, room)
+	}
+	return frame
+}
+
+// nextMessage reads the next message frame.
+func nextMessage(t *testing.T, conn *websocket.Conn) Message {
+	t.Helper()
+	frame := expectFrame(t, conn, gatewayMessage, "")
+	msg, err := decodeMessage(frame.Message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func signedMessage(t *testing.T, id *identity, roomId, sender, text string) json.RawMessage {
+	t.Helper()
+	msg := newMessage(roomId, sender, text)
+	signMessage(id.signing, &msg)
+	body, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestGatewayAuthentication(t *testing.T) {
+	g := newTestGateway(t, nil)
+	token := testToken(t, aliceId, "aal1")
+
+	// a token in the query is ignored, the first frame has to be auth
+	conn, _, err := websocket.DefaultDialer.Dial(g.url+"?access_token="+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sendFrame(t, conn, gatewayFrame{Type: gatewaySubscribe, Room: publicChatRoomId})
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var frame gatewayFrame
+	err = conn.ReadJSON(&frame)
+	if closeErr := (*websocket.CloseError)(nil); !errors.As(err, &closeErr) || closeErr.Code != websocket.ClosePolicyViolation {
+		t.Fatalf("subscribing without auth: %+v, %v", frame, err)
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial(g.url, http.Header{"Authorization": {"Bearer not-a-token"}})
+	if err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("invalid header token: %v", err)
+	}
+
+	for _, header := range []bool{true, false} {
+		conn := g.dial(t, aliceId, header)
+		sendFrame(t, conn, gatewayFrame{Type: gatewaySubscribe, Room: publicChatRoomId})
+		expectFrame(t, conn, gatewaySubscribed, publicChatRoomId)
+	}
+}
+
+func TestGatewayVerifiesMessages(t *testing.T) {
+	alice := fixedIdentity(t, 9, 13)
+	bob := fixedIdentity(t, 7, 8)
+	carol := fixedIdentity(t, 5, 6)
+	g := newTestGateway(t, map[string]*identity{aliceId: alice, bobId: bob, carolId: carol})
+	direct, err := directRoomId(g.key, aliceId, bobId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceConn := g.dial(t, aliceId, true)
+	bobConn := g.dial(t, bobId, false)
+	sendFrame(t, aliceConn, gatewayFrame{Type: gatewaySubscribe, Room: direct, Peer: bobId})
+	expectFrame(t, aliceConn, gatewaySubscribed, direct)
+	sendFrame(t, bobConn, gatewayFrame{Type: gatewaySubscribe, Room: direct, Peer: aliceId})
+	expectFrame(t, bobConn, gatewaySubscribed, direct)
+
+	sendFrame(t, aliceConn, gatewayFrame{Type: gatewayPublish, Message: signedMessage(t, alice, direct, aliceId, "signed")})
+	if msg := nextMessage(t, bobConn); msg.Message != "signed" || !msg.Verified || msg.Warning != "" {
+		t.Fatalf("signed message: %+v", msg)
+	}
+
+	// straight to the broker: a forged signature claiming to be verified
+	// and encrypted, and a stranger in the direct room
+	forged := newMessage(direct, aliceId, "forged")
+	signMessage(carol.signing, &forged)
+	forged.Verified, forged.Encrypted = true, true
+	stranger := newMessage(direct, carolId, "stranger")
+	signMessage(carol.signing, &stranger)
+	publisher := g.broker.transport()
+	publisher.Connect()
+	for _, msg := range []Message{stranger, forged} {
+		if _, err := publisher.Publish(msg, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msg := nextMessage(t, bobConn)
+	if msg.Message != "forged" {
+		t.Fatalf("got %q, the message of the stranger was delivered", msg.Message)
+	}
+	if msg.Verified || msg.Encrypted || msg.Warning == "" {
+		t.Fatalf("forged message: %+v", msg)
+	}
+}
+
+func TestGatewayGroups(t *testing.T) {
+	alice := fixedIdentity(t, 9, 13)
+	bob := fixedIdentity(t, 7, 8)
+	carol := fixedIdentity(t, 5, 6)
+	g := newTestGateway(t, map[string]*identity{aliceId: alice, bobId: bob, carolId: carol})
+	group := Room{
+		Id:        groupId,
+		Name:      "friends",
+		CreatedBy: aliceId,
+		Members:   []RoomMember{{aliceId, RoleOwner}, {bobId, RoleMember}},
+	}
+	announce := func(room Room, at string) json.RawMessage {
+		msg, err := encodeRoom(room, aliceId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.Time = at
+		signMessage(alice.signing, &msg)
+		body, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+	created := announce(group, "2026-10-17T12:00:00Z")
+
+	aliceConn := g.dial(t, aliceId, true)
+	bobConn := g.dial(t, bobId, true)
+	carolConn := g.dial(t, carolId, true)
+	sendFrame(t, bobConn, gatewayFrame{Type: gatewaySubscribe, Room: groupId})
+	if frame := expectFrame(t, bobConn, gatewayError, groupId); frame.Error != errUnknownRoom.Error() {
+		t.Fatalf("unknown group: %s", frame.Error)
+	}
+	sendFrame(t, aliceConn, gatewayFrame{Type: gatewaySubscribe, Room: groupId, Message: created})
+	expectFrame(t, aliceConn, gatewaySubscribed, groupId)
+	sendFrame(t, bobConn, gatewayFrame{Type: gatewaySubscribe, Room: groupId})
+	expectFrame(t, bobConn, gatewaySubscribed, groupId)
+	sendFrame(t, carolConn, gatewayFrame{Type: gatewaySubscribe, Room: groupId, Message: created})
+	if frame := expectFrame(t, carolConn, gatewayError, groupId); frame.Error != errNotAMember.Error() {
+		t.Fatalf("carol subscribed: %s", frame.Error)
+	}
+
+	sendFrame(t, aliceConn, gatewayFrame{Type: gatewayPublish, Message: signedMessage(t, alice, groupId, aliceId, "hello")})
+	if msg := nextMessage(t, bobConn); msg.Message != "hello" || !msg.Verified {
+		t.Fatalf("group message: %+v", msg)
+	}
+
+	// bob still gets the announcement that removes him
+	sendFrame(t, aliceConn, gatewayFrame{Type: gatewayPublish, Message: announce(group.withoutMember(bobId), "2026-10-17T12:05:00Z")})
+	if msg := nextMessage(t, bobConn); msg.ContentType != roomContentType || !msg.Verified {
+		t.Fatalf("announcement: %+v", msg)
+	}
+	expectFrame(t, bobConn, gatewayUnsubscribed, groupId)
+	sendFrame(t, bobConn, gatewayFrame{Type: gatewaySubscribe, Room: groupId, Message: created})
+	if frame := expectFrame(t, bobConn, gatewayError, groupId); frame.Error != errStaleRoom.Error() {
+		t.Fatalf("subscribing with the old announcement: %s", frame.Error)
+	}
+	sendFrame(t, bobConn, gatewayFrame{Type: gatewayPublish, Message: signedMessage(t, bob, groupId, bobId, "still here")})
+	if frame := nextFrame(t, bobConn); frame.Type != gatewayNack {
+		t.Fatalf("publishing after the removal: %+v", frame)
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errInvalidCredentials = errors.New("invalid email or password")
+	errEmailNotConfirmed  = errors.New("the email address is not confirmed yet")
+	errUserExists         = errors.New("a user with this email address already exists")
+	errWeakPassword       = errors.New("the password is too weak")
+	errAuthRateLimited    = errors.New("too many requests, try again later")
+	errInvalidRefresh     = errors.New("the session ended, sign in again")
+	errInvalidEmail       = errors.New("invalid email address")
+	errMfaInvalidCode     = errors.New("invalid verification code")
+	errMfaChallenge       = errors.New("the verification expired, try again")
+	errMfaRequired        = errors.New("this needs a session verified with the second factor")
+)
+
+// AuthError is an error answered by Supabase Auth. Code is the error
+// code of GoTrue, like invalid_credentials, and leads the message, so
+// the frontend can tell the errors apart. errors.Is matches it against
+// the errors above.
+type AuthError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *AuthError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func (e *AuthError) Unwrap() error {
+	switch e.Code {
+	case "invalid_credentials":
+		return errInvalidCredentials
+	case "email_not_confirmed":
+		return errEmailNotConfirmed
+	case "user_already_exists", "email_exists":
+		return errUserExists
+	case "weak_password":
+		return errWeakPassword
+	case "over_request_rate_limit", "over_email_send_rate_limit", "over_sms_send_rate_limit":
+		return errAuthRateLimited
+	case "refresh_token_not_found", "refresh_token_already_used", "session_not_found", "session_expired":
+		return errInvalidRefresh
+	case "mfa_verification_failed":
+		return errMfaInvalidCode
+	case "mfa_challenge_expired":
+		return errMfaChallenge
+	case "insufficient_aal":
+		return errMfaRequired
+	}
+	return nil
+}
+
+// authErrorBody covers both the current error format of GoTrue and
+// the OAuth style one older versions answer with.
+type authErrorBody struct {
+	ErrorCode        string `json:"error_code"`
+	Msg              string `json:"msg"`
+	Message          string `json:"message"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// newAuthError decodes an error response. Older versions only answer
+// with a message, which is mapped to the code newer ones would send.
+func newAuthError(status int, body []byte) *AuthError {
+	var decoded authErrorBody
+	_ = json.Unmarshal(body, &decoded)
+	e := &AuthError{Status: status, Code: decoded.ErrorCode}
+	for _, message := range []string{decoded.Msg, decoded.Message, decoded.ErrorDescription, decoded.Error} {
+		if message != "" {
+			e.Message = message
+			break
+		}
+	}
+	if e.Message == "" {
+		e.Message = strings.TrimSpace(string(body))
+	}
+	if e.Message == "" {
+		e.Message = http.StatusText(status)
+	}
+	if e.Code != "" {
+		return e
+	}
+
+	message := strings.ToLower(e.Message)
+	switch {
+	case status == http.StatusTooManyRequests:
+		e.Code = "over_request_rate_limit"
+	case strings.Contains(message, "invalid login credentials"):
+		e.Code = "invalid_credentials"
+	case strings.Contains(message, "email not confirmed"):
+		e.Code = "email_not_confirmed"
+	case strings.Contains(message, "already registered"):
+		e.Code = "user_already_exists"
+	case strings.Contains(message, "password should"):
+		e.Code = "weak_password"
+	case strings.Contains(message, "refresh token"):
+		e.Code = "refresh_token_not_found"
+	case strings.Contains(message, "invalid totp code"):
+		e.Code = "mfa_verification_failed"
+	case strings.Contains(message, "challenge") && strings.Contains(message, "expired"):
+		e.Code = "mfa_challenge_expired"
+	case strings.Contains(message, "aal2"):
+		e.Code = "insufficient_aal"
+	case decoded.Error != "" && decoded.Error != e.Message:
+		e.Code = decoded.Error
+	default:
+		e.Code = "http_" + strconv.Itoa(status)
+	}
+	return e
+}
+
+// authClient talks to the GoTrue API of the Supabase project,
+// which lives under /auth/v1.
+type authClient struct {
+	baseUrl string
+	apiKey  string
+	http    *http.Client
+	now     func() time.Time
+}
+
+func newAuthClient(baseUrl, apiKey string) *authClient {
+	return &authClient{
+		baseUrl: strings.TrimRight(baseUrl, "/") + "/auth/v1",
+		apiKey:  apiKey,
+		http:    &http.Client{Timeout: 15 * time.Second},
+		now:     time.Now,
+	}
+}
+
+// authUser is a user as GoTrue describes it.
+type authUser struct {
+	Id               string                 `json:"id"`
+	Email            string                 `json:"email"`
+	EmailConfirmedAt string                 `json:"email_confirmed_at"`
+	UserMetadata     map[string]interface{} `json:"user_metadata"`
+	Factors          []authFactor           `json:"factors"`
+}
+
+// userName is the user_name the user signed up with, if any.
+func (u authUser) userName() string {
+	name, _ := u.UserMetadata["user_name"].(string)
+	return name
+}
+
+// verifiedFactor returns the first verified factor of the type,
+// nil if the user has none.
+func (u authUser) verifiedFactor(factorType string) *authFactor {
+	for i, factor := range u.Factors {
+		if factor.FactorType == factorType && factor.Status == "verified" {
+			return &u.Factors[i]
+		}
+	}
+	return nil
+}
+
+// authFactor is a second factor of a user. It only counts once it is
+// verified, until then enrolling it is not finished.
+type authFactor struct {
+	Id           string `json:"id"`
+	FriendlyName string `json:"friendly_name"`
+	FactorType   string `json:"factor_type"`
+	Status       string `json:"status"`
+}
+
+// authSession is a signed in session. The access token is short lived,
+// the refresh token trades it for a new one.
+type authSession struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresIn    int64     `json:"expires_in"`
+	ExpiresAt    int64     `json:"expires_at"`
+	User         *authUser `json:"user"`
+}
+
+// expires is when the access token expires.
+func (s *authSession) expires() time.Time {
+	return time.Unix(s.ExpiresAt, 0)
+}
+
+// do sends a request to the auth API and decodes the JSON response into
+// out, which may be nil. Error responses are returned as *AuthError.
+func (c *authClient) do(method, path string, query url.Values, accessToken string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	endpoint := c.baseUrl + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, endpoint, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("apikey", c.apiKey)
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return newAuthError(resp.StatusCode, message)
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("supabase auth %s %s: %w", method, path, err)
+	}
+	return nil
+}
+
+// tokenRequest asks for a session with the given grant type.
+func (c *authClient) tokenRequest(grantType string, body interface{}) (*authSession, error) {
+	var session authSession
+	if err := c.do(http.MethodPost, "/token", url.Values{"grant_type": {grantType}}, "", body, &session); err != nil {
+		return nil, err
+	}
+	if session.AccessToken == "" {
+		return nil, fmt.Errorf("%w: the answer has no access token", errInvalidToken)
+	}
+	if session.ExpiresAt == 0 {
+		session.ExpiresAt = c.now().Unix() + session.ExpiresIn
+	}
+	return &session, nil
+}
+
+// signInWithPassword signs in with email and password.
+func (c *authClient) signInWithPassword(email, password string) (*authSession, error) {
+	return c.tokenRequest("password", map[string]string{
+		"email":    email,
+		"password": password,
+	})
+}
+
+// refresh trades the refresh token for a new session.
+func (c *authClient) refresh(refreshToken string) (*authSession, error) {
+	return c.tokenRequest("refresh_token", map[string]string{
+		"refresh_token": refreshToken,
+	})
+}
+
+// signUp creates a user with the user name in its metadata. If the
+// project confirms email addresses, there is no session until the user
+// followed the link in the mail and only the user is returned.
+func (c *authClient) signUp(email, password, userName string) (*authSession, *authUser, error) {
+	body := map[string]interface{}{
+		"email":    email,
+		"password": password,
+	}
+	if userName != "" {
+		body["data"] = map[string]string{"user_name": userName}
+	}
+	var answer struct {
+		authSession
+		authUser
+	}
+	if err := c.do(http.MethodPost, "/signup", nil, "", body, &answer); err != nil {
+		return nil, nil, err
+	}
+	if answer.AccessToken == "" {
+		return nil, &answer.authUser, nil
+	}
+	session := answer.authSession
+	if session.ExpiresAt == 0 {
+		session.ExpiresAt = c.now().Unix() + session.ExpiresIn
+	}
+	return &session, session.User, nil
+}
+
+// signOut ends the session on the server, a session that already
+// ended does not count as an error.
+func (c *authClient) signOut(accessToken string) error {
+	err := c.do(http.MethodPost, "/logout", nil, accessToken, nil, nil)
+	var authErr *AuthError
+	if errors.As(err, &authErr) && (authErr.Status == http.StatusUnauthorized || authErr.Status == http.StatusNotFound) {
+		return nil
+	}
+	return err
+}
+
+// recover sends the password recovery mail.
+func (c *authClient) recover(email string) error {
+	return c.do(http.MethodPost, "/recover", nil, "", map[string]string{"email": email}, nil)
+}
+
+// user returns the user the access token belongs to.
+func (c *authClient) user(accessToken string) (*authUser, error) {
+	var user authUser
+	if err := c.do(http.MethodGet, "/user", nil, accessToken, nil, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// authorizeUrl is where the browser starts signing in with the OAuth
+// provider. Supabase sends it back to redirectTo with a code, which only
+// the holder of the verifier behind the challenge can exchange.
+func (c *authClient) authorizeUrl(provider, redirectTo, codeChallenge string) string {
+	query := url.Values{
+		"provider":              {provider},
+		"redirect_to":           {redirectTo},
+		"code_challenge":        {codeChallenge},
+		"code_challenge_method": {"s256"},
+	}
+	return c.baseUrl + "/authorize?" + query.Encode()
+}
+
+// exchangeCode trades the code of the OAuth redirect for a session.
+func (c *authClient) exchangeCode(code, codeVerifier string) (*authSession, error) {
+	return c.tokenRequest("pkce", map[string]string{
+		"auth_code":     code,
+		"code_verifier": codeVerifier,
+	})
+}
+
+// totpEnrollment is the answer to enrolling a TOTP factor.
+type totpEnrollment struct {
+	Id   string `json:"id"`
+	Type string `json:"type"`
+	Totp struct {
+		Secret string `json:"secret"`
+		Uri    string `json:"uri"`
+	} `json:"totp"`
+}
+
+// enrollTotp starts enrolling a TOTP factor, it has to be verified once
+// before it counts.
+func (c *authClient) enrollTotp(accessToken, friendlyName, issuer string) (*totpEnrollment, error) {
+	body := map[string]string{
+		"factor_type": "totp",
+		"issuer":      issuer,
+	}
+	if friendlyName != "" {
+		body["friendly_name"] = friendlyName
+	}
+	var enrollment totpEnrollment
+	if err := c.do(http.MethodPost, "/factors", nil, accessToken, body, &enrollment); err != nil {
+		return nil, err
+	}
+	return &enrollment, nil
+}
+
+// challengeAndVerify verifies the code of the factor. The session it
+// answers with is verified with the second factor.
+func (c *authClient) challengeAndVerify(accessToken, factorId, code string) (*authSession, error) {
+	path := "/factors/" + url.PathEscape(factorId)
+	var challenge struct {
+		Id string `json:"id"`
+	}
+	if err := c.do(http.MethodPost, path+"/challenge", nil, accessToken, nil, &challenge); err != nil {
+		return nil, err
+	}
+	var session authSession
+	body := map[string]string{
+		"challenge_id": challenge.Id,
+		"code":         code,
+	}
+	if err := c.do(http.MethodPost, path+"/verify", nil, accessToken, body, &session); err != nil {
+		return nil, err
+	}
+	if session.AccessToken == "" {
+		return nil, fmt.Errorf("%w: the answer has no access token", errInvalidToken)
+	}
+	if session.ExpiresAt == 0 {
+		session.ExpiresAt = c.now().Unix() + session.ExpiresIn
+	}
+	return &session, nil
+}
+
+// unenroll removes the factor.
+func (c *authClient) unenroll(accessToken, factorId string) error {
+	return c.do(http.MethodDelete, "/factors/"+url.PathEscape(factorId), nil, accessToken, nil, nil)
+}
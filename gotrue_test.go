@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// authRequest is a request the fake GoTrue received.
+type authRequest struct {
+	method string
+	path   string
+	query  string
+	header http.Header
+	body   map[string]interface{}
+}
+
+// newFakeGoTrue serves answer for every request to the auth API and
+// records the requests on the returned channel.
+func newFakeGoTrue(t *testing.T, answer func(r authRequest) (int, string)) (*authClient, <-chan authRequest) {
+	t.Helper()
+	requests := make(chan authRequest, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := authRequest{
+			method: r.Method,
+			path:   strings.TrimPrefix(r.URL.Path, "/auth/v1"),
+			query:  r.URL.RawQuery,
+			header: r.Header,
+		}
+		if data, _ := io.ReadAll(r.Body); len(data) > 0 {
+			if err := json.Unmarshal(data, &req.body); err != nil {
+				t.Errorf("%s %s: %v", r.Method, r.URL.Path, err)
+			}
+		}
+		requests <- req
+		status, body := answer(req)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_, _ = io.WriteString(w, body)
+	}))
+	t.Cleanup(server.Close)
+
+	c := newAuthClient(server.URL, "anon-key")
+	c.now = func() time.Time { return time.Unix(1700000000, 0) }
+	return c, requests
+}
+
+const testSession = `{
+	"access_token": "access",
+	"refresh_token": "refresh",
+	"expires_in": 3600,
+	"user": {"id": "9c6e5a2e-31d4-4c1b-8a4e-6a4a2c1f0b7d", "email": "ada@example.com", "user_metadata": {"user_name": "ada"}}
+}`
+
+func TestSignInWithPassword(t *testing.T) {
+	c, requests := newFakeGoTrue(t, func(authRequest) (int, string) {
+		return http.StatusOK, testSession
+	})
+	session, err := c.signInWithPassword("ada@example.com", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := <-requests
+	if req.method != http.MethodPost || req.path != "/token" || req.query != "grant_type=password" {
+		t.Errorf("request %s %s?%s", req.method, req.path, req.query)
+	}
+	if req.header.Get("apikey") != "anon-key" {
+		t.Errorf("apikey %q", req.header.Get("apikey"))
+	}
+	if req.body["email"] != "ada@example.com" || req.body["password"] != "secret" {
+		t.Errorf("body %v", req.body)
+	}
+	if session.AccessToken != "access" || session.RefreshToken != "refresh" {
+		t.Errorf("session %+v", session)
+	}
+	if session.ExpiresAt != 1700000000+3600 {
+		t.Errorf("expires at %d, want now plus expires_in", session.ExpiresAt)
+	}
+	if session.User == nil || session.User.userName() != "ada" {
+		t.Errorf("user %+v", session.User)
+	}
+}
+
+func TestSignUp(t *testing.T) {
+	confirm := false
+	c, requests := newFakeGoTrue(t, func(authRequest) (int, string) {
+		if confirm {
+			// projects that confirm email addresses answer with the user only
+			return http.StatusOK, `{"id": "9c6e5a2e-31d4-4c1b-8a4e-6a4a2c1f0b7d", "email": "ada@example.com", "user_metadata": {"user_name": "ada"}}`
+		}
+		return http.StatusOK, testSession
+	})
+
+	session, user, err := c.signUp("ada@example.com", "secret", "ada")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := <-requests
+	if req.method != http.MethodPost || req.path != "/signup" {
+		t.Errorf("request %s %s", req.method, req.path)
+	}
+	data, _ := req.body["data"].(map[string]interface{})
+	if data["user_name"] != "ada" {
+		t.Errorf("metadata %v, want the user_name", req.body["data"])
+	}
+	if session == nil || session.AccessToken != "access" || user == nil || user.userName() != "ada" {
+		t.Errorf("session %+v, user %+v", session, user)
+	}
+
+	confirm = true
+	session, user, err = c.signUp("ada@example.com", "secret", "ada")
+	<-requests
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session != nil {
+		t.Errorf("a session before the email address was confirmed")
+	}
+	if user == nil || user.Email != "ada@example.com" {
+		t.Errorf("user %+v", user)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	answer := testSession
+	status := http.StatusOK
+	c, requests := newFakeGoTrue(t, func(authRequest) (int, string) {
+		return status, answer
+	})
+
+	session, err := c.refresh("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := <-requests
+	if req.path != "/token" || req.query != "grant_type=refresh_token" || req.body["refresh_token"] != "old" {
+		t.Errorf("request %s?%s %v", req.path, req.query, req.body)
+	}
+	if session.RefreshToken != "refresh" {
+		t.Errorf("session %+v", session)
+	}
+
+	for _, body := range []string{
+		`{"code": 400, "error_code": "refresh_token_not_found", "msg": "Invalid Refresh Token: Refresh Token Not Found"}`,
+		`{"error": "invalid_grant", "error_description": "Invalid Refresh Token: Already Used"}`,
+	} {
+		status, answer = http.StatusBadRequest, body
+		if _, err := c.refresh("old"); !errors.Is(err, errInvalidRefresh) {
+			t.Errorf("%s: %v, want errInvalidRefresh", body, err)
+		}
+		<-requests
+	}
+}
+
+func TestSignOut(t *testing.T) {
+	status := http.StatusNoContent
+	c, requests := newFakeGoTrue(t, func(authRequest) (int, string) {
+		return status, ""
+	})
+	if err := c.signOut("access"); err != nil {
+		t.Fatal(err)
+	}
+	req := <-requests
+	if req.method != http.MethodPost || req.path != "/logout" || req.header.Get("Authorization") != "Bearer access" {
+		t.Errorf("request %s %s %q", req.method, req.path, req.header.Get("Authorization"))
+	}
+
+	// the session already ended
+	status = http.StatusUnauthorized
+	if err := c.signOut("access"); err != nil {
+		t.Errorf("signing out of an ended session: %v", err)
+	}
+	<-requests
+
+	status = http.StatusInternalServerError
+	if err := c.signOut("access"); err == nil {
+		t.Error("a server error was ignored")
+	}
+	<-requests
+}
+
+func TestRecover(t *testing.T) {
+	c, requests := newFakeGoTrue(t, func(authRequest) (int, string) {
+		return http.StatusOK, "{}"
+	})
+	if err := c.recover("ada@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	req := <-requests
+	if req.method != http.MethodPost || req.path != "/recover" || req.body["email"] != "ada@example.com" {
+		t.Errorf("request %s %s %v", req.method, req.path, req.body)
+	}
+}
+
+func TestAuthErrors(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		code   string
+		want   error
+	}{
+		{400, `{"code": 400, "error_code": "invalid_credentials", "msg": "Invalid login credentials"}`, "invalid_credentials", errInvalidCredentials},
+		{400, `{"error": "invalid_grant", "error_description": "Invalid login credentials"}`, "invalid_credentials", errInvalidCredentials},
+		{400, `{"error": "invalid_grant", "error_description": "Email not confirmed"}`, "email_not_confirmed", errEmailNotConfirmed},
+		{401, `{"code": 401, "msg": "This endpoint requires a Bearer token"}`, "http_401", nil},
+		{401, `{"code": 401, "error_code": "insufficient_aal", "msg": "AAL2 session is required"}`, "insufficient_aal", errMfaRequired},
+		{422, `{"code": 422, "error_code": "user_already_exists", "msg": "User already registered"}`, "user_already_exists", errUserExists},
+		{422, `{"code": 422, "msg": "User already registered"}`, "user_already_exists", errUserExists},
+		{422, `{"code": 422, "msg": "Password should be at least 6 characters"}`, "weak_password", errWeakPassword},
+		{422, `{"code": 422, "error_code": "mfa_verification_failed", "msg": "Invalid TOTP code entered"}`, "mfa_verification_failed", errMfaInvalidCode},
+		{429, `{"msg": "Too many requests"}`, "over_request_rate_limit", errAuthRateLimited},
+	}
+	for _, tc := range tests {
+		c, requests := newFakeGoTrue(t, func(authRequest) (int, string) {
+			return tc.status, tc.body
+		})
+		_, err := c.signInWithPassword("ada@example.com", "secret")
+		<-requests
+		var authErr *AuthError
+		if !errors.As(err, &authErr) {
+			t.Errorf("%d %s: %v is no AuthError", tc.status, tc.body, err)
+			continue
+		}
+		if authErr.Status != tc.status || authErr.Code != tc.code {
+			t.Errorf("%d %s: status %d, code %q, want %q", tc.status, tc.body, authErr.Status, authErr.Code, tc.code)
+		}
+		if !strings.HasPrefix(authErr.Error(), tc.code+": ") {
+			t.Errorf("%d %s: the message %q does not lead with the code", tc.status, tc.body, authErr.Error())
+		}
+		if tc.want != nil && !errors.Is(err, tc.want) {
+			t.Errorf("%d %s: %v does not match %v", tc.status, tc.body, err, tc.want)
+		}
+		if tc.want == nil && errors.Unwrap(err) != nil {
+			t.Errorf("%d %s: unexpectedly matches %v", tc.status, tc.body, errors.Unwrap(err))
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The users and the group most tests are about.
+const (
+	aliceId = "1d4f2a6e-8c3b-4e5f-9a7d-2b6c8e0f1a3d"
+	bobId   = "7e9a1c3f-5b2d-4f6e-8a0c-4d6f8b0e2c1a"
+	carolId = "c4a8e2f6-0b1d-4e3f-a5c7-9d1b3e5f7a2c"
+
+	groupId = "5f6a7b8c-9d0e-4f1a-8b3c-4d5e6f7a8b9c"
+)
+
+// testJwtSecret signs the access tokens of the tests.
+const testJwtSecret = "a test secret that is long enough"
+
+// testUserId is the user the app of newSupabaseApp signs in as.
+const testUserId = "9c6e5a2e-31d4-4c1b-8a4e-6a4a2c1f0b7d"
+
+// supabaseRequest is a request the fake Supabase received.
+type supabaseRequest struct {
+	method string
+	path   string
+	query  string
+	token  string
+	body   json.RawMessage
+}
+
+// fakeSupabase answers the requests of an app the way the test wants,
+// the profile and prekey uploads of every sign in are accepted.
+type fakeSupabase struct {
+	mu       sync.Mutex
+	requests []supabaseRequest
+	answer   func(r supabaseRequest) (int, string)
+}
+
+// newSupabaseApp returns an app that talks to a fake Supabase and keeps
+// its local state in a temporary directory.
+func newSupabaseApp(t *testing.T, answer func(r supabaseRequest) (int, string)) (*App, *fakeSupabase) {
+	t.Helper()
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	fake := &fakeSupabase{answer: answer}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	a := NewApp(Config{
+		SupaBaseUrl:       server.URL,
+		SupaBaseApiKey:    "anon-key",
+		SupaBaseJwtSecret: testJwtSecret,
+		RoomIdKey:         "a room id key for the tests",
+	}, nil)
+	a.events = func(string, interface{}) {}
+	t.Cleanup(func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if a.refresher != nil {
+			a.refresher.Stop()
+		}
+	})
+	return a, fake
+}
+
+func (f *fakeSupabase) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	req := supabaseRequest{
+		method: r.Method,
+		path:   r.URL.Path,
+		query:  r.URL.RawQuery,
+		token:  strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "),
+		body:   body,
+	}
+	f.mu.Lock()
+	f.requests = append(f.requests, req)
+	f.mu.Unlock()
+
+	status, answer := 0, ""
+	switch req.path {
+	case "/rest/v1/" + profilesTable, "/rest/v1/" + oneTimePrekeysTable:
+		status = http.StatusCreated
+	default:
+		status, answer = f.answer(req)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = io.WriteString(w, answer)
+}
+
+// find returns the requests to the path.
+func (f *fakeSupabase) find(method, path string) []supabaseRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var found []supabaseRequest
+	for _, req := range f.requests {
+		if req.method == method && req.path == path {
+			found = append(found, req)
+		}
+	}
+	return found
+}
+
+// sessionJson is a GoTrue session of the test user with a verified TOTP
+// factor, if factorId is set.
+func sessionJson(t *testing.T, aal, factorId string) string {
+	t.Helper()
+	factors := "[]"
+	if factorId != "" {
+		factors = fmt.Sprintf(`[{"id": %q, "factor_type": "totp", "status": "verified"}]`, factorId)
+	}
+	return fmt.Sprintf(`{
+		"access_token": %q,
+		"refresh_token": "refresh-%s",
+		"expires_in": 3600,
+		"user": {"id": %q, "email": "ada@example.com", "user_metadata": {"user_name": "ada"}, "factors": %s}
+	}`, testToken(t, testUserId, aal), aal, testUserId, factors)
+}
+
+// signToken builds a token with the header and claims, signed by sign.
+func signToken(t *testing.T, header, claims map[string]interface{}, sign func(signed []byte) []byte) string {
+	t.Helper()
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(header) + "." + encode(claims)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+// hs256 signs the way a project with a legacy JWT secret does.
+func hs256(secret string) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(signed)
+		return mac.Sum(nil)
+	}
+}
+
+// testToken is an access token of the user signed with testJwtSecret.
+func testToken(t *testing.T, userId, aal string) string {
+	t.Helper()
+	return signToken(t, map[string]interface{}{"alg": "HS256", "typ": "JWT"}, map[string]interface{}{
+		"sub": userId,
+		"aud": "authenticated",
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"aal": aal,
+	}, hs256(testJwtSecret))
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultTokenAudience is the audience Supabase issues the access
+	// tokens of signed in users for.
+	defaultTokenAudience = "authenticated"
+	// tokenLeeway tolerates clocks that are slightly off.
+	tokenLeeway = 30 * time.Second
+	// jwksMaxAge is how long the signing keys are cached, jwksMinInterval
+	// how often an unknown key id may trigger fetching them again.
+	jwksMaxAge      = 10 * time.Minute
+	jwksMinInterval = 30 * time.Second
+)
+
+var (
+	errInvalidToken      = errors.New("invalid access token")
+	errTokenExpired      = errors.New("the access token expired, sign in again")
+	errTokenAudience     = errors.New("the access token is meant for another audience")
+	errUnsupportedAlg    = errors.New("unsupported token algorithm")
+	errNoJwtSecret       = errors.New("HS256 tokens need SUPABASE_JWT_SECRET")
+	errUnknownSigningKey = errors.New("unknown token signing key")
+)
+
+// tokenClaims are the claims of a Supabase access token the app uses.
+type tokenClaims struct {
+	Subject   string        `json:"sub"`
+	Audience  tokenAudience `json:"aud"`
+	ExpiresAt int64         `json:"exp"`
+	NotBefore int64         `json:"nbf"`
+	Role      string        `json:"role"`
+	Email     string        `json:"email"`
+}
+
+// expires is when the token stops being valid.
+func (c tokenClaims) expires() time.Time {
+	return time.Unix(c.ExpiresAt, 0)
+}
+
+// tokenAudience is the aud claim, which may be a string or a list.
+type tokenAudience []string
+
+func (a *tokenAudience) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		var list []string
+		if err := json.Unmarshal(data, &list); err != nil {
+			return err
+		}
+		*a = list
+		return nil
+	}
+	var single string
+	if err := json.Unmarshal(data, &single); err != nil {
+		return err
+	}
+	*a = tokenAudience{single}
+	return nil
+}
+
+func (a tokenAudience) contains(audience string) bool {
+	for _, aud := range a {
+		if aud == audience {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenVerifier verifies Supabase access tokens. Projects with the
+// legacy JWT secret sign with HS256, projects with asymmetric signing
+// keys with RS256 or ES256 and publish the keys as a JWKS.
+type tokenVerifier struct {
+	secret   []byte
+	audience string
+	jwksUrl  string
+	apiKey   string
+	http     *http.Client
+	now      func() time.Time
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+func newTokenVerifier(c Config) *tokenVerifier {
+	audience := c.SupaBaseJwtAudience
+	if audience == "" {
+		audience = defaultTokenAudience
+	}
+	return &tokenVerifier{
+		secret:   []byte(c.SupaBaseJwtSecret),
+		audience: audience,
+		jwksUrl:  strings.TrimRight(c.SupaBaseUrl, "/") + "/auth/v1/.well-known/jwks.json",
+		apiKey:   c.SupaBaseApiKey,
+		http:     &http.Client{Timeout: 15 * time.Second},
+		now:      time.Now,
+	}
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// verify checks the signature, the expiry and the audience of the token
+// and returns its claims, with the subject in its canonical form.
+func (v *tokenVerifier) verify(token string) (tokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return tokenClaims{}, errInvalidToken
+	}
+	var header tokenHeader
+	if err := decodeTokenPart(parts[0], &header); err != nil {
+		return tokenClaims{}, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return tokenClaims{}, fmt.Errorf("%w: %v", errInvalidToken, err)
+	}
+	if err := v.verifySignature(header, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return tokenClaims{}, err
+	}
+
+	var claims tokenClaims
+	if err := decodeTokenPart(parts[1], &claims); err != nil {
+		return tokenClaims{}, err
+	}
+	now := v.now()
+	if claims.ExpiresAt == 0 || now.After(claims.expires().Add(tokenLeeway)) {
+		return tokenClaims{}, errTokenExpired
+	}
+	if claims.NotBefore != 0 && now.Add(tokenLeeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return tokenClaims{}, fmt.Errorf("%w: not valid yet", errInvalidToken)
+	}
+	if !claims.Audience.contains(v.audience) {
+		return tokenClaims{}, errTokenAudience
+	}
+	subject, err := normalizeUserId(claims.Subject)
+	if err != nil {
+		return tokenClaims{}, fmt.Errorf("%w: %v", errInvalidToken, err)
+	}
+	claims.Subject = subject
+	return claims, nil
+}
+
+func decodeTokenPart(part string, out interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidToken, err)
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidToken, err)
+	}
+	return nil
+}
+
+func (v *tokenVerifier) verifySignature(header tokenHeader, signed, signature []byte) error {
+	digest := sha256.Sum256(signed)
+	switch header.Alg {
+	case "HS256":
+		if len(v.secret) == 0 {
+			return errNoJwtSecret
+		}
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return fmt.Errorf("%w: bad signature", errInvalidToken)
+		}
+		return nil
+	case "RS256":
+		key, err := v.signingKey(header.Kid)
+		if err != nil {
+			return err
+		}
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%w: key %q is not an RSA key", errInvalidToken, header.Kid)
+		}
+		if err := rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature); err != nil {
+			return fmt.Errorf("%w: bad signature", errInvalidToken)
+		}
+		return nil
+	case "ES256":
+		key, err := v.signingKey(header.Kid)
+		if err != nil {
+			return err
+		}
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return fmt.Errorf("%w: key %q is not a P-256 key", errInvalidToken, header.Kid)
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(ecKey, digest[:], r, s) {
+			return fmt.Errorf("%w: bad signature", errInvalidToken)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: %q", errUnsupportedAlg, header.Alg)
+}
+
+// signingKey returns the published key with the id, fetching the keys
+// again when they are old or the id is new, keys rotate after all.
+func (v *tokenVerifier) signingKey(kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	key, ok := v.keys[kid]
+	age := v.now().Sub(v.fetched)
+	if ok && age < jwksMaxAge {
+		return key, nil
+	}
+	if v.keys != nil && !ok && age < jwksMinInterval {
+		return nil, fmt.Errorf("%w: %q", errUnknownSigningKey, kid)
+	}
+
+	keys, err := v.fetchKeys()
+	if err != nil {
+		if ok {
+			// keep using the cached key while the endpoint is down
+			return key, nil
+		}
+		return nil, err
+	}
+	v.keys = keys
+	v.fetched = v.now()
+	if key, ok = keys[kid]; !ok {
+		return nil, fmt.Errorf("%w: %q", errUnknownSigningKey, kid)
+	}
+	return key, nil
+}
+
+// jsonWebKey is a public key of a JWKS, only the fields of
+// RSA and P-256 keys are read.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetchKeys downloads the JWKS of the project, keys it cannot use are skipped.
+func (v *tokenVerifier) fetchKeys() (map[string]crypto.PublicKey, error) {
+	req, err := http.NewRequest(http.MethodGet, v.jwksUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("apikey", v.apiKey)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := v.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("supabase jwks: %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if key, err := jwk.publicKey(); err == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("RSA exponent out of range")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
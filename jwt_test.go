@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestVerifyHs256Token(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	v := newTokenVerifier(Config{SupaBaseJwtSecret: testJwtSecret})
+	v.now = func() time.Time { return now }
+	header := map[string]interface{}{"alg": "HS256", "typ": "JWT"}
+	claims := func(change func(c map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{"sub": strings.ToUpper(aliceId), "aud": "authenticated", "exp": now.Add(time.Hour).Unix()}
+		change(c)
+		return c
+	}
+
+	for _, token := range []string{
+		signToken(t, header, claims(func(map[string]interface{}) {}), hs256(testJwtSecret)),
+		signToken(t, header, claims(func(c map[string]interface{}) { c["aud"] = []string{"other", "authenticated"} }), hs256(testJwtSecret)),
+		signToken(t, header, claims(func(c map[string]interface{}) { c["exp"] = now.Add(-tokenLeeway / 2).Unix() }), hs256(testJwtSecret)),
+	} {
+		got, err := v.verify(token)
+		if err != nil {
+			t.Errorf("%s: %v", token, err)
+		} else if got.Subject != aliceId {
+			t.Errorf("subject %s, want %s", got.Subject, aliceId)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"expired", signToken(t, header, claims(func(c map[string]interface{}) { c["exp"] = now.Add(-time.Minute).Unix() }), hs256(testJwtSecret)), errTokenExpired},
+		{"without expiry", signToken(t, header, claims(func(c map[string]interface{}) { delete(c, "exp") }), hs256(testJwtSecret)), errTokenExpired},
+		{"not valid yet", signToken(t, header, claims(func(c map[string]interface{}) { c["nbf"] = now.Add(time.Minute).Unix() }), hs256(testJwtSecret)), errInvalidToken},
+		{"another audience", signToken(t, header, claims(func(c map[string]interface{}) { c["aud"] = "anon" }), hs256(testJwtSecret)), errTokenAudience},
+		{"subject is no user id", signToken(t, header, claims(func(c map[string]interface{}) { c["sub"] = "alice" }), hs256(testJwtSecret)), errInvalidToken},
+		{"another secret", signToken(t, header, claims(func(map[string]interface{}) {}), hs256("another secret")), errInvalidToken},
+		{"unsigned", signToken(t, map[string]interface{}{"alg": "none"}, claims(func(map[string]interface{}) {}), func([]byte) []byte { return nil }), errUnsupportedAlg},
+		{"two parts", "e30.e30", errInvalidToken},
+		{"not base64", "e30.e30.!", errInvalidToken},
+	}
+	for _, tc := range tests {
+		if _, err := v.verify(tc.token); !errors.Is(err, tc.want) {
+			t.Errorf("%s: %v, want %v", tc.name, err, tc.want)
+		}
+	}
+
+	v.secret = nil
+	if _, err := v.verify(tests[0].token); !errors.Is(err, errNoJwtSecret) {
+		t.Errorf("without a secret: %v", err)
+	}
+}
+
+func TestVerifyJwksToken(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	keys := []jsonWebKey{
+		{Kty: "EC", Kid: "ec", Crv: "P-256", X: b64(ecKey.X.FillBytes(make([]byte, 32))), Y: b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+		{Kty: "RSA", Kid: "rsa", N: b64(rsaKey.N.Bytes()), E: b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{Kty: "oct", Kid: "symmetric"},
+	}
+	var fetches int32
+	var down int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		if r.URL.Path != "/auth/v1/.well-known/jwks.json" || r.Header.Get("apikey") != "anon-key" {
+			t.Errorf("fetched %s with api key %q", r.URL.Path, r.Header.Get("apikey"))
+		}
+		if atomic.LoadInt32(&down) != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	defer server.Close()
+
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	v := newTokenVerifier(Config{SupaBaseUrl: server.URL + "/", SupaBaseApiKey: "anon-key"})
+	v.now = func() time.Time { return now }
+	claims := map[string]interface{}{"sub": aliceId, "aud": "authenticated", "exp": now.Add(time.Hour).Unix()}
+	es256 := func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	rs256 := func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		signature, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signature
+	}
+	token := func(alg, kid string, sign func([]byte) []byte) string {
+		return signToken(t, map[string]interface{}{"alg": alg, "kid": kid}, claims, sign)
+	}
+
+	for _, tok := range []string{token("ES256", "ec", es256), token("RS256", "rsa", rs256)} {
+		if _, err := v.verify(tok); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Fatalf("%d fetches of the keys, want 1", n)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"signed by another key", token("ES256", "rsa", es256), errInvalidToken},
+		{"algorithm of another key", token("RS256", "ec", rs256), errInvalidToken},
+		{"tampered signature", token("ES256", "ec", func(signed []byte) []byte { return es256(append(signed, '.')) }), errInvalidToken},
+		{"unknown key", token("ES256", "rotated", es256), errUnknownSigningKey},
+		{"unusable key", token("ES256", "symmetric", es256), errUnknownSigningKey},
+	}
+	for _, tc := range tests {
+		if _, err := v.verify(tc.token); !errors.Is(err, tc.want) {
+			t.Errorf("%s: %v, want %v", tc.name, err, tc.want)
+		}
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("unknown keys fetched the keys %d more times right away", n-1)
+	}
+
+	// an unknown key fetches the keys again, but not too often
+	now = now.Add(jwksMinInterval)
+	if _, err := v.verify(token("ES256", "rotated", es256)); !errors.Is(err, errUnknownSigningKey) {
+		t.Errorf("unknown key: %v", err)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Errorf("%d fetches of the keys, want 2", n)
+	}
+
+	// old keys are fetched again, and used while the endpoint is down
+	atomic.StoreInt32(&down, 1)
+	now = now.Add(jwksMaxAge)
+	if _, err := v.verify(token("ES256", "ec", es256)); err != nil {
+		t.Errorf("while the keys cannot be fetched: %v", err)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 3 {
+		t.Errorf("%d fetches of the keys, want 3", n)
+	}
+}
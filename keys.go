@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// profilesTable is the Supabase table the public keys of users are kept in.
+const profilesTable = "profiles"
+
+var errNoPublicKey = errors.New("the user has not published a public key yet")
+
+// identity holds the private keys of the signed in user: an X25519 key
+// to agree on encryption keys and an Ed25519 key to sign messages.
+type identity struct {
+	exchange *ecdh.PrivateKey
+	signing  ed25519.PrivateKey
+}
+
+// identityFile is how the identity of a user is stored on disk.
+type identityFile struct {
+	X25519  string `json:"x25519"`
+	Ed25519 string `json:"ed25519"`
+}
+
+// profileKeys is the part of a Supabase profile that holds public keys.
+type profileKeys struct {
+	Id               string `json:"id"`
+	X25519PublicKey  string `json:"x25519_public_key"`
+	Ed25519PublicKey string `json:"ed25519_public_key"`
+}
+
+// contactKeys are the decoded public keys of another user.
+type contactKeys struct {
+	exchange *ecdh.PublicKey
+	signing  ed25519.PublicKey
+}
+
+// cachedContactKeys are the keys of a contact along with the time they
+// were fetched.
+type cachedContactKeys struct {
+	keys    contactKeys
+	fetched time.Time
+}
+
+// loadOrCreateIdentity returns the identity of the user, generating
+// and storing the keys that do not exist yet.
+func loadOrCreateIdentity(userId string) (*identity, error) {
+	dir, err := configDir()
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "identity-"+userId+".json")
+
+	var file identityFile
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	var id identity
+	changed := false
+	if file.X25519 == "" {
+		id.exchange, err = ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		file.X25519 = base64.StdEncoding.EncodeToString(id.exchange.Bytes())
+		changed = true
+	} else {
+		raw, err := base64.StdEncoding.DecodeString(file.X25519)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+		if id.exchange, err = ecdh.X25519().NewPrivateKey(raw); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+	}
+	if file.Ed25519 == "" {
+		_, id.signing, err = ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		file.Ed25519 = base64.StdEncoding.EncodeToString(id.signing.Seed())
+		changed = true
+	} else {
+		seed, err := base64.StdEncoding.DecodeString(file.Ed25519)
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("reading %s: invalid signing key", path)
+		}
+		id.signing = ed25519.NewKeyFromSeed(seed)
+	}
+
+	if changed {
+		data, err := json.Marshal(file)
+		if err != nil {
+			return nil, err
+		}
+		if err := writePrivateFile(path, data); err != nil {
+			return nil, err
+		}
+	}
+	return &id, nil
+}
+
+// publicKeys encodes the public half of the identity for the profile.
+func (id *identity) publicKeys(userId string) profileKeys {
+	return profileKeys{
+		Id:               userId,
+		X25519PublicKey:  base64.StdEncoding.EncodeToString(id.exchange.PublicKey().Bytes()),
+		Ed25519PublicKey: base64.StdEncoding.EncodeToString(id.signing.Public().(ed25519.PublicKey)),
+	}
+}
+
+// decode parses the public keys of a profile.
+func (p profileKeys) decode() (contactKeys, error) {
+	if p.X25519PublicKey == "" || p.Ed25519PublicKey == "" {
+		return contactKeys{}, errNoPublicKey
+	}
+	raw, err := base64.StdEncoding.DecodeString(p.X25519PublicKey)
+	if err != nil {
+		return contactKeys{}, fmt.Errorf("public key of %s: %w", p.Id, err)
+	}
+	exchange, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return contactKeys{}, fmt.Errorf("public key of %s: %w", p.Id, err)
+	}
+	signing, err := base64.StdEncoding.DecodeString(p.Ed25519PublicKey)
+	if err != nil || len(signing) != ed25519.PublicKeySize {
+		return contactKeys{}, fmt.Errorf("signing key of %s is invalid", p.Id)
+	}
+	return contactKeys{exchange: exchange, signing: ed25519.PublicKey(signing)}, nil
+}
+
+// profile encodes the keys the way they are stored in a profile.
+func (k contactKeys) profile(userId string) profileKeys {
+	return profileKeys{
+		Id:               userId,
+		X25519PublicKey:  base64.StdEncoding.EncodeToString(k.exchange.Bytes()),
+		Ed25519PublicKey: base64.StdEncoding.EncodeToString(k.signing),
+	}
+}
+
+// publishPublicKeys stores the public keys in the profile of the user.
+func (s *supabaseClient) publishPublicKeys(keys profileKeys) error {
+	return s.rest(
+		"POST",
+		profilesTable,
+		url.Values{"on_conflict": {"id"}},
+		keys,
+		nil,
+		map[string]string{"Prefer": "resolution=merge-duplicates,return=minimal"},
+	)
+}
+
+// fetchPublicKeys reads the public keys from the profile of a user.
+func (s *supabaseClient) fetchPublicKeys(userId string) (profileKeys, error) {
+	return s.fetchPublicKeysAs(s.token(), userId)
+}
+
+// fetchPublicKeysAs is fetchPublicKeys with the access token of another
+// session, the gateway reads the keys on behalf of its clients.
+func (s *supabaseClient) fetchPublicKeysAs(token, userId string) (profileKeys, error) {
+	var profiles []profileKeys
+	err := s.restAs(
+		token,
+		"GET",
+		profilesTable,
+		url.Values{
+			"id":     {"eq." + userId},
+			"select": {"id,x25519_public_key,ed25519_public_key"},
+		},
+		nil,
+		&profiles,
+		nil,
+	)
+	if err != nil {
+		return profileKeys{}, err
+	}
+	if len(profiles) == 0 {
+		return profileKeys{}, errNoPublicKey
+	}
+	return profiles[0], nil
+}
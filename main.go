@@ -2,6 +2,7 @@ package main
 
 import (
 	"embed"
+	"os"
 
 	"github.com/wailsapp/wails/v2"
 	"github.com/wailsapp/wails/v2/pkg/options"
@@ -12,8 +13,19 @@ import (
 var assets embed.FS
 
 func main() {
+	config, problems := loadConfig(os.Args[1:], os.LookupEnv)
+
+	// With a gateway address the process serves web clients instead
+	if config.GatewayAddr != "" {
+		if err := runGateway(config, problems); err != nil {
+			println("Error:", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Create an instance of the app structure
-	app := NewApp()
+	app := NewApp(config, problems)
 
 	// Create application with options
 	err := wails.Run(&options.App{
@@ -25,6 +37,7 @@ func main() {
 		},
 		BackgroundColour: &options.RGBA{R: 27, G: 44, B: 77, A: 1},
 		OnStartup:        app.startup,
+		OnShutdown:       app.shutdown,
 		Bind: []interface{}{
 			app,
 		},
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// memoryBroker is an in-process stand-in for RabbitMQ. It keeps an inbox
+// per user and routes the messages of a room to every inbox bound to it,
+// just like the topic exchange does. Nothing leaves the process, so the
+// app and its tests can run without a broker; several transports of the
+// same broker talk to each other.
+type memoryBroker struct {
+	mu      sync.Mutex
+	inboxes map[string]*memoryInbox
+	rooms   map[string]map[string]bool
+}
+
+type memoryInbox struct {
+	messages []Message
+	// signal has room for one wake up, which is enough because the
+	// subscriber drains the inbox every time it wakes up
+	signal chan struct{}
+}
+
+func newMemoryBroker() *memoryBroker {
+	return &memoryBroker{
+		inboxes: make(map[string]*memoryInbox),
+		rooms:   make(map[string]map[string]bool),
+	}
+}
+
+// transport returns a new client of the broker.
+func (b *memoryBroker) transport() *memoryTransport {
+	return &memoryTransport{broker: b}
+}
+
+// inbox returns the inbox, creating it if needed.
+// The caller must hold the lock.
+func (b *memoryBroker) inbox(name string) *memoryInbox {
+	inbox, ok := b.inboxes[name]
+	if !ok {
+		inbox = &memoryInbox{signal: make(chan struct{}, 1)}
+		b.inboxes[name] = inbox
+	}
+	return inbox
+}
+
+// bind routes the room to the inbox. The caller must hold the lock.
+func (b *memoryBroker) bind(name, roomId string) {
+	b.inbox(name)
+	if b.rooms[roomId] == nil {
+		b.rooms[roomId] = make(map[string]bool)
+	}
+	b.rooms[roomId][name] = true
+}
+
+func (b *memoryBroker) unbind(name, roomId string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.rooms[roomId], name)
+}
+
+// publish puts the message into every inbox bound to its room, after
+// encoding and decoding it like it would travel over the wire.
+func (b *memoryBroker) publish(msg Message, members []string) error {
+	publishing, err := msg.publishing()
+	if err != nil {
+		return err
+	}
+	msg, err = decodeMessage(publishing.Body)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, userId := range members {
+		b.bind(userQueueName(userId), msg.ChatRoomId)
+	}
+	for name := range b.rooms[msg.ChatRoomId] {
+		inbox := b.inbox(name)
+		inbox.messages = append(inbox.messages, msg)
+		select {
+		case inbox.signal <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// pop takes the oldest message out of the inbox.
+func (b *memoryBroker) pop(name string) (Message, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	inbox := b.inbox(name)
+	if len(inbox.messages) == 0 {
+		return Message{}, false
+	}
+	msg := inbox.messages[0]
+	inbox.messages = inbox.messages[1:]
+	return msg, true
+}
+
+// remove deletes a temporary inbox together with its bindings.
+func (b *memoryBroker) remove(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.inboxes, name)
+	for _, inboxes := range b.rooms {
+		delete(inboxes, name)
+	}
+}
+
+// memoryTransport is the Transport on top of a memoryBroker.
+type memoryTransport struct {
+	broker *memoryBroker
+
+	mu        sync.Mutex
+	connected bool
+	inbox     string
+	listeners []func(BrokerStatus)
+}
+
+func (t *memoryTransport) Connect() {
+	t.mu.Lock()
+	t.connected = true
+	listeners := append([]func(BrokerStatus){}, t.listeners...)
+	t.mu.Unlock()
+
+	status := t.Status()
+	for _, listener := range listeners {
+		listener(status)
+	}
+}
+
+func (t *memoryTransport) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.connected = false
+}
+
+func (t *memoryTransport) Status() BrokerStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.connected {
+		return BrokerStatus{}
+	}
+	return BrokerStatus{Connected: true, Broker: transportMemory}
+}
+
+func (t *memoryTransport) OnStatus(f func(BrokerStatus)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.listeners = append(t.listeners, f)
+}
+
+// Publish hands the message to the broker, which takes it over at once.
+func (t *memoryTransport) Publish(msg Message, members []string) (<-chan error, error) {
+	if !t.Status().Connected {
+		return nil, errNotConnected
+	}
+	if err := t.broker.publish(msg, members); err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	done <- nil
+	return done, nil
+}
+
+func (t *memoryTransport) Subscribe(userId string, rooms func() []string, handle func(Message)) func() {
+	name := userQueueName(userId)
+	temporary := userId == ""
+	if temporary {
+		name = "temporary." + uuid.NewString()
+	}
+
+	t.broker.mu.Lock()
+	inbox := t.broker.inbox(name)
+	for _, roomId := range rooms() {
+		t.broker.bind(name, roomId)
+	}
+	t.broker.mu.Unlock()
+
+	t.mu.Lock()
+	t.inbox = name
+	t.mu.Unlock()
+
+	stop := make(chan struct{})
+	go func() {
+		for {
+			for {
+				msg, ok := t.broker.pop(name)
+				if !ok {
+					break
+				}
+				handle(msg)
+			}
+			select {
+			case <-stop:
+				return
+			case <-inbox.signal:
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			t.mu.Lock()
+			if t.inbox == name {
+				t.inbox = ""
+			}
+			t.mu.Unlock()
+			if temporary {
+				t.broker.remove(name)
+			}
+		})
+	}
+}
+
+// Join binds the inbox of the running subscription to the room.
+func (t *memoryTransport) Join(roomId string) error {
+	t.mu.Lock()
+	name := t.inbox
+	t.mu.Unlock()
+	if name == "" {
+		return nil
+	}
+	t.broker.mu.Lock()
+	defer t.broker.mu.Unlock()
+	t.broker.bind(name, roomId)
+	return nil
+}
+
+func (t *memoryTransport) Leave(userId, roomId string) error {
+	name := userQueueName(userId)
+	if userId == "" {
+		t.mu.Lock()
+		name = t.inbox
+		t.mu.Unlock()
+	}
+	t.broker.unbind(name, roomId)
+	return nil
+}
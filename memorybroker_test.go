@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// newMemoryApp returns an app that uses a transport of the broker and
+// records the events it emits.
+func newMemoryApp(broker *memoryBroker) (*App, <-chan Message, <-chan DeliveryStatus) {
+	received := make(chan Message, 16)
+	statuses := make(chan DeliveryStatus, 16)
+	a := NewApp(Config{Transport: transportMemory}, nil)
+	a.events = func(eventName string, data interface{}) {
+		switch eventName {
+		case messageReceivedEvent:
+			received <- data.(Message)
+		case messageStatusEvent:
+			statuses <- data.(DeliveryStatus)
+		}
+	}
+	a.transport = broker.transport()
+	a.transport.Connect()
+	return a, received, statuses
+}
+
+func TestSendOverMemoryBroker(t *testing.T) {
+	broker := newMemoryBroker()
+	alice, _, statuses := newMemoryApp(broker)
+	bob, received, _ := newMemoryApp(broker)
+	bob.user.queueName = publicChatRoomId
+	bob.startConsuming()
+	defer bob.stopConsuming()
+
+	id, err := alice.Send("hello", publicChatRoomId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	select {
+	case msg := <-received:
+		if msg.Id != id || msg.Message != "hello" || msg.ChatRoomId != publicChatRoomId {
+			t.Fatalf("received %+v, want the sent message %s", msg, id)
+		}
+	case <-timeout:
+		t.Fatal("the message did not arrive")
+	}
+	for {
+		select {
+		case status := <-statuses:
+			if status.MessageId != id {
+				t.Fatalf("status of unknown message %s", status.MessageId)
+			}
+			switch status.State {
+			case DeliveryConfirmed:
+				return
+			case DeliveryFailed:
+				t.Fatalf("delivery failed: %s", status.Error)
+			}
+		case <-timeout:
+			t.Fatal("the delivery was not confirmed")
+		}
+	}
+}
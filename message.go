@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// messageVersion is the envelope version written by this client.
+	messageVersion = 1
+	// messageType is used as the AMQP type property of chat messages.
+	messageType = "chat.message"
+	// messageContentType is the content type of the envelope itself.
+	messageContentType = "application/json"
+	// textContentType is the content type of plain text message bodies.
+	textContentType = "text/plain"
+)
+
+var (
+	errMalformedMessage = errors.New("malformed message")
+	errUnknownVersion   = errors.New("unknown message version")
+)
+
+// Message is the versioned JSON envelope every chat message is sent in.
+type Message struct {
+	Version     int    `json:"version"`
+	Id          string `json:"id"`
+	ChatRoomId  string `json:"chatRoomId"`
+	Sender      string `json:"sender"`
+	Time        string `json:"time"`
+	ContentType string `json:"contentType"`
+	Message     string `json:"message"`
+	Signature   string `json:"signature,omitempty"`
+	// Encrypted, Verified and Warning are set on received messages,
+	// they are never trusted from the wire.
+	Encrypted bool   `json:"encrypted,omitempty"`
+	Verified  bool   `json:"verified,omitempty"`
+	Warning   string `json:"warning,omitempty"`
+}
+
+// newMessage wraps a plain text message in an envelope
+// with a fresh id and the current time.
+func newMessage(chatRoomId, sender, message string) Message {
+	return Message{
+		Version:     messageVersion,
+		Id:          uuid.NewString(),
+		ChatRoomId:  chatRoomId,
+		Sender:      sender,
+		Time:        time.Now().UTC().Format(time.RFC3339),
+		ContentType: textContentType,
+		Message:     message,
+	}
+}
+
+// publishing encodes the message as an AMQP publishing
+// with the MessageId, Timestamp and Type properties set.
+func (m Message) publishing() (amqp.Publishing, error) {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return amqp.Publishing{}, err
+	}
+	timestamp, err := time.Parse(time.RFC3339, m.Time)
+	if err != nil {
+		return amqp.Publishing{}, err
+	}
+	return amqp.Publishing{
+		ContentType:  messageContentType,
+		DeliveryMode: amqp.Persistent,
+		MessageId:    m.Id,
+		Timestamp:    timestamp,
+		Type:         messageType,
+		Body:         body,
+	}, nil
+}
+
+// decodeMessage parses an envelope and rejects malformed
+// payloads as well as versions this client does not understand.
+func decodeMessage(body []byte) (Message, error) {
+	var m Message
+	if err := json.Unmarshal(body, &m); err != nil {
+		return Message{}, fmt.Errorf("%w: %v", errMalformedMessage, err)
+	}
+	if m.Version != messageVersion {
+		return Message{}, fmt.Errorf("%w: %d", errUnknownVersion, m.Version)
+	}
+	if m.Id == "" || m.ChatRoomId == "" || m.ContentType == "" {
+		return Message{}, fmt.Errorf("%w: missing required field", errMalformedMessage)
+	}
+	if _, err := time.Parse(time.RFC3339, m.Time); err != nil {
+		return Message{}, fmt.Errorf("%w: %v", errMalformedMessage, err)
+	}
+	if err := validateRoomId(m.ChatRoomId); err != nil {
+		return Message{}, fmt.Errorf("%w: %v", errMalformedMessage, err)
+	}
+	return m, nil
+}
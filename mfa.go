@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// recoveryCodesTable holds the hashes of the recovery codes of all
+	// users. Users only see their own, and only with a session verified
+	// with the second factor.
+	recoveryCodesTable = "mfa_recovery_codes"
+	// redeemRecoveryCodeRpc is a database function that, if the calling
+	// user has a recovery code with the hash, deletes the recovery codes
+	// along with all factors of the user, and answers whether the code
+	// existed. It runs with the rights of its owner, a session without the
+	// second factor cannot remove a verified factor otherwise.
+	redeemRecoveryCodeRpc = "rpc/redeem_mfa_recovery_code"
+	// recoveryCodeCount is how many recovery codes a user gets.
+	recoveryCodeCount = 10
+)
+
+var (
+	errNoPendingSignIn     = errors.New("no sign in waits for a verification code")
+	errNoEnrollment        = errors.New("no factor is being enrolled")
+	errInvalidRecoveryCode = errors.New("invalid recovery code")
+)
+
+// MfaFactor is a second factor of the signed in user.
+type MfaFactor struct {
+	Id           string `json:"id"`
+	FriendlyName string `json:"friendlyName"`
+	Type         string `json:"type"`
+	Verified     bool   `json:"verified"`
+}
+
+// TotpEnrollment is a TOTP factor being enrolled. The user adds it to an
+// authenticator app by scanning QrCode, a PNG data URL, or typing Secret.
+type TotpEnrollment struct {
+	FactorId string `json:"factorId"`
+	Secret   string `json:"secret"`
+	Uri      string `json:"uri"`
+	QrCode   string `json:"qrCode"`
+}
+
+// pendingMfa is a sign in that waits for the code of the second factor.
+type pendingMfa struct {
+	session  *authSession
+	factorId string
+}
+
+// pendingEnrollment is a TOTP factor waiting for its first code.
+type pendingEnrollment struct {
+	factorId string
+	secret   string
+}
+
+// recoveryCodeRow is a row of the recoveryCodesTable.
+type recoveryCodeRow struct {
+	UserId   string `json:"user_id"`
+	CodeHash string `json:"code_hash"`
+}
+
+// replaceRecoveryCodes replaces the recovery codes of the user.
+func (s *supabaseClient) replaceRecoveryCodes(userId string, hashes []string) error {
+	err := s.rest("DELETE", recoveryCodesTable, url.Values{"user_id": {"eq." + userId}}, nil, nil, nil)
+	if err != nil || len(hashes) == 0 {
+		return err
+	}
+	rows := make([]recoveryCodeRow, len(hashes))
+	for i, hash := range hashes {
+		rows[i] = recoveryCodeRow{UserId: userId, CodeHash: hash}
+	}
+	return s.rest("POST", recoveryCodesTable, nil, rows, nil, map[string]string{"Prefer": "return=minimal"})
+}
+
+// redeemRecoveryCode uses up the recovery code with the hash on behalf
+// of the session that is waiting for the second factor.
+func (s *supabaseClient) redeemRecoveryCode(accessToken, hash string) (bool, error) {
+	var redeemed bool
+	err := s.restAs(accessToken, "POST", redeemRecoveryCodeRpc, nil, map[string]string{"code_hash": hash}, &redeemed, nil)
+	return redeemed, err
+}
+
+// newRecoveryCode returns a random recovery code, like ABCD-EFGH-IJKL-MNOP.
+func newRecoveryCode() (string, error) {
+	buf := make([]byte, 10)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	code := base32.StdEncoding.EncodeToString(buf)
+	return code[0:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:16], nil
+}
+
+// hashRecoveryCode hashes the code the way it is stored, ignoring case,
+// spaces and dashes. The codes are random enough for a plain hash.
+func hashRecoveryCode(code string) string {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// EnrollTotp starts adding an authenticator app as second factor,
+// ConfirmTotp finishes it with the first code the app shows
+func (a *App) EnrollTotp(friendlyName string) (TotpEnrollment, error) {
+	a.mu.Lock()
+	session := a.session
+	a.mu.Unlock()
+	if session == nil {
+		return TotpEnrollment{}, errNotSignedIn
+	}
+	enrollment, err := a.auth.enrollTotp(session.AccessToken, strings.TrimSpace(friendlyName), totpIssuer)
+	if err != nil {
+		return TotpEnrollment{}, err
+	}
+	account := a.getSenderId()
+	if session.User != nil && session.User.Email != "" {
+		account = session.User.Email
+	}
+	uri := totpUri(totpIssuer, account, enrollment.Totp.Secret)
+	qr, err := qrDataUrl(uri)
+	if err != nil {
+		return TotpEnrollment{}, err
+	}
+	a.mu.Lock()
+	a.enrollment = &pendingEnrollment{factorId: enrollment.Id, secret: enrollment.Totp.Secret}
+	a.mu.Unlock()
+	return TotpEnrollment{
+		FactorId: enrollment.Id,
+		Secret:   enrollment.Totp.Secret,
+		Uri:      uri,
+		QrCode:   qr,
+	}, nil
+}
+
+// ConfirmTotp verifies the first code of the factor being enrolled and
+// returns the recovery codes, which are shown only this once
+func (a *App) ConfirmTotp(code string) ([]string, error) {
+	a.mu.Lock()
+	session := a.session
+	enrollment := a.enrollment
+	a.mu.Unlock()
+	if session == nil {
+		return nil, errNotSignedIn
+	}
+	if enrollment == nil {
+		return nil, errNoEnrollment
+	}
+	secret, err := newTotp(enrollment.secret, time.Now)
+	if err != nil {
+		return nil, err
+	}
+	// checked here first, so a typo does not cost a challenge
+	code = strings.TrimSpace(code)
+	if !secret.verify(code) {
+		return nil, errMfaInvalidCode
+	}
+	verified, err := a.auth.challengeAndVerify(session.AccessToken, enrollment.factorId, code)
+	if err != nil {
+		return nil, err
+	}
+	if verified.User == nil {
+		verified.User = session.User
+	}
+	if err := a.setSession(verified); err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	if a.enrollment == enrollment {
+		a.enrollment = nil
+	}
+	a.mu.Unlock()
+	return a.RegenerateRecoveryCodes()
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes, the old ones
+// stop working
+func (a *App) RegenerateRecoveryCodes() ([]string, error) {
+	userId := a.getSenderId()
+	if userId == "" {
+		return nil, errNotSignedIn
+	}
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+		hashes[i] = hashRecoveryCode(code)
+	}
+	if err := a.supabase.replaceRecoveryCodes(userId, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// GetMfaFactors lists the second factors of the signed in user
+func (a *App) GetMfaFactors() ([]MfaFactor, error) {
+	token := a.supabase.token()
+	if token == "" {
+		return nil, errNotSignedIn
+	}
+	user, err := a.auth.user(token)
+	if err != nil {
+		return nil, err
+	}
+	factors := make([]MfaFactor, 0, len(user.Factors))
+	for _, factor := range user.Factors {
+		factors = append(factors, MfaFactor{
+			Id:           factor.Id,
+			FriendlyName: factor.FriendlyName,
+			Type:         factor.FactorType,
+			Verified:     factor.Status == "verified",
+		})
+	}
+	return factors, nil
+}
+
+// UnenrollFactor removes the second factor, the recovery codes go
+// along with the last one
+func (a *App) UnenrollFactor(factorId string) error {
+	token := a.supabase.token()
+	if token == "" {
+		return errNotSignedIn
+	}
+	if err := a.auth.unenroll(token, factorId); err != nil {
+		return err
+	}
+	user, err := a.auth.user(token)
+	if err != nil {
+		return err
+	}
+	if user.verifiedFactor("totp") != nil {
+		return nil
+	}
+	return a.supabase.replaceRecoveryCodes(a.getSenderId(), nil)
+}
+
+// VerifySignIn finishes signing in with the code of the second factor
+func (a *App) VerifySignIn(code string) (AuthUser, error) {
+	a.mu.Lock()
+	pending := a.pendingMfa
+	a.mu.Unlock()
+	if pending == nil {
+		return AuthUser{}, errNoPendingSignIn
+	}
+	session, err := a.auth.challengeAndVerify(pending.session.AccessToken, pending.factorId, strings.TrimSpace(code))
+	if err != nil {
+		return AuthUser{}, err
+	}
+	if session.User == nil {
+		session.User = pending.session.User
+	}
+	return a.finishMfa(pending, session)
+}
+
+// SignInWithRecoveryCode finishes signing in with a recovery code instead
+// of the second factor. The factors are removed with it, the user has to
+// enroll again
+func (a *App) SignInWithRecoveryCode(code string) (AuthUser, error) {
+	a.mu.Lock()
+	pending := a.pendingMfa
+	a.mu.Unlock()
+	if pending == nil {
+		return AuthUser{}, errNoPendingSignIn
+	}
+	redeemed, err := a.supabase.redeemRecoveryCode(pending.session.AccessToken, hashRecoveryCode(code))
+	if err != nil {
+		return AuthUser{}, err
+	}
+	if !redeemed {
+		return AuthUser{}, errInvalidRecoveryCode
+	}
+	if pending.session.User != nil {
+		pending.session.User.Factors = nil
+	}
+	return a.finishMfa(pending, pending.session)
+}
+
+// completeSignIn signs in with the session of a first factor, unless the
+// user has a verified second factor. Then the session waits for
+// VerifySignIn and the user is returned with MfaRequired set.
+func (a *App) completeSignIn(session *authSession) (AuthUser, error) {
+	if session.User != nil {
+		if factor := session.User.verifiedFactor("totp"); factor != nil {
+			a.mu.Lock()
+			a.pendingMfa = &pendingMfa{session: session, factorId: factor.Id}
+			a.mu.Unlock()
+			user := newAuthUser(session.User)
+			user.MfaRequired = true
+			return user, nil
+		}
+	}
+	return a.signInWith(session)
+}
+
+// finishMfa signs in with the session the pending sign in ended with.
+func (a *App) finishMfa(pending *pendingMfa, session *authSession) (AuthUser, error) {
+	a.mu.Lock()
+	if a.pendingMfa == pending {
+		a.pendingMfa = nil
+	}
+	a.mu.Unlock()
+	return a.signInWith(session)
+}
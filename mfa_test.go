@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignInWithSecondFactor(t *testing.T) {
+	a, fake := newSupabaseApp(t, func(r supabaseRequest) (int, string) {
+		switch r.path {
+		case "/auth/v1/token":
+			return http.StatusOK, sessionJson(t, "aal1", "factor-1")
+		case "/auth/v1/factors/factor-1/challenge":
+			return http.StatusOK, `{"id": "challenge-1"}`
+		case "/auth/v1/factors/factor-1/verify":
+			if !strings.Contains(string(r.body), `"code":"123456"`) {
+				return http.StatusUnprocessableEntity, `{"error_code": "mfa_verification_failed", "msg": "Invalid TOTP code entered"}`
+			}
+			return http.StatusOK, sessionJson(t, "aal2", "factor-1")
+		}
+		return http.StatusNotFound, `{}`
+	})
+
+	user, err := a.SignIn("ada@example.com", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.MfaRequired || a.getSenderId() != "" {
+		t.Fatalf("signed in without the second factor: %+v", user)
+	}
+
+	if _, err := a.VerifySignIn("654321"); !errors.Is(err, errMfaInvalidCode) {
+		t.Fatalf("wrong code: %v", err)
+	}
+	if a.getSenderId() != "" {
+		t.Fatal("signed in with a wrong code")
+	}
+
+	// the sign in still waits for the right code
+	user, err = a.VerifySignIn(" 123456 ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.MfaRequired || user.Id != testUserId || a.getSenderId() != testUserId {
+		t.Fatalf("not signed in after the second factor: %+v", user)
+	}
+	verify := fake.find("POST", "/auth/v1/factors/factor-1/verify")
+	var body map[string]string
+	if err := json.Unmarshal(verify[len(verify)-1].body, &body); err != nil {
+		t.Fatal(err)
+	}
+	if body["challenge_id"] != "challenge-1" {
+		t.Errorf("verified challenge %q", body["challenge_id"])
+	}
+	if _, err := a.VerifySignIn("123456"); !errors.Is(err, errNoPendingSignIn) {
+		t.Errorf("verifying twice: %v", err)
+	}
+}
+
+func TestSignInWithRecoveryCode(t *testing.T) {
+	code := "abcd-efgh-ijkl-mnop"
+	pending := sessionJson(t, "aal1", "factor-1")
+	a, fake := newSupabaseApp(t, func(r supabaseRequest) (int, string) {
+		switch r.path {
+		case "/auth/v1/token":
+			return http.StatusOK, pending
+		case "/rest/v1/" + redeemRecoveryCodeRpc:
+			var body map[string]string
+			_ = json.Unmarshal(r.body, &body)
+			return http.StatusOK, fmt.Sprint(body["code_hash"] == hashRecoveryCode(code))
+		}
+		return http.StatusNotFound, `{}`
+	})
+
+	if _, err := a.SignInWithRecoveryCode(code); !errors.Is(err, errNoPendingSignIn) {
+		t.Fatalf("recovery code without a sign in: %v", err)
+	}
+	if _, err := a.SignIn("ada@example.com", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.SignInWithRecoveryCode("aaaa-bbbb-cccc-dddd"); !errors.Is(err, errInvalidRecoveryCode) {
+		t.Fatalf("unknown recovery code: %v", err)
+	}
+
+	// codes may be typed with spaces instead of dashes
+	user, err := a.SignInWithRecoveryCode("ABCD EFGH IJKL MNOP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.MfaRequired || a.getSenderId() != testUserId {
+		t.Fatalf("not signed in with the recovery code: %+v", user)
+	}
+	var session authSession
+	if err := json.Unmarshal([]byte(pending), &session); err != nil {
+		t.Fatal(err)
+	}
+	redeem := fake.find("POST", "/rest/v1/"+redeemRecoveryCodeRpc)
+	if len(redeem) != 2 {
+		t.Fatalf("%d redeem requests", len(redeem))
+	}
+	if redeem[1].token != session.AccessToken {
+		t.Error("the recovery code was not redeemed with the pending session")
+	}
+}
+
+func TestEnrollTotp(t *testing.T) {
+	a, fake := newSupabaseApp(t, func(r supabaseRequest) (int, string) {
+		switch r.path {
+		case "/auth/v1/factors":
+			return http.StatusOK, fmt.Sprintf(`{"id": "factor-1", "type": "totp", "totp": {"secret": %q}}`, rfc6238Secret)
+		case "/auth/v1/factors/factor-1/challenge":
+			return http.StatusOK, `{"id": "challenge-1"}`
+		case "/auth/v1/factors/factor-1/verify":
+			return http.StatusOK, sessionJson(t, "aal2", "factor-1")
+		case "/rest/v1/" + recoveryCodesTable:
+			return http.StatusCreated, ""
+		}
+		return http.StatusNotFound, `{}`
+	})
+	var session authSession
+	if err := json.Unmarshal([]byte(sessionJson(t, "aal1", "")), &session); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.signInWith(&session); err != nil {
+		t.Fatal(err)
+	}
+
+	enrollment, err := a.EnrollTotp("Phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enrollment.Secret != rfc6238Secret || !strings.HasPrefix(enrollment.Uri, "otpauth://totp/Messenger:ada@example.com?") {
+		t.Errorf("enrollment %+v", enrollment)
+	}
+	if !strings.HasPrefix(enrollment.QrCode, "data:image/png;base64,") {
+		t.Errorf("QR code %.40s", enrollment.QrCode)
+	}
+
+	// a wrong code is refused before asking GoTrue
+	if _, err := a.ConfirmTotp("000000x"); !errors.Is(err, errMfaInvalidCode) {
+		t.Fatalf("wrong code: %v", err)
+	}
+	if len(fake.find("POST", "/auth/v1/factors/factor-1/challenge")) != 0 {
+		t.Fatal("a wrong code was sent to GoTrue")
+	}
+
+	secret, err := newTotp(rfc6238Secret, time.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, err := a.ConfirmTotp(secret.code(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("%d recovery codes", len(codes))
+	}
+
+	// the old codes are deleted and the hashes of the new ones stored
+	deleted := fake.find("DELETE", "/rest/v1/"+recoveryCodesTable)
+	if len(deleted) != 1 || deleted[0].query != "user_id=eq."+testUserId {
+		t.Fatalf("deleted %+v", deleted)
+	}
+	inserted := fake.find("POST", "/rest/v1/"+recoveryCodesTable)
+	if len(inserted) != 1 {
+		t.Fatalf("%d inserts", len(inserted))
+	}
+	var rows []recoveryCodeRow
+	if err := json.Unmarshal(inserted[0].body, &rows); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != len(codes) {
+		t.Fatalf("%d rows for %d codes", len(rows), len(codes))
+	}
+	for i, row := range rows {
+		if row.UserId != testUserId || row.CodeHash != hashRecoveryCode(codes[i]) {
+			t.Errorf("row %+v does not store code %s", row, codes[i])
+		}
+		if strings.Contains(string(inserted[0].body), codes[i]) {
+			t.Errorf("the recovery code %s left the device", codes[i])
+		}
+	}
+}
+
+func TestHashRecoveryCode(t *testing.T) {
+	code, err := newRecoveryCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(code) != 19 || strings.Count(code, "-") != 3 {
+		t.Errorf("recovery code %q", code)
+	}
+	want := hashRecoveryCode("ABCDEFGHIJKLMNOP")
+	for _, typed := range []string{"ABCD-EFGH-IJKL-MNOP", "abcd efgh ijkl mnop", "abcdefghijklmnop"} {
+		if hashRecoveryCode(typed) != want {
+			t.Errorf("%q hashes differently", typed)
+		}
+	}
+}
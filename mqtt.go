@@ -0,0 +1,465 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	utils "github.com/benni347/messengerutils"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
+)
+
+// Over MQTT the public room is a topic below mqttTopicPrefix, while the
+// messages of the other rooms are published to the inbox topic of every
+// member below mqttInboxPrefix, as MQTT cannot subscribe somebody else to
+// a room. Messages are published with QoS 1 and never retained. The inbox
+// of a signed in user is a persistent session per device, under a client
+// id made of the user and the device, so the broker keeps the messages
+// while the device is offline and devices of the same user do not take
+// over each other's session. Unlike with RabbitMQ, a device only gets
+// messages once it connected for the first time, the broker has no
+// session for it before.
+//
+// Only MQTT 3.1.1 is spoken: the paho.mqtt.golang client does not
+// support MQTT 5, and nothing here needs its features.
+const (
+	mqttTopicPrefix = "messenger/rooms/"
+	mqttInboxPrefix = "messenger/users/"
+	mqttQos         = 1
+	mqttKeepAlive   = 30 * time.Second
+	// mqttTimeout bounds how long subscribing and unsubscribing may take.
+	mqttTimeout = 10 * time.Second
+	// mqttQueueSize is how many received messages wait for the handler
+	// before the client stops reading from the broker.
+	mqttQueueSize = 64
+)
+
+var errMqttTimeout = errors.New("the MQTT broker did not answer in time")
+
+// mqttDevice is the file that identifies this installation to the broker.
+type mqttDevice struct {
+	Id string `json:"id"`
+}
+
+// mqttDeviceId returns the id of this installation, creating it on the
+// first run.
+func mqttDeviceId() (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "device.json")
+	var device mqttDevice
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, &device); err != nil {
+			return "", fmt.Errorf("reading %s: %w", path, err)
+		}
+		if device.Id != "" {
+			return device.Id, nil
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	device.Id = uuid.NewString()
+	if data, err = json.Marshal(device); err != nil {
+		return "", err
+	}
+	return device.Id, writePrivateFile(path, data)
+}
+
+// roomTopic is the topic the messages of the room are published to.
+func roomTopic(roomId string) string {
+	return mqttTopicPrefix + roomId
+}
+
+// inboxTopic is the topic the messages to the user are published to.
+func inboxTopic(userId string) string {
+	return mqttInboxPrefix + userId
+}
+
+// mqttTransport is the Transport on top of an MQTT 3.1.1 broker. It
+// publishes through a connection of its own and opens one connection
+// per subscription, under the client id of the user and the device.
+type mqttTransport struct {
+	servers  []string
+	user     string
+	password string
+	tls      *tls.Config
+	device   string
+
+	publisher mqtt.Client
+
+	mu        sync.Mutex
+	connected bool
+	attempt   string
+	broker    string
+	listeners []func(BrokerStatus)
+	// subscriber is the client of the running subscription,
+	// userId the user it belongs to and joined the rooms joined since
+	subscriber mqtt.Client
+	userId     string
+	joined     map[string]bool
+}
+
+func newMqttTransport(c Config) (*mqttTransport, error) {
+	servers := splitList(c.MqttUrl)
+	if len(servers) == 0 {
+		return nil, errNoBroker
+	}
+	device, err := mqttDeviceId()
+	if err != nil {
+		return nil, err
+	}
+	t := &mqttTransport{
+		servers:  servers,
+		user:     c.MqttUser,
+		password: c.MqttPassword,
+		device:   device,
+	}
+	if c.MqttCaFile != "" {
+		pool, err := loadCaPool(c.MqttCaFile)
+		if err != nil {
+			return nil, err
+		}
+		t.tls = &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: pool}
+	}
+	return t, nil
+}
+
+// options returns the client options shared by all connections.
+func (t *mqttTransport) options(clientId string, clean bool) *mqtt.ClientOptions {
+	opts := mqtt.NewClientOptions().
+		SetClientID(clientId).
+		SetCleanSession(clean).
+		SetUsername(t.user).
+		SetPassword(t.password).
+		SetKeepAlive(mqttKeepAlive).
+		SetOrderMatters(true).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(reconnectMinDelay).
+		SetMaxReconnectInterval(reconnectMaxDelay)
+	for _, server := range t.servers {
+		opts.AddBroker(server)
+	}
+	if t.tls != nil {
+		opts.SetTLSConfig(t.tls)
+	}
+	return opts
+}
+
+func (t *mqttTransport) Connect() {
+	opts := t.options("messenger-"+uuid.NewString(), true).
+		SetConnectionAttemptHandler(func(broker *url.URL, tlsCfg *tls.Config) *tls.Config {
+			t.mu.Lock()
+			t.attempt = broker.Redacted()
+			t.mu.Unlock()
+			return tlsCfg
+		}).
+		SetOnConnectHandler(func(mqtt.Client) {
+			t.mu.Lock()
+			t.connected = true
+			t.broker = t.attempt
+			t.mu.Unlock()
+			t.notify()
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			utils.PrintError("Lost the connection to the MQTT broker", err)
+			t.mu.Lock()
+			t.connected = false
+			t.mu.Unlock()
+			t.notify()
+		})
+	t.publisher = mqtt.NewClient(opts)
+	// with connect retry on, the client keeps trying in the background
+	t.publisher.Connect()
+}
+
+func (t *mqttTransport) notify() {
+	status := t.Status()
+	t.mu.Lock()
+	listeners := append([]func(BrokerStatus){}, t.listeners...)
+	t.mu.Unlock()
+	for _, listener := range listeners {
+		listener(status)
+	}
+}
+
+func (t *mqttTransport) OnStatus(f func(BrokerStatus)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.listeners = append(t.listeners, f)
+}
+
+func (t *mqttTransport) Status() BrokerStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.connected {
+		return BrokerStatus{}
+	}
+	return BrokerStatus{Connected: true, Broker: t.broker}
+}
+
+func (t *mqttTransport) Close() {
+	if t.publisher != nil {
+		t.publisher.Disconnect(250)
+	}
+}
+
+// Publish publishes with QoS 1 to the inbox of every member, or to the
+// topic of the room if it has none, like the public room. The message is
+// confirmed once the broker answered every publish with a PUBACK.
+func (t *mqttTransport) Publish(msg Message, members []string) (<-chan error, error) {
+	if t.publisher == nil || !t.publisher.IsConnectionOpen() {
+		return nil, errNotConnected
+	}
+	publishing, err := msg.publishing()
+	if err != nil {
+		return nil, err
+	}
+	topics := []string{roomTopic(msg.ChatRoomId)}
+	if len(members) > 0 {
+		topics = topics[:0]
+		for _, userId := range members {
+			topics = append(topics, inboxTopic(userId))
+		}
+	}
+	tokens := make([]mqtt.Token, len(topics))
+	for i, topic := range topics {
+		tokens[i] = t.publisher.Publish(topic, mqttQos, false, publishing.Body)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		for _, token := range tokens {
+			<-token.Done()
+			if err := token.Error(); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	return done, nil
+}
+
+func (t *mqttTransport) Subscribe(userId string, rooms func() []string, handle func(Message)) func() {
+	clientId, clean := "messenger-"+userId+"-"+t.device, false
+	if userId == "" {
+		clientId, clean = "messenger-"+uuid.NewString(), true
+	}
+
+	queue := newMqttQueue(handle)
+	receive := func(_ mqtt.Client, m mqtt.Message) {
+		message, err := decodeMessage(m.Payload())
+		if err != nil {
+			utils.PrintError("Dropping a message", err)
+			m.Ack()
+			return
+		}
+		queue.push(message, m.Ack)
+	}
+	opts := t.options(clientId, clean).
+		// the queue acknowledges a message once it was handled, so the
+		// broker delivers the queued ones again after a crash
+		SetAutoAckDisabled(true).
+		// messages the broker kept for the session may arrive
+		// before the subscriptions are made again
+		SetDefaultPublishHandler(receive).
+		SetOnConnectHandler(func(c mqtt.Client) {
+			var topics []string
+			if userId != "" {
+				topics = append(topics, inboxTopic(userId))
+			}
+			for _, roomId := range t.subscriptionRooms(c, rooms) {
+				if roomId == publicChatRoomId {
+					topics = append(topics, roomTopic(roomId))
+				}
+			}
+			for _, topic := range topics {
+				token := c.Subscribe(topic, mqttQos, nil)
+				if !token.WaitTimeout(mqttTimeout) {
+					utils.PrintError("Failed to subscribe to "+topic, errMqttTimeout)
+				} else if err := token.Error(); err != nil {
+					utils.PrintError("Failed to subscribe to "+topic, err)
+				}
+			}
+		})
+	client := mqtt.NewClient(opts)
+
+	t.mu.Lock()
+	t.subscriber = client
+	t.userId = userId
+	t.joined = make(map[string]bool)
+	t.mu.Unlock()
+	client.Connect()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.mu.Lock()
+			if t.subscriber == client {
+				t.subscriber = nil
+				t.userId = ""
+			}
+			t.mu.Unlock()
+			client.Disconnect(250)
+			queue.close()
+		})
+	}
+}
+
+// mqttQueue hands the messages of a subscription to the handler one
+// after another in a goroutine of its own, so a slow handler does not
+// hold up the client right away. It holds at most mqttQueueSize
+// messages, a full queue blocks the client, which then stops reading
+// from the broker until the handler caught up. A message is only
+// acknowledged once it was handled, the ones still queued when the
+// subscription ends are delivered again by the broker.
+type mqttQueue struct {
+	messages chan mqttDelivery
+	stop     chan struct{}
+}
+
+// mqttDelivery is a received message and how to acknowledge it.
+type mqttDelivery struct {
+	msg Message
+	ack func()
+}
+
+func newMqttQueue(handle func(Message)) *mqttQueue {
+	q := &mqttQueue{messages: make(chan mqttDelivery, mqttQueueSize), stop: make(chan struct{})}
+	go func() {
+		for {
+			select {
+			case <-q.stop:
+				return
+			case d := <-q.messages:
+				handle(d.msg)
+				d.ack()
+			}
+		}
+	}()
+	return q
+}
+
+// push queues the message, waiting while the queue is full.
+func (q *mqttQueue) push(msg Message, ack func()) {
+	select {
+	case q.messages <- mqttDelivery{msg: msg, ack: ack}:
+	case <-q.stop:
+	}
+}
+
+// close stops the worker, the queued messages stay unacknowledged.
+func (q *mqttQueue) close() {
+	close(q.stop)
+}
+
+// subscriptionRooms returns the rooms and the rooms joined since the
+// subscription started, as long as c is the running subscriber.
+func (t *mqttTransport) subscriptionRooms(c mqtt.Client, rooms func() []string) []string {
+	list := rooms()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.subscriber != c {
+		return list
+	}
+	for roomId := range t.joined {
+		list = append(list, roomId)
+	}
+	return list
+}
+
+// Join subscribes the running subscription to the topic of the public
+// room. The messages of the other rooms arrive in the inbox anyway.
+func (t *mqttTransport) Join(roomId string) error {
+	if roomId != publicChatRoomId {
+		return nil
+	}
+	t.mu.Lock()
+	client := t.subscriber
+	if client != nil {
+		t.joined[roomId] = true
+	}
+	t.mu.Unlock()
+	if client == nil || !client.IsConnectionOpen() {
+		// subscribed to once the client connects
+		return nil
+	}
+	return waitToken(client.Subscribe(roomTopic(roomId), mqttQos, nil))
+}
+
+// Leave unsubscribes the running subscription from the public room. The
+// session of another user cannot be changed from here, and the other
+// rooms are not published to room topics.
+func (t *mqttTransport) Leave(userId, roomId string) error {
+	if roomId != publicChatRoomId {
+		return nil
+	}
+	t.mu.Lock()
+	client := t.subscriber
+	own := client != nil && t.userId == userId
+	if own {
+		delete(t.joined, roomId)
+	}
+	t.mu.Unlock()
+	if !own || !client.IsConnectionOpen() {
+		return nil
+	}
+	return waitToken(client.Unsubscribe(roomTopic(roomId)))
+}
+
+// validateMqttUrls checks the schemes the MQTT client can dial.
+func validateMqttUrls(value string) error {
+	for _, rawUrl := range splitList(value) {
+		u, err := url.Parse(rawUrl)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("%q is not a valid url", rawUrl)
+		}
+		switch u.Scheme {
+		case "tcp", "mqtt", "ssl", "tls", "mqtts", "ws", "wss":
+		default:
+			return fmt.Errorf("%q: scheme must be tcp, ssl, ws or wss", rawUrl)
+		}
+	}
+	return nil
+}
+
+// validateMqttConfig checks the MQTT settings against each other,
+// it is only called when the MQTT transport is selected.
+func validateMqttConfig(c Config) []ConfigProblem {
+	var problems []ConfigProblem
+	if c.MqttUrl == "" {
+		problems = append(problems, ConfigProblem{Field: "MQTT_URL", Source: sourceDefault, Message: "is required for the MQTT transport"})
+	}
+	if c.MqttCaFile != "" {
+		if _, err := loadCaPool(c.MqttCaFile); err != nil {
+			problems = append(problems, ConfigProblem{Field: "MQTT_CA_FILE", Source: sourceDefault, Message: err.Error()})
+		}
+	}
+	if c.GatewayAddr != "" {
+		// direct rooms and groups only reach the inbox topics of their
+		// members, never the temporary inbox of the gateway
+		problems = append(problems, ConfigProblem{Field: "GATEWAY_ADDR", Source: sourceDefault, Message: "the gateway needs the amqp transport"})
+	}
+	return problems
+}
+
+func waitToken(token mqtt.Token) error {
+	if !token.WaitTimeout(mqttTimeout) {
+		return errMqttTimeout
+	}
+	if err := token.Error(); err != nil {
+		return fmt.Errorf("MQTT: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMqttQueueAcknowledgesHandledMessages(t *testing.T) {
+	release := make(chan struct{})
+	handled := make(chan string, mqttQueueSize+2)
+	q := newMqttQueue(func(msg Message) {
+		<-release
+		handled <- msg.Id
+	})
+	var acked int32
+	ack := func() { atomic.AddInt32(&acked, 1) }
+
+	// the worker holds one message, the queue mqttQueueSize more
+	for i := 0; i <= mqttQueueSize; i++ {
+		q.push(Message{Id: strconv.Itoa(i)}, ack)
+	}
+	pushed := make(chan struct{})
+	go func() {
+		q.push(Message{Id: "last"}, ack)
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("a full queue did not block")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if n := atomic.LoadInt32(&acked); n != 0 {
+		t.Fatalf("%d messages acknowledged before they were handled", n)
+	}
+
+	close(release)
+	<-pushed
+	for i := 0; i <= mqttQueueSize; i++ {
+		if id := <-handled; id != strconv.Itoa(i) {
+			t.Fatalf("handled %s, want %d", id, i)
+		}
+	}
+	if id := <-handled; id != "last" {
+		t.Fatalf("handled %s, want last", id)
+	}
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&acked) != mqttQueueSize+2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&acked); n != mqttQueueSize+2 {
+		t.Fatalf("%d messages acknowledged, want %d", n, mqttQueueSize+2)
+	}
+	q.close()
+}
+
+func TestMqttQueueCloseKeepsQueuedMessagesUnacknowledged(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	q := newMqttQueue(func(Message) { <-block })
+	var acked int32
+	q.push(Message{Id: "handling"}, func() { atomic.AddInt32(&acked, 1) })
+	q.push(Message{Id: "queued"}, func() { atomic.AddInt32(&acked, 1) })
+	q.close()
+
+	// pushing to a closed queue returns instead of blocking the client
+	for i := 0; i <= mqttQueueSize; i++ {
+		q.push(Message{Id: strconv.Itoa(i)}, func() { atomic.AddInt32(&acked, 1) })
+	}
+	if n := atomic.LoadInt32(&acked); n != 0 {
+		t.Fatalf("%d messages acknowledged after closing", n)
+	}
+}
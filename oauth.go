@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	utils "github.com/benni347/messengerutils"
+	"github.com/wailsapp/wails/v2/pkg/runtime"
+)
+
+const (
+	// oauthCallbackPath is the path of the loopback redirect.
+	oauthCallbackPath = "/auth/callback"
+	// oauthTimeout is how long the user has to sign in in the browser.
+	oauthTimeout = 5 * time.Minute
+)
+
+var (
+	errOAuthCanceled = errors.New("signing in was canceled")
+	errOAuthTimeout  = errors.New("signing in took too long")
+	errOAuthDenied   = errors.New("signing in was refused")
+)
+
+// oauthFlow is one sign in through an OAuth provider with PKCE: the
+// browser signs in, Supabase redirects it to a server on the loopback
+// interface with a code, and only this flow knows the verifier the
+// code can be exchanged with.
+type oauthFlow struct {
+	verifier string
+	listener net.Listener
+	server   *http.Server
+	codes    chan oauthResult
+
+	cancelOnce sync.Once
+	canceled   chan struct{}
+}
+
+type oauthResult struct {
+	code string
+	err  error
+}
+
+// newOauthFlow listens on the loopback port, a free one if port is empty.
+func newOauthFlow(port string) (*oauthFlow, error) {
+	verifier, err := newCodeVerifier()
+	if err != nil {
+		return nil, err
+	}
+	if port == "" {
+		port = "0"
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		return nil, err
+	}
+	f := &oauthFlow{
+		verifier: verifier,
+		listener: listener,
+		codes:    make(chan oauthResult, 1),
+		canceled: make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(oauthCallbackPath, f.callback)
+	f.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := f.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			utils.PrintError("OAuth redirect server", err)
+		}
+	}()
+	return f, nil
+}
+
+// newCodeVerifier returns a random PKCE code verifier.
+func newCodeVerifier() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// challenge is the S256 code challenge of the verifier.
+func (f *oauthFlow) challenge() string {
+	sum := sha256.Sum256([]byte(f.verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// redirectUrl is where the provider has to send the browser back to.
+func (f *oauthFlow) redirectUrl() string {
+	return "http://" + f.listener.Addr().String() + oauthCallbackPath
+}
+
+// callback receives the redirect. Only the first one counts, the flow
+// is over after it anyway.
+func (f *oauthFlow) callback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var result oauthResult
+	if reason := query.Get("error"); reason != "" {
+		if description := query.Get("error_description"); description != "" {
+			reason = description
+		}
+		result.err = fmt.Errorf("%w: %s", errOAuthDenied, reason)
+	} else if result.code = query.Get("code"); result.code == "" {
+		http.Error(w, "missing code", http.StatusBadRequest)
+		return
+	}
+
+	message := "You are signed in to the messenger, you can close this window."
+	if result.err != nil {
+		message = "Signing in failed: " + result.err.Error()
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<!DOCTYPE html><html><head><title>Messenger</title></head><body><p>%s</p></body></html>", html.EscapeString(message))
+
+	select {
+	case f.codes <- result:
+	default:
+	}
+}
+
+// wait blocks until the redirect arrived, the flow was canceled or
+// the timeout passed.
+func (f *oauthFlow) wait(timeout time.Duration) (string, error) {
+	select {
+	case result := <-f.codes:
+		return result.code, result.err
+	case <-f.canceled:
+		return "", errOAuthCanceled
+	case <-time.After(timeout):
+		return "", errOAuthTimeout
+	}
+}
+
+// cancel ends the flow and stops the server.
+func (f *oauthFlow) cancel() {
+	f.cancelOnce.Do(func() {
+		close(f.canceled)
+		ctx, done := context.WithTimeout(context.Background(), time.Second)
+		defer done()
+		if err := f.server.Shutdown(ctx); err != nil {
+			utils.PrintError("Failed to stop the OAuth redirect server", err)
+		}
+	})
+}
+
+// SignInWithGithub signs in with GitHub in the browser and
+// resolves once the user came back, a second call cancels the first.
+// Like SignIn it may wait for the second factor
+func (a *App) SignInWithGithub() (AuthUser, error) {
+	return a.signInWithProvider("github")
+}
+
+// CancelSignIn gives up signing in through the browser
+func (a *App) CancelSignIn() {
+	a.mu.Lock()
+	flow := a.oauth
+	a.mu.Unlock()
+	if flow != nil {
+		flow.cancel()
+	}
+}
+
+// signInWithProvider runs the OAuth flow with the provider and stores
+// the session it ends with.
+func (a *App) signInWithProvider(provider string) (AuthUser, error) {
+	// the previous flow may hold the port
+	a.CancelSignIn()
+	flow, err := newOauthFlow(a.config.OAuthRedirectPort)
+	if err != nil {
+		return AuthUser{}, err
+	}
+	a.mu.Lock()
+	a.oauth = flow
+	a.mu.Unlock()
+	defer func() {
+		flow.cancel()
+		a.mu.Lock()
+		if a.oauth == flow {
+			a.oauth = nil
+		}
+		a.mu.Unlock()
+	}()
+
+	runtime.BrowserOpenURL(a.ctx, a.auth.authorizeUrl(provider, flow.redirectUrl(), flow.challenge()))
+	code, err := flow.wait(oauthTimeout)
+	if err != nil {
+		return AuthUser{}, err
+	}
+	session, err := a.auth.exchangeCode(code, flow.verifier)
+	if err != nil {
+		return AuthUser{}, err
+	}
+	return a.completeSignIn(session)
+}
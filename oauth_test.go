@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCodeChallenge(t *testing.T) {
+	// the example of RFC 7636, appendix B
+	f := &oauthFlow{verifier: "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"}
+	if challenge := f.challenge(); challenge != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Errorf("challenge %s", challenge)
+	}
+
+	verifier, err := newCodeVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := newCodeVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(verifier) < 43 || len(verifier) > 128 || verifier == other {
+		t.Errorf("verifiers %q and %q", verifier, other)
+	}
+}
+
+// redirect sends the browser back to the flow with the query.
+func redirect(t *testing.T, f *oauthFlow, query string) (int, string) {
+	t.Helper()
+	resp, err := http.Get(f.redirectUrl() + "?" + query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestOauthCallback(t *testing.T) {
+	f, err := newOauthFlow("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.cancel()
+	if u, err := url.Parse(f.redirectUrl()); err != nil || u.Hostname() != "127.0.0.1" || u.Path != oauthCallbackPath {
+		t.Fatalf("redirect url %s", f.redirectUrl())
+	}
+
+	if status, _ := redirect(t, f, "state=x"); status != http.StatusBadRequest {
+		t.Errorf("redirect without a code: status %d", status)
+	}
+	if status, body := redirect(t, f, "code=the-code"); status != http.StatusOK || !strings.Contains(body, "signed in") {
+		t.Errorf("redirect with a code: %d %s", status, body)
+	}
+	// a second redirect neither blocks nor replaces the first code
+	redirect(t, f, "code=another-code")
+	if code, err := f.wait(time.Second); err != nil || code != "the-code" {
+		t.Errorf("got %q, %v", code, err)
+	}
+
+	denied, err := newOauthFlow("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer denied.cancel()
+	_, body := redirect(t, denied, "error=access_denied&error_description=%3Cb%3Eno%3C%2Fb%3E")
+	if !strings.Contains(body, "&lt;b&gt;no&lt;/b&gt;") {
+		t.Errorf("the reason is not escaped: %s", body)
+	}
+	if _, err := denied.wait(time.Second); !errors.Is(err, errOAuthDenied) || !strings.Contains(err.Error(), "<b>no</b>") {
+		t.Errorf("denied: %v", err)
+	}
+}
+
+func TestOauthCancelAndTimeout(t *testing.T) {
+	f, err := newOauthFlow("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.wait(10 * time.Millisecond); !errors.Is(err, errOAuthTimeout) {
+		t.Errorf("timeout: %v", err)
+	}
+	redirectUrl := f.redirectUrl()
+	f.cancel()
+	f.cancel()
+	if _, err := f.wait(time.Second); !errors.Is(err, errOAuthCanceled) {
+		t.Errorf("canceled: %v", err)
+	}
+	if resp, err := http.Get(redirectUrl + "?code=late"); err == nil {
+		resp.Body.Close()
+		t.Error("the redirect server still runs after canceling")
+	}
+}
+
+func TestExchangeCode(t *testing.T) {
+	c, requests := newFakeGoTrue(t, func(authRequest) (int, string) {
+		return http.StatusOK, testSession
+	})
+	authorize, err := url.Parse(c.authorizeUrl("github", "http://127.0.0.1:4321/auth/callback", "challenge"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := authorize.Query()
+	if authorize.Path != "/auth/v1/authorize" || query.Get("provider") != "github" || query.Get("redirect_to") != "http://127.0.0.1:4321/auth/callback" ||
+		query.Get("code_challenge") != "challenge" || query.Get("code_challenge_method") != "s256" {
+		t.Errorf("authorize url %s", authorize)
+	}
+
+	session, err := c.exchangeCode("the-code", "the-verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := <-requests
+	if req.method != http.MethodPost || req.path != "/token" || req.query != "grant_type=pkce" {
+		t.Errorf("request %s %s?%s", req.method, req.path, req.query)
+	}
+	if req.body["auth_code"] != "the-code" || req.body["code_verifier"] != "the-verifier" {
+		t.Errorf("body %v", req.body)
+	}
+	if session.AccessToken != "access" {
+		t.Errorf("session %+v", session)
+	}
+}
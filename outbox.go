@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	utils "github.com/benni347/messengerutils"
+)
+
+const (
+	outboxMinDelay = 1 * time.Second
+	outboxMaxDelay = 1 * time.Minute
+)
+
+var errCanceled = errors.New("the message was canceled")
+
+// OutboxEntry describes a message that is waiting to be sent.
+type OutboxEntry struct {
+	MessageId   string `json:"messageId"`
+	ChatRoomId  string `json:"chatRoomId"`
+	Message     string `json:"message"`
+	Time        string `json:"time"`
+	Attempts    int    `json:"attempts"`
+	NextAttempt string `json:"nextAttempt"`
+}
+
+type outboxItem struct {
+	message  Message
+	attempts int
+	next     time.Time
+}
+
+// outbox holds messages that could not be handed to the broker yet.
+// Messages are kept in order per chat room: only the oldest message of
+// a room is retried and the ones behind it wait until it went through.
+type outbox struct {
+	publish func(Message) error
+
+	mu    sync.Mutex
+	rooms map[string][]*outboxItem
+
+	wake chan struct{}
+	done chan struct{}
+}
+
+// newOutbox creates an outbox which sends its messages with publish.
+// Call start to begin retrying.
+func newOutbox(publish func(Message) error) *outbox {
+	return &outbox{
+		publish: publish,
+		rooms:   make(map[string][]*outboxItem),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+func (o *outbox) start() {
+	go o.run()
+}
+
+func (o *outbox) stop() {
+	close(o.done)
+}
+
+// add queues a message behind the other messages of its chat room.
+func (o *outbox) add(message Message) {
+	o.mu.Lock()
+	o.rooms[message.ChatRoomId] = append(o.rooms[message.ChatRoomId], &outboxItem{
+		message: message,
+		next:    time.Now(),
+	})
+	o.mu.Unlock()
+	o.signal()
+}
+
+// has reports whether messages are waiting for the chat room,
+// in which case new messages must be queued behind them.
+func (o *outbox) has(chatRoomId string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.rooms[chatRoomId]) > 0
+}
+
+// cancel removes a waiting message from the outbox.
+func (o *outbox) cancel(messageId string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for room, items := range o.rooms {
+		for i, item := range items {
+			if item.message.Id != messageId {
+				continue
+			}
+			items = append(items[:i], items[i+1:]...)
+			if len(items) == 0 {
+				delete(o.rooms, room)
+			} else {
+				o.rooms[room] = items
+			}
+			return nil
+		}
+	}
+	return errUnknownMessage
+}
+
+// entries lists the waiting messages, oldest first.
+func (o *outbox) entries() []OutboxEntry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	entries := []OutboxEntry{}
+	for _, items := range o.rooms {
+		for _, item := range items {
+			entries = append(entries, OutboxEntry{
+				MessageId:   item.message.Id,
+				ChatRoomId:  item.message.ChatRoomId,
+				Message:     item.message.Message,
+				Time:        item.message.Time,
+				Attempts:    item.attempts,
+				NextAttempt: item.next.UTC().Format(time.RFC3339),
+			})
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time < entries[j].Time
+	})
+	return entries
+}
+
+// flush retries all waiting messages right away,
+// it is called once the connection is healthy again.
+func (o *outbox) flush() {
+	o.mu.Lock()
+	now := time.Now()
+	for _, items := range o.rooms {
+		items[0].next = now
+	}
+	o.mu.Unlock()
+	o.signal()
+}
+
+func (o *outbox) signal() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (o *outbox) run() {
+	for {
+		item, wait := o.due()
+		if item == nil {
+			var timer <-chan time.Time
+			if wait > 0 {
+				timer = time.After(wait)
+			}
+			select {
+			case <-o.done:
+				return
+			case <-o.wake:
+			case <-timer:
+			}
+			continue
+		}
+
+		err := o.publish(item.message)
+
+		o.mu.Lock()
+		items := o.rooms[item.message.ChatRoomId]
+		if len(items) == 0 || items[0] != item {
+			// canceled while it was being sent
+			o.mu.Unlock()
+			continue
+		}
+		if err != nil {
+			item.attempts++
+			item.next = time.Now().Add(outboxBackoff(item.attempts))
+			o.mu.Unlock()
+			utils.PrintError("Failed to send a queued message", err)
+			continue
+		}
+		if len(items) == 1 {
+			delete(o.rooms, item.message.ChatRoomId)
+		} else {
+			o.rooms[item.message.ChatRoomId] = items[1:]
+		}
+		o.mu.Unlock()
+	}
+}
+
+// due returns the oldest message that should be sent now. If there is
+// none it returns how long to wait for the next one, zero meaning the
+// outbox is empty.
+func (o *outbox) due() (*outboxItem, time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := time.Now()
+	var next *outboxItem
+	for _, items := range o.rooms {
+		head := items[0]
+		if next == nil || head.next.Before(next.next) {
+			next = head
+		}
+	}
+	if next == nil {
+		return nil, 0
+	}
+	if wait := next.next.Sub(now); wait > 0 {
+		return nil, wait
+	}
+	return next, 0
+}
+
+// outboxBackoff is the exponential backoff with jitter before the
+// given attempt, it lies between half and the full delay.
+func outboxBackoff(attempts int) time.Duration {
+	delay := outboxMaxDelay
+	if attempts < 16 {
+		delay = outboxMinDelay << uint(attempts-1)
+	}
+	if delay > outboxMaxDelay {
+		delay = outboxMaxDelay
+	}
+	half := int64(delay / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyBroker fails every publish while it is down and records the
+// messages it took.
+type flakyBroker struct {
+	mu        sync.Mutex
+	down      bool
+	attempts  int
+	published []string
+	took      chan struct{}
+}
+
+func (b *flakyBroker) publish(msg Message) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.attempts++
+	if b.down {
+		return errNotConfirmed
+	}
+	b.published = append(b.published, msg.Id)
+	b.took <- struct{}{}
+	return nil
+}
+
+func TestOutboxKeepsTheOrderOfEachRoom(t *testing.T) {
+	broker := &flakyBroker{down: true, took: make(chan struct{}, 8)}
+	o := newOutbox(broker.publish)
+	first := newMessage("room-a", "", "first")
+	second := newMessage("room-a", "", "second")
+	other := newMessage("room-b", "", "other")
+	for _, msg := range []Message{first, second, other} {
+		o.add(msg)
+	}
+	if !o.has("room-a") || o.has("room-c") {
+		t.Fatal("has does not match the queued rooms")
+	}
+	o.start()
+	defer o.stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		broker.mu.Lock()
+		attempts := broker.attempts
+		broker.mu.Unlock()
+		if attempts >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the outbox did not try to send")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for _, entry := range o.entries() {
+		if entry.MessageId == second.Id && entry.Attempts != 0 {
+			t.Fatal("the second message was tried before the first went through")
+		}
+	}
+
+	broker.mu.Lock()
+	broker.down = false
+	broker.mu.Unlock()
+	o.flush()
+	for i := 0; i < 3; i++ {
+		select {
+		case <-broker.took:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the queued messages were not sent")
+		}
+	}
+	broker.mu.Lock()
+	published := broker.published
+	broker.mu.Unlock()
+	var order []string
+	for _, id := range published {
+		if id != other.Id {
+			order = append(order, id)
+		}
+	}
+	if len(order) != 2 || order[0] != first.Id || order[1] != second.Id {
+		t.Fatalf("room-a was sent as %v, want the first then the second", order)
+	}
+	if entries := o.entries(); len(entries) != 0 {
+		t.Fatalf("still waiting: %+v", entries)
+	}
+}
+
+func TestOutboxCancel(t *testing.T) {
+	o := newOutbox(func(Message) error { return errNotConfirmed })
+	first := newMessage("room-a", "", "first")
+	second := newMessage("room-a", "", "second")
+	o.add(first)
+	o.add(second)
+	if err := o.cancel(first.Id); err != nil {
+		t.Fatal(err)
+	}
+	entries := o.entries()
+	if len(entries) != 1 || entries[0].MessageId != second.Id {
+		t.Fatalf("entries after canceling %+v", entries)
+	}
+	if err := o.cancel(first.Id); !errors.Is(err, errUnknownMessage) {
+		t.Errorf("canceling twice: %v", err)
+	}
+	if err := o.cancel(second.Id); err != nil || o.has("room-a") {
+		t.Errorf("canceling the last message: %v", err)
+	}
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	for attempts := 1; attempts < 40; attempts++ {
+		delay := outboxMinDelay << uint(attempts-1)
+		if attempts >= 16 || delay > outboxMaxDelay {
+			delay = outboxMaxDelay
+		}
+		for i := 0; i < 20; i++ {
+			if got := outboxBackoff(attempts); got < delay/2 || got > delay {
+				t.Fatalf("attempt %d waits %v, want between %v and %v", attempts, got, delay/2, delay)
+			}
+		}
+	}
+}
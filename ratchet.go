@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// The Double Ratchet as described by Signal
+// (https://signal.org/docs/specifications/doubleratchet/) with X25519,
+// HKDF-SHA256 and HMAC-SHA256 for the key derivations and AES-256-GCM
+// as the message cipher.
+
+// maxSkip is the number of message keys a single chain may skip, so a
+// malicious header cannot make us derive keys forever.
+const maxSkip = 1000
+
+var (
+	errTooManySkipped = errors.New("too many skipped messages")
+	errCannotSend     = errors.New("the session cannot send before it received a message")
+)
+
+// ratchetHeader travels in the clear next to every ratchet message.
+type ratchetHeader struct {
+	DH []byte `json:"dh"`
+	PN uint32 `json:"pn"`
+	N  uint32 `json:"n"`
+}
+
+// bytes encodes the header for use as associated data.
+func (h ratchetHeader) bytes() []byte {
+	out := make([]byte, 0, len(h.DH)+8)
+	out = append(out, h.DH...)
+	out = binary.BigEndian.AppendUint32(out, h.PN)
+	out = binary.BigEndian.AppendUint32(out, h.N)
+	return out
+}
+
+// ratchetState is the state of one side of a session. It is exported
+// field by field so it can be stored between runs of the app.
+type ratchetState struct {
+	DHs     []byte            `json:"dhs"`
+	DHr     []byte            `json:"dhr,omitempty"`
+	RK      []byte            `json:"rk"`
+	CKs     []byte            `json:"cks,omitempty"`
+	CKr     []byte            `json:"ckr,omitempty"`
+	Ns      uint32            `json:"ns"`
+	Nr      uint32            `json:"nr"`
+	PN      uint32            `json:"pn"`
+	Skipped map[string][]byte `json:"skipped"`
+	AD      []byte            `json:"ad"`
+}
+
+func dh(private []byte, public []byte) ([]byte, error) {
+	priv, err := ecdh.X25519().NewPrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := ecdh.X25519().NewPublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+	return priv.ECDH(pub)
+}
+
+func generateRatchetKey() ([]byte, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return key.Bytes(), nil
+}
+
+func ratchetPublic(private []byte) ([]byte, error) {
+	priv, err := ecdh.X25519().NewPrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	return priv.PublicKey().Bytes(), nil
+}
+
+// kdfRK derives the next root key and a chain key from a DH output.
+func kdfRK(rk, dhOut []byte) ([]byte, []byte) {
+	out := hkdfSha256(dhOut, rk, []byte("messenger ratchet"), 64)
+	return out[:32], out[32:]
+}
+
+// kdfCK derives the next chain key and a message key from a chain key.
+func kdfCK(ck []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write([]byte{0x01})
+	mk := mac.Sum(nil)
+	mac = hmac.New(sha256.New, ck)
+	mac.Write([]byte{0x02})
+	return mac.Sum(nil), mk
+}
+
+// sealWithMessageKey encrypts with a key and nonce derived from the
+// message key, which is used exactly once.
+func sealWithMessageKey(mk, plaintext, ad []byte) ([]byte, error) {
+	keys := hkdfSha256(mk, nil, []byte("messenger message keys"), 44)
+	gcm, err := newGcm(keys[:32])
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nil, keys[32:], plaintext, ad), nil
+}
+
+func openWithMessageKey(mk, ciphertext, ad []byte) ([]byte, error) {
+	keys := hkdfSha256(mk, nil, []byte("messenger message keys"), 44)
+	gcm, err := newGcm(keys[:32])
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, keys[32:], ciphertext, ad)
+}
+
+// newInitiatorRatchet starts the session of the side that ran X3DH,
+// the signed prekey of the peer is its first ratchet key.
+func newInitiatorRatchet(sk, peerRatchet, ad []byte) (*ratchetState, error) {
+	dhs, err := generateRatchetKey()
+	if err != nil {
+		return nil, err
+	}
+	out, err := dh(dhs, peerRatchet)
+	if err != nil {
+		return nil, err
+	}
+	rk, cks := kdfRK(sk, out)
+	return &ratchetState{
+		DHs:     dhs,
+		DHr:     peerRatchet,
+		RK:      rk,
+		CKs:     cks,
+		Skipped: make(map[string][]byte),
+		AD:      ad,
+	}, nil
+}
+
+// newResponderRatchet starts the session of the side whose signed
+// prekey was used, it can only send once it received a message.
+func newResponderRatchet(sk, signedPrekey, ad []byte) *ratchetState {
+	return &ratchetState{
+		DHs:     signedPrekey,
+		RK:      sk,
+		Skipped: make(map[string][]byte),
+		AD:      ad,
+	}
+}
+
+func (s *ratchetState) clone() *ratchetState {
+	c := *s
+	c.Skipped = make(map[string][]byte, len(s.Skipped))
+	for k, v := range s.Skipped {
+		c.Skipped[k] = v
+	}
+	return &c
+}
+
+func skippedKey(dh []byte, n uint32) string {
+	return base64.StdEncoding.EncodeToString(dh) + ":" + fmt.Sprint(n)
+}
+
+// encrypt advances the sending chain and encrypts the plaintext,
+// aad is bound to the ciphertext next to the header.
+func (s *ratchetState) encrypt(plaintext, aad []byte) (ratchetHeader, []byte, error) {
+	if s.CKs == nil {
+		return ratchetHeader{}, nil, errCannotSend
+	}
+	pub, err := ratchetPublic(s.DHs)
+	if err != nil {
+		return ratchetHeader{}, nil, err
+	}
+	var mk []byte
+	s.CKs, mk = kdfCK(s.CKs)
+	header := ratchetHeader{DH: pub, PN: s.PN, N: s.Ns}
+	s.Ns++
+	ciphertext, err := sealWithMessageKey(mk, plaintext, s.associatedData(header, aad))
+	if err != nil {
+		return ratchetHeader{}, nil, err
+	}
+	return header, ciphertext, nil
+}
+
+// decrypt decrypts a message, keeping the keys of messages skipped on
+// the way so they can still be read when they arrive late. The state
+// is only changed if the message could be decrypted.
+func (s *ratchetState) decrypt(header ratchetHeader, ciphertext, aad []byte) ([]byte, error) {
+	next := s.clone()
+	plaintext, err := next.decryptInPlace(header, ciphertext, aad)
+	if err != nil {
+		return nil, err
+	}
+	*s = *next
+	return plaintext, nil
+}
+
+func (s *ratchetState) decryptInPlace(header ratchetHeader, ciphertext, aad []byte) ([]byte, error) {
+	ad := s.associatedData(header, aad)
+	key := skippedKey(header.DH, header.N)
+	if mk, ok := s.Skipped[key]; ok {
+		delete(s.Skipped, key)
+		return openWithMessageKey(mk, ciphertext, ad)
+	}
+
+	if !bytes.Equal(header.DH, s.DHr) {
+		if err := s.skip(header.PN); err != nil {
+			return nil, err
+		}
+		if err := s.dhRatchet(header); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.skip(header.N); err != nil {
+		return nil, err
+	}
+	var mk []byte
+	s.CKr, mk = kdfCK(s.CKr)
+	s.Nr++
+	return openWithMessageKey(mk, ciphertext, ad)
+}
+
+// skip stores the message keys of the receiving chain up to until.
+func (s *ratchetState) skip(until uint32) error {
+	if s.CKr == nil {
+		return nil
+	}
+	if until > s.Nr+maxSkip || len(s.Skipped) > 10*maxSkip {
+		return errTooManySkipped
+	}
+	for s.Nr < until {
+		var mk []byte
+		s.CKr, mk = kdfCK(s.CKr)
+		s.Skipped[skippedKey(s.DHr, s.Nr)] = mk
+		s.Nr++
+	}
+	return nil
+}
+
+// dhRatchet steps both chains once the peer used a new ratchet key.
+func (s *ratchetState) dhRatchet(header ratchetHeader) error {
+	s.PN = s.Ns
+	s.Ns = 0
+	s.Nr = 0
+	s.DHr = header.DH
+
+	out, err := dh(s.DHs, s.DHr)
+	if err != nil {
+		return err
+	}
+	s.RK, s.CKr = kdfRK(s.RK, out)
+
+	if s.DHs, err = generateRatchetKey(); err != nil {
+		return err
+	}
+	if out, err = dh(s.DHs, s.DHr); err != nil {
+		return err
+	}
+	s.RK, s.CKs = kdfRK(s.RK, out)
+	return nil
+}
+
+func (s *ratchetState) associatedData(header ratchetHeader, aad []byte) []byte {
+	ad := make([]byte, 0, len(s.AD)+len(header.DH)+8+len(aad))
+	ad = append(ad, s.AD...)
+	ad = append(ad, header.bytes()...)
+	return append(ad, aad...)
+}
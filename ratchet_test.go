@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// fixedKey is a key made of one repeated byte, so the vectors below can
+// be recomputed with any X25519 and HKDF implementation.
+func fixedKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// newSessionPair sets up a session the way X3DH leaves it, alice as the
+// initiator and bob as the responder whose signed prekey was used.
+func newSessionPair(t *testing.T) (alice, bob *ratchetState) {
+	t.Helper()
+	spk := fixedKey(5)
+	spkPub, err := ratchetPublic(spk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sk := fixedKey(6)
+	if alice, err = newInitiatorRatchet(sk, spkPub, []byte("ad")); err != nil {
+		t.Fatal(err)
+	}
+	return alice, newResponderRatchet(sk, spk, []byte("ad"))
+}
+
+type sentMessage struct {
+	header     ratchetHeader
+	ciphertext []byte
+}
+
+func send(t *testing.T, s *ratchetState, plaintext string) sentMessage {
+	t.Helper()
+	header, ciphertext, err := s.encrypt([]byte(plaintext), []byte("aad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sentMessage{header, ciphertext}
+}
+
+func receive(t *testing.T, s *ratchetState, msg sentMessage, want string) {
+	t.Helper()
+	got, err := s.decrypt(msg.header, msg.ciphertext, []byte("aad"))
+	if err != nil {
+		t.Fatalf("decrypting %q: %v", want, err)
+	}
+	if string(got) != want {
+		t.Fatalf("decrypted %q, want %q", got, want)
+	}
+}
+
+func TestKdfVectors(t *testing.T) {
+	rk, ck := kdfRK(fixedKey(1), fixedKey(2))
+	if !bytes.Equal(rk, mustHex(t, "ecab6f80364e0ce4afa7d834a99e952158cd52b0c1abb2788645f32f358729d8")) {
+		t.Errorf("kdfRK root key = %x", rk)
+	}
+	if !bytes.Equal(ck, mustHex(t, "096a8eca54082192110a2883d5a5fbc3f8be3a04d9de11313acd4c36ad397718")) {
+		t.Errorf("kdfRK chain key = %x", ck)
+	}
+	ck, mk := kdfCK(fixedKey(3))
+	if !bytes.Equal(ck, mustHex(t, "cfbf8f5595e5f186a92161efb3ebb946d3aa706c2df70eed5152741bdb1e7bde")) {
+		t.Errorf("kdfCK chain key = %x", ck)
+	}
+	if !bytes.Equal(mk, mustHex(t, "aa6fa3f949be2b2cc7de5a18e7f65fee5fb78488f588d53196a63e66ad67ad12")) {
+		t.Errorf("kdfCK message key = %x", mk)
+	}
+}
+
+func TestRatchetEncryptVector(t *testing.T) {
+	spkPub, err := ratchetPublic(fixedKey(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// newInitiatorRatchet with the random ratchet key replaced by a fixed one
+	out, err := dh(fixedKey(4), spkPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rk, cks := kdfRK(fixedKey(6), out)
+	s := &ratchetState{DHs: fixedKey(4), DHr: spkPub, RK: rk, CKs: cks, Skipped: make(map[string][]byte), AD: []byte("ad")}
+
+	msg := send(t, s, "hello")
+	if !bytes.Equal(msg.header.DH, mustHex(t, "ac01b2209e86354fb853237b5de0f4fab13c7fcbf433a61c019369617fecf10b")) {
+		t.Errorf("header key = %x", msg.header.DH)
+	}
+	if msg.header.N != 0 || msg.header.PN != 0 {
+		t.Errorf("header = %+v, want the first message of the first chain", msg.header)
+	}
+	if !bytes.Equal(msg.ciphertext, mustHex(t, "add6fa77a1a1cf52b688bd89d68536d00a6940c153")) {
+		t.Errorf("ciphertext = %x", msg.ciphertext)
+	}
+
+	bob := newResponderRatchet(fixedKey(6), fixedKey(5), []byte("ad"))
+	receive(t, bob, msg, "hello")
+}
+
+func TestRatchetInOrder(t *testing.T) {
+	alice, bob := newSessionPair(t)
+	if _, _, err := bob.encrypt([]byte("too early"), nil); !errors.Is(err, errCannotSend) {
+		t.Fatalf("responder sent before receiving: %v", err)
+	}
+	for _, text := range []string{"one", "two", "three"} {
+		receive(t, bob, send(t, alice, text), text)
+	}
+	receive(t, alice, send(t, bob, "four"), "four")
+	receive(t, bob, send(t, alice, "five"), "five")
+	receive(t, alice, send(t, bob, "six"), "six")
+}
+
+func TestRatchetOutOfOrder(t *testing.T) {
+	alice, bob := newSessionPair(t)
+	first := send(t, alice, "one")
+	second := send(t, alice, "two")
+	third := send(t, alice, "three")
+	receive(t, bob, third, "three")
+	receive(t, bob, first, "one")
+
+	// a message of the previous chain arrives after the peer replied
+	receive(t, alice, send(t, bob, "four"), "four")
+	fifth := send(t, alice, "five")
+	receive(t, bob, fifth, "five")
+	receive(t, bob, second, "two")
+
+	if _, err := bob.decrypt(second.header, second.ciphertext, []byte("aad")); err == nil {
+		t.Error("a message decrypted twice")
+	}
+}
+
+func TestRatchetMaxSkip(t *testing.T) {
+	alice, bob := newSessionPair(t)
+	receive(t, bob, send(t, alice, "first"), "first")
+
+	far := send(t, alice, "far")
+	far.header.N = bob.Nr + maxSkip + 1
+	if _, err := bob.decrypt(far.header, far.ciphertext, []byte("aad")); !errors.Is(err, errTooManySkipped) {
+		t.Fatalf("skipping more than maxSkip: %v", err)
+	}
+	if len(bob.Skipped) != 0 {
+		t.Fatalf("the failed message left %d skipped keys behind", len(bob.Skipped))
+	}
+
+	// skipping exactly maxSkip keys, the one of far included, is fine
+	var last sentMessage
+	for i := 0; i < maxSkip; i++ {
+		last = send(t, alice, "next")
+	}
+	receive(t, bob, last, "next")
+	if len(bob.Skipped) != maxSkip {
+		t.Fatalf("%d skipped keys, want %d", len(bob.Skipped), maxSkip)
+	}
+}
+
+func TestRatchetRejectsTampering(t *testing.T) {
+	alice, bob := newSessionPair(t)
+	msg := send(t, alice, "hello")
+
+	ciphertext := append([]byte{}, msg.ciphertext...)
+	ciphertext[0] ^= 1
+	header := msg.header
+	header.PN++
+	tampered := []struct {
+		name       string
+		header     ratchetHeader
+		ciphertext []byte
+		aad        string
+	}{
+		{"ciphertext", msg.header, ciphertext, "aad"},
+		{"header", header, msg.ciphertext, "aad"},
+		{"associated data", msg.header, msg.ciphertext, "other"},
+	}
+	for _, tc := range tampered {
+		if _, err := bob.decrypt(tc.header, tc.ciphertext, []byte(tc.aad)); err == nil {
+			t.Errorf("tampered %s decrypted", tc.name)
+		}
+	}
+	// the failures did not change the state
+	receive(t, bob, msg, "hello")
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/google/uuid"
+)
+
+// publicChatRoomId is the room everybody can read and write.
+const publicChatRoomId = "00000000001"
+
+// defaultRoomIdKey is the ROOM_ID_KEY of every install that does not set
+// its own, so direct rooms work out of the box and between installs.
+// The key is no secret: it ships with the app, and so does any key a
+// deployment hands to its users. Anybody who has the app can work out
+// which two users a direct room id belongs to by trying the pairs of
+// users they know. The key only keeps the ids opaque to somebody who
+// watches the broker without the app. A deployment that sets its own
+// key has to give the same one to all its apps and gateways, and the
+// direct rooms derived from the old key are not found under the new one.
+const defaultRoomIdKey = "messenger direct rooms, version 1"
+
+// roomIdPattern matches every id a room can have: the public room,
+// the uuids of groups and the keyed hashes of direct rooms. Dots and
+// the topic wildcards are never allowed, since the id becomes part of
+// a routing key.
+var roomIdPattern = regexp.MustCompile(`^[0-9a-f][0-9a-f-]{7,63}$`)
+
+var (
+	errInvalidRoomId = errors.New("invalid chat room id")
+	errInvalidUserId = errors.New("invalid user id")
+	errSameUser      = errors.New("cannot create a chat room with yourself")
+	errNoRoomIdKey   = errors.New("ROOM_ID_KEY is not configured")
+)
+
+// validateRoomId checks that the id is a well formed room id.
+func validateRoomId(id string) error {
+	if !roomIdPattern.MatchString(id) {
+		return fmt.Errorf("%w: %q", errInvalidRoomId, id)
+	}
+	return nil
+}
+
+// normalizeUserId validates a Supabase user id and returns it in its
+// canonical dashed form, so the same user always yields the same room.
+func normalizeUserId(id string) (string, error) {
+	parsed, err := uuid.Parse(id)
+	if err != nil {
+		return "", fmt.Errorf("%w: %q", errInvalidUserId, id)
+	}
+	return parsed.String(), nil
+}
+
+// directRoomId derives the id of the room two users chat in. It is a
+// keyed hash of both ids, so it is the same for both users but reveals
+// neither of them to somebody who watches the broker without the app,
+// see defaultRoomIdKey for everybody else.
+func directRoomId(key []byte, userA, userB string) (string, error) {
+	if len(key) == 0 {
+		return "", errNoRoomIdKey
+	}
+	a, err := normalizeUserId(userA)
+	if err != nil {
+		return "", err
+	}
+	b, err := normalizeUserId(userB)
+	if err != nil {
+		return "", err
+	}
+	if a == b {
+		return "", errSameUser
+	}
+	if b < a {
+		a, b = b, a
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("messenger direct room\x00" + a + "\x00" + b))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
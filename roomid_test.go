@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDirectRoomId(t *testing.T) {
+	key := []byte(defaultRoomIdKey)
+	id, err := directRoomId(key, aliceId, bobId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateRoomId(id); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(id, aliceId) || strings.Contains(id, bobId) {
+		t.Fatalf("%s reveals the users", id)
+	}
+
+	// both users and any spelling of the ids end up in the same room
+	for _, pair := range [][2]string{{bobId, aliceId}, {strings.ToUpper(aliceId), bobId}} {
+		if other, err := directRoomId(key, pair[0], pair[1]); err != nil || other != id {
+			t.Errorf("%v: %s, %v, want %s", pair, other, err, id)
+		}
+	}
+	if other, _ := directRoomId([]byte("another key of the deployment"), aliceId, bobId); other == id {
+		t.Error("another key derives the same room")
+	}
+	if other, _ := directRoomId(key, aliceId, carolId); other == id {
+		t.Error("another user derives the same room")
+	}
+
+	for _, tc := range []struct {
+		key          []byte
+		userA, userB string
+		want         error
+	}{
+		{nil, aliceId, bobId, errNoRoomIdKey},
+		{key, aliceId, strings.ToUpper(aliceId), errSameUser},
+		{key, aliceId, "bob", errInvalidUserId},
+	} {
+		if _, err := directRoomId(tc.key, tc.userA, tc.userB); !errors.Is(err, tc.want) {
+			t.Errorf("%q and %q: %v, want %v", tc.userA, tc.userB, err, tc.want)
+		}
+	}
+}
+
+func TestValidateRoomId(t *testing.T) {
+	direct, err := directRoomId([]byte(defaultRoomIdKey), aliceId, bobId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{publicChatRoomId, groupId, direct} {
+		if err := validateRoomId(id); err != nil {
+			t.Errorf("%s: %v", id, err)
+		}
+	}
+	for _, id := range []string{"", "1234567", "-0000000001", "0000.0001", "00000000#", "00000000*", strings.ToUpper(groupId), direct + "0"} {
+		if err := validateRoomId(id); !errors.Is(err, errInvalidRoomId) {
+			t.Errorf("%q: %v", id, err)
+		}
+	}
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	utils "github.com/benni347/messengerutils"
+	"github.com/google/uuid"
+)
+
+const (
+	// roomContentType marks envelopes which carry a Room
+	// instead of a chat message.
+	roomContentType = "application/vnd.messenger.room+json"
+	// roomUpdatedEvent is emitted with the Room whenever
+	// a room was created or its members changed.
+	roomUpdatedEvent = "room:updated"
+	// roomRemovedEvent is emitted with the room id once
+	// the current user is no longer a member of it.
+	roomRemovedEvent = "room:removed"
+)
+
+// RoomRole is the role of a member within a room.
+type RoomRole string
+
+const (
+	RoleOwner  RoomRole = "owner"
+	RoleAdmin  RoomRole = "admin"
+	RoleMember RoomRole = "member"
+)
+
+var (
+	errNotSignedIn   = errors.New("not signed in")
+	errUnknownRoom   = errors.New("unknown chat room")
+	errNotAMember    = errors.New("not a member of the chat room")
+	errNotPermitted  = errors.New("not permitted to change the members of the chat room")
+	errAlreadyMember = errors.New("already a member of the chat room")
+	errEmptyRoomName = errors.New("the room name must not be empty")
+	errLeaveDirect   = errors.New("a direct chat room cannot be left")
+)
+
+// RoomMember is a user taking part in a room.
+type RoomMember struct {
+	UserId string   `json:"userId"`
+	Role   RoomRole `json:"role"`
+}
+
+// Room is a chat room with any number of members.
+// Direct rooms are between exactly two users and cannot be managed.
+type Room struct {
+	Id        string       `json:"id"`
+	Name      string       `json:"name"`
+	CreatedBy string       `json:"createdBy"`
+	Direct    bool         `json:"direct"`
+	Members   []RoomMember `json:"members"`
+}
+
+// member returns the member with the given user id.
+func (r *Room) member(userId string) (RoomMember, bool) {
+	for _, m := range r.Members {
+		if m.UserId == userId {
+			return m, true
+		}
+	}
+	return RoomMember{}, false
+}
+
+// canManage reports whether the user may add and remove members.
+func (r *Room) canManage(userId string) bool {
+	m, ok := r.member(userId)
+	return ok && (m.Role == RoleOwner || m.Role == RoleAdmin)
+}
+
+// canRemove reports whether the user may remove the member. The owner
+// removes admins and members, admins only members, and nobody removes
+// the owner, who leaves instead.
+func (r *Room) canRemove(userId, memberId string) bool {
+	actor, ok := r.member(userId)
+	if !ok || userId == memberId {
+		return false
+	}
+	target, ok := r.member(memberId)
+	if !ok {
+		return false
+	}
+	switch actor.Role {
+	case RoleOwner:
+		return target.Role != RoleOwner
+	case RoleAdmin:
+		return target.Role == RoleMember
+	}
+	return false
+}
+
+// withoutMember returns a copy of the room without the user. If the
+// owner leaves, the longest standing admin or member takes over.
+func (r Room) withoutMember(userId string) Room {
+	members := make([]RoomMember, 0, len(r.Members))
+	var wasOwner bool
+	for _, m := range r.Members {
+		if m.UserId == userId {
+			wasOwner = m.Role == RoleOwner
+			continue
+		}
+		members = append(members, m)
+	}
+	if wasOwner && len(members) > 0 {
+		next := 0
+		for i, m := range members {
+			if m.Role == RoleAdmin {
+				next = i
+				break
+			}
+		}
+		members[next].Role = RoleOwner
+	}
+	r.Members = members
+	return r
+}
+
+// isLeave reports whether the update is nothing but the member leaving
+// the room, which every member may do without managing it.
+func (r Room) isLeave(update Room, userId string) bool {
+	if _, ok := r.member(userId); !ok {
+		return false
+	}
+	return r.withoutMember(userId).equal(update)
+}
+
+// allowsUpdate reports whether the user may turn the room into the
+// update. Every member may leave, owners and admins may add members and
+// remove the ones canRemove allows. The name, the creator and the roles
+// of the remaining members never change this way, direct rooms not at
+// all.
+func (r Room) allowsUpdate(update Room, userId string) bool {
+	if r.Direct || update.Direct {
+		return false
+	}
+	if r.isLeave(update, userId) {
+		return true
+	}
+	if !r.canManage(userId) || update.Id != r.Id || update.Name != r.Name || update.CreatedBy != r.CreatedBy {
+		return false
+	}
+	for _, m := range r.Members {
+		next, ok := update.member(m.UserId)
+		if !ok && !r.canRemove(userId, m.UserId) {
+			return false
+		}
+		if ok && next.Role != m.Role {
+			return false
+		}
+	}
+	for _, m := range update.Members {
+		if _, ok := r.member(m.UserId); !ok && m.Role != RoleMember {
+			return false
+		}
+	}
+	return true
+}
+
+// isNewGroup reports whether the room is a group as the user created
+// it: its id is a uuid, the user is its creator and only owner,
+// everybody else a member. Only its creator introduces a room nobody
+// knows yet, and the id keeps it from passing off a direct room.
+func (r Room) isNewGroup(userId string) bool {
+	if r.Direct || r.CreatedBy != userId || strings.TrimSpace(r.Name) == "" {
+		return false
+	}
+	if id, err := uuid.Parse(r.Id); err != nil || id.String() != r.Id {
+		return false
+	}
+	for _, m := range r.Members {
+		if (m.UserId == userId) != (m.Role == RoleOwner) {
+			return false
+		}
+		if m.Role != RoleOwner && m.Role != RoleMember {
+			return false
+		}
+	}
+	_, ok := r.member(userId)
+	return ok
+}
+
+// equal reports whether both rooms are the same, members in the same order.
+func (r Room) equal(other Room) bool {
+	if r.Id != other.Id || r.Name != other.Name || r.CreatedBy != other.CreatedBy ||
+		r.Direct != other.Direct || len(r.Members) != len(other.Members) {
+		return false
+	}
+	for i, m := range r.Members {
+		if other.Members[i] != m {
+			return false
+		}
+	}
+	return true
+}
+
+// newGroupRoom creates a room with an opaque id owned by the creator.
+func newGroupRoom(name, creator string, memberIds []string) (Room, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return Room{}, errEmptyRoomName
+	}
+	room := Room{
+		Id:        uuid.NewString(),
+		Name:      name,
+		CreatedBy: creator,
+		Members:   []RoomMember{{UserId: creator, Role: RoleOwner}},
+	}
+	for _, id := range memberIds {
+		if strings.TrimSpace(id) == "" {
+			continue
+		}
+		id, err := normalizeUserId(id)
+		if err != nil {
+			return Room{}, err
+		}
+		if _, ok := room.member(id); ok {
+			continue
+		}
+		room.Members = append(room.Members, RoomMember{UserId: id, Role: RoleMember})
+	}
+	return room, nil
+}
+
+// newDirectRoom creates the room two users chat in.
+func newDirectRoom(id, creator, other string) Room {
+	return Room{
+		Id:        id,
+		CreatedBy: creator,
+		Direct:    true,
+		Members: []RoomMember{
+			{UserId: creator, Role: RoleMember},
+			{UserId: other, Role: RoleMember},
+		},
+	}
+}
+
+// encodeRoom wraps a room in an envelope so every member learns about it.
+func encodeRoom(room Room, sender string) (Message, error) {
+	body, err := json.Marshal(room)
+	if err != nil {
+		return Message{}, err
+	}
+	msg := newMessage(room.Id, sender, string(body))
+	msg.ContentType = roomContentType
+	return msg, nil
+}
+
+// decodeRoom reads the room carried by an envelope.
+func decodeRoom(msg Message) (Room, error) {
+	var room Room
+	if err := json.Unmarshal([]byte(msg.Message), &room); err != nil {
+		return Room{}, fmt.Errorf("%w: %v", errMalformedMessage, err)
+	}
+	if room.Id != msg.ChatRoomId {
+		return Room{}, fmt.Errorf("%w: room id does not match", errMalformedMessage)
+	}
+	seen := make(map[string]bool, len(room.Members))
+	for _, member := range room.Members {
+		if _, err := normalizeUserId(member.UserId); err != nil {
+			return Room{}, fmt.Errorf("%w: %v", errMalformedMessage, err)
+		}
+		if seen[member.UserId] {
+			return Room{}, fmt.Errorf("%w: %s is listed twice", errMalformedMessage, member.UserId)
+		}
+		seen[member.UserId] = true
+	}
+	return room, nil
+}
+
+// roomDirectory holds the rooms the current user knows about. Once
+// loaded from a path, every change is saved there, so the groups are
+// still known after a restart.
+type roomDirectory struct {
+	mu    sync.Mutex
+	path  string
+	rooms map[string]Room
+}
+
+func newRoomDirectory() *roomDirectory {
+	return &roomDirectory{rooms: make(map[string]Room)}
+}
+
+// configDir is the directory the app keeps its local state in.
+func configDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "messenger"), nil
+}
+
+// writePrivateFile writes a file only the current user can read.
+func writePrivateFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+// roomsPath is where the rooms of the user are stored.
+func roomsPath(userId string) (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "rooms-"+userId+".json"), nil
+}
+
+// load replaces the rooms with the ones stored at the path. An empty
+// path forgets all rooms and keeps the next ones in memory only.
+func (d *roomDirectory) load(path string) error {
+	rooms := make(map[string]Room)
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, &rooms); err != nil {
+				return fmt.Errorf("reading %s: %w", path, err)
+			}
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.path = path
+	d.rooms = rooms
+	return nil
+}
+
+// save writes the rooms to the path. The caller must hold the lock.
+func (d *roomDirectory) save() {
+	if d.path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(d.rooms, "", "  ")
+	if err == nil {
+		err = writePrivateFile(d.path, data)
+	}
+	if err != nil {
+		utils.PrintError("Failed to save the chat rooms", err)
+	}
+}
+
+func (d *roomDirectory) get(id string) (Room, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	room, ok := d.rooms[id]
+	return room, ok
+}
+
+func (d *roomDirectory) put(room Room) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rooms[room.Id] = room
+	d.save()
+}
+
+func (d *roomDirectory) remove(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.rooms, id)
+	d.save()
+}
+
+// list returns all rooms sorted by name.
+func (d *roomDirectory) list() []Room {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	rooms := make([]Room, 0, len(d.rooms))
+	for _, room := range d.rooms {
+		rooms = append(rooms, room)
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].Name < rooms[j].Name
+	})
+	return rooms
+}
+
+// CreateGroup creates a group chat room with the signed in user as owner
+func (a *App) CreateGroup(name string, memberIds []string) (Room, error) {
+	creator := a.getSenderId()
+	if creator == "" {
+		return Room{}, errNotSignedIn
+	}
+	room, err := newGroupRoom(name, creator, memberIds)
+	if err != nil {
+		return Room{}, err
+	}
+	a.rooms.put(room)
+	a.announceRoom(room)
+	return room, nil
+}
+
+// GetRoom returns the room with the given id
+func (a *App) GetRoom(roomId string) (Room, error) {
+	room, ok := a.rooms.get(roomId)
+	if !ok {
+		return Room{}, errUnknownRoom
+	}
+	return room, nil
+}
+
+// GetRooms returns all chat rooms the user is a member of
+func (a *App) GetRooms() []Room {
+	return a.rooms.list()
+}
+
+// AddMember adds a user to a group, only owners and admins may do so
+func (a *App) AddMember(roomId, userId string) (Room, error) {
+	room, err := a.managedRoom(roomId)
+	if err != nil {
+		return Room{}, err
+	}
+	userId, err = normalizeUserId(userId)
+	if err != nil {
+		return Room{}, err
+	}
+	if _, ok := room.member(userId); ok {
+		return Room{}, errAlreadyMember
+	}
+	member := RoomMember{UserId: userId, Role: RoleMember}
+	room.Members = append(append([]RoomMember{}, room.Members...), member)
+	a.rooms.put(room)
+	a.announceRoom(room)
+	return room, nil
+}
+
+// RemoveMember removes a user from a group, only owners and admins may do so
+func (a *App) RemoveMember(roomId, userId string) (Room, error) {
+	room, err := a.managedRoom(roomId)
+	if err != nil {
+		return Room{}, err
+	}
+	userId, err = normalizeUserId(userId)
+	if err != nil {
+		return Room{}, err
+	}
+	if _, ok := room.member(userId); !ok {
+		return Room{}, errNotAMember
+	}
+	if !room.canRemove(a.getSenderId(), userId) {
+		return Room{}, errNotPermitted
+	}
+	room = room.withoutMember(userId)
+	a.rooms.put(room)
+	a.announceRoom(room)
+	if err := a.unsubscribe(room.Id, userId); err != nil {
+		utils.PrintError("Failed to stop delivering the room to "+userId, err)
+	}
+	return room, nil
+}
+
+// LeaveRoom removes the signed in user from a group
+func (a *App) LeaveRoom(roomId string) error {
+	me := a.getSenderId()
+	room, ok := a.rooms.get(roomId)
+	if !ok {
+		return errUnknownRoom
+	}
+	if room.Direct {
+		return errLeaveDirect
+	}
+	if _, ok := room.member(me); !ok {
+		return errNotAMember
+	}
+	a.announceRoom(room.withoutMember(me))
+	a.rooms.remove(roomId)
+	if err := a.unsubscribe(roomId, me); err != nil {
+		utils.PrintError("Failed to stop delivering the room to "+me, err)
+	}
+	return nil
+}
+
+// loadRooms switches to the rooms of the user, none if nobody is
+// signed in.
+func (a *App) loadRooms(userId string) {
+	path := ""
+	if userId != "" {
+		var err error
+		if path, err = roomsPath(userId); err != nil {
+			utils.PrintError("Failed to load the chat rooms", err)
+		}
+	}
+	if err := a.rooms.load(path); err != nil {
+		utils.PrintError("Failed to load the chat rooms", err)
+		// never keep the rooms of the previous user, nor overwrite the file
+		a.rooms.load("")
+	}
+}
+
+// authorizeRoom checks that the signed in user may use the room. The
+// public room is open to everybody, any other room needs an unexpired
+// access token of one of its members.
+func (a *App) authorizeRoom(roomId string) error {
+	if roomId == publicChatRoomId {
+		return nil
+	}
+	a.mu.Lock()
+	userId, expires := a.user.id, a.user.expires
+	a.mu.Unlock()
+	if userId == "" {
+		return errNotSignedIn
+	}
+	if time.Now().After(expires) {
+		return errTokenExpired
+	}
+	room, ok := a.rooms.get(roomId)
+	if !ok {
+		return errUnknownRoom
+	}
+	if _, ok := room.member(userId); !ok {
+		return errNotAMember
+	}
+	return nil
+}
+
+// managedRoom returns the room if the signed in user may change its members.
+func (a *App) managedRoom(roomId string) (Room, error) {
+	room, ok := a.rooms.get(roomId)
+	if !ok {
+		return Room{}, errUnknownRoom
+	}
+	if room.Direct || !room.canManage(a.getSenderId()) {
+		return Room{}, errNotPermitted
+	}
+	return room, nil
+}
+
+// announceRoom sends the room to all its members.
+func (a *App) announceRoom(room Room) {
+	msg, err := encodeRoom(room, a.getSenderId())
+	if err != nil {
+		utils.PrintError("Failed to encode the room", err)
+		return
+	}
+	if err := a.seal(&msg); err != nil {
+		utils.PrintError("Failed to sign the room", err)
+		return
+	}
+	a.deliveries.add(msg)
+	a.sendOrQueue(msg)
+}
+
+// applyRoomUpdate takes over a room announced by another member,
+// provided the sender was allowed to make the change. A room the user
+// does not know yet has to be announced by its creator. Direct rooms
+// are never announced, both users derive them.
+func (a *App) applyRoomUpdate(msg Message) error {
+	room, err := decodeRoom(msg)
+	if err != nil {
+		return err
+	}
+	if known, ok := a.rooms.get(room.Id); ok {
+		if !known.allowsUpdate(room, msg.Sender) {
+			return errNotPermitted
+		}
+	} else if !room.isNewGroup(msg.Sender) {
+		return errNotPermitted
+	}
+	if _, ok := room.member(a.getSenderId()); !ok {
+		a.rooms.remove(room.Id)
+		a.emit(roomRemovedEvent, room.Id)
+		return nil
+	}
+	a.rooms.put(room)
+	a.emit(roomUpdatedEvent, room)
+	return nil
+}
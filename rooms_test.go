@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+const (
+	ownerId    = "0a1b2c3d-4e5f-4a6b-8c7d-9e0f1a2b3c4d"
+	adminId    = "1b2c3d4e-5f6a-4b7c-8d9e-0f1a2b3c4d5e"
+	meId       = "2c3d4e5f-6a7b-4c8d-9e0f-1a2b3c4d5e6f"
+	memberId   = "3d4e5f6a-7b8c-4d9e-8f1a-2b3c4d5e6f7a"
+	newcomerId = "4e5f6a7b-8c9d-4e0f-9a2b-3c4d5e6f7a8b"
+)
+
+// newRoomApp returns an app signed in as me that knows the rooms.
+func newRoomApp(rooms ...Room) *App {
+	a := NewApp(Config{RoomIdKey: "a room id key for the tests"}, nil)
+	a.events = func(string, interface{}) {}
+	a.user.id = meId
+	for _, room := range rooms {
+		a.rooms.put(room)
+	}
+	return a
+}
+
+// testGroup is the group of owner with admin, me and member.
+func testGroup() Room {
+	return Room{
+		Id:        groupId,
+		Name:      "friends",
+		CreatedBy: ownerId,
+		Members: []RoomMember{
+			{UserId: ownerId, Role: RoleOwner},
+			{UserId: adminId, Role: RoleAdmin},
+			{UserId: meId, Role: RoleMember},
+			{UserId: memberId, Role: RoleMember},
+		},
+	}
+}
+
+func roomUpdate(t *testing.T, room Room, sender string) Message {
+	t.Helper()
+	msg, err := encodeRoom(room, sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestApplyUnknownRoom(t *testing.T) {
+	direct, err := directRoomId([]byte("a room id key for the tests"), meId, ownerId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherOwner := testGroup()
+	otherOwner.Members[0].Role, otherOwner.Members[1].Role = RoleMember, RoleOwner
+	withAdmin := testGroup()
+	unnamed := testGroup()
+	unnamed.Name = " "
+	directId := Room{Id: direct, Name: "friends", CreatedBy: ownerId, Members: []RoomMember{{ownerId, RoleOwner}, {meId, RoleMember}}}
+
+	tests := []struct {
+		name   string
+		room   Room
+		sender string
+		want   error
+	}{
+		{"announced by its creator", Room{Id: groupId, Name: "friends", CreatedBy: ownerId, Members: []RoomMember{{ownerId, RoleOwner}, {meId, RoleMember}}}, ownerId, nil},
+		{"made up creator", testGroup(), memberId, errNotPermitted},
+		{"creator is not the owner", otherOwner, ownerId, errNotPermitted},
+		{"created with an admin", withAdmin, ownerId, errNotPermitted},
+		{"without a name", unnamed, ownerId, errNotPermitted},
+		{"direct room", newDirectRoom(direct, ownerId, meId), ownerId, errNotPermitted},
+		{"group with the id of a direct room", directId, ownerId, errNotPermitted},
+	}
+	for _, tc := range tests {
+		a := newRoomApp()
+		if err := a.applyRoomUpdate(roomUpdate(t, tc.room, tc.sender)); !errors.Is(err, tc.want) {
+			t.Errorf("%s: %v, want %v", tc.name, err, tc.want)
+		}
+		_, known := a.rooms.get(tc.room.Id)
+		if known != (tc.want == nil) {
+			t.Errorf("%s: the room is known %v", tc.name, known)
+		}
+	}
+}
+
+func TestApplyRoomUpdate(t *testing.T) {
+	change := func(f func(r *Room)) Room {
+		room := testGroup()
+		room.Members = append([]RoomMember{}, room.Members...)
+		f(&room)
+		return room
+	}
+	tests := []struct {
+		name   string
+		update Room
+		sender string
+		want   error
+	}{
+		{"admin adds a member", change(func(r *Room) { r.Members = append(r.Members, RoomMember{newcomerId, RoleMember}) }), adminId, nil},
+		{"admin adds an admin", change(func(r *Room) { r.Members = append(r.Members, RoomMember{newcomerId, RoleAdmin}) }), adminId, errNotPermitted},
+		{"admin removes a member", testGroup().withoutMember(memberId), adminId, nil},
+		{"admin removes the owner", testGroup().withoutMember(ownerId), adminId, errNotPermitted},
+		{"owner removes the admin", testGroup().withoutMember(adminId), ownerId, nil},
+		{"admin takes over", change(func(r *Room) { r.Members[0].Role, r.Members[1].Role = RoleAdmin, RoleOwner }), adminId, errNotPermitted},
+		{"admin promotes a member", change(func(r *Room) { r.Members[3].Role = RoleAdmin }), adminId, errNotPermitted},
+		{"admin renames", change(func(r *Room) { r.Name = "enemies" }), adminId, errNotPermitted},
+		{"admin changes the creator", change(func(r *Room) { r.CreatedBy = adminId }), adminId, errNotPermitted},
+		{"admin makes it direct", change(func(r *Room) { r.Direct = true }), adminId, errNotPermitted},
+		{"member adds somebody", change(func(r *Room) { r.Members = append(r.Members, RoomMember{newcomerId, RoleMember}) }), memberId, errNotPermitted},
+		{"member leaves", testGroup().withoutMember(memberId), memberId, nil},
+		{"member leaves and removes another", testGroup().withoutMember(memberId).withoutMember(adminId), memberId, errNotPermitted},
+		{"owner leaves", testGroup().withoutMember(ownerId), ownerId, nil},
+	}
+	for _, tc := range tests {
+		a := newRoomApp(testGroup())
+		if err := a.applyRoomUpdate(roomUpdate(t, tc.update, tc.sender)); !errors.Is(err, tc.want) {
+			t.Errorf("%s: %v, want %v", tc.name, err, tc.want)
+			continue
+		}
+		room, _ := a.rooms.get(groupId)
+		if tc.want == nil && !room.equal(tc.update) {
+			t.Errorf("%s: the room is %+v", tc.name, room)
+		}
+		if tc.want != nil && !room.equal(testGroup()) {
+			t.Errorf("%s: the refused update changed the room to %+v", tc.name, room)
+		}
+	}
+
+	// an update without the user removes the room
+	a := newRoomApp(testGroup())
+	if err := a.applyRoomUpdate(roomUpdate(t, testGroup().withoutMember(meId), adminId)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.rooms.get(groupId); ok {
+		t.Error("the room is kept after the user was removed")
+	}
+}
+
+func TestDecodeRoomRejectsDuplicateMembers(t *testing.T) {
+	room := testGroup()
+	room.Members = append(room.Members, RoomMember{memberId, RoleAdmin})
+	if _, err := decodeRoom(roomUpdate(t, room, ownerId)); !errors.Is(err, errMalformedMessage) {
+		t.Errorf("duplicate member: %v", err)
+	}
+}
+
+func TestLeaveAndRemoveLimits(t *testing.T) {
+	direct, err := directRoomId([]byte("a room id key for the tests"), meId, ownerId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newRoomApp(newDirectRoom(direct, meId, ownerId))
+	if err := a.LeaveRoom(direct); !errors.Is(err, errLeaveDirect) {
+		t.Errorf("leaving a direct room: %v", err)
+	}
+
+	group := testGroup()
+	group.Members[2].Role = RoleAdmin
+	a = newRoomApp(group)
+	for _, target := range []string{ownerId, adminId} {
+		if _, err := a.RemoveMember(groupId, target); !errors.Is(err, errNotPermitted) {
+			t.Errorf("an admin removes %s: %v", target, err)
+		}
+	}
+}
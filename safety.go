@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// safetyNumberVersion is part of every fingerprint and QR payload,
+	// so the derivation can change without old numbers matching new ones.
+	safetyNumberVersion = 0
+	// safetyNumberIterations makes brute forcing a key with a matching
+	// fingerprint expensive.
+	safetyNumberIterations = 5200
+)
+
+var errNotDirect = errors.New("safety numbers only exist for direct rooms")
+
+// SafetyNumber lets two users confirm they see the same keys, either by
+// comparing the digits or by scanning the QR payload of the other.
+type SafetyNumber struct {
+	ChatRoomId string `json:"chatRoomId"`
+	UserId     string `json:"userId"`
+	Digits     string `json:"digits"`
+	QrPayload  string `json:"qrPayload"`
+	Verified   bool   `json:"verified"`
+}
+
+// identityKeyBytes are the public keys that make up an identity.
+func identityKeyBytes(keys contactKeys) []byte {
+	return append(append([]byte{}, keys.signing...), keys.exchange.Bytes()...)
+}
+
+// fingerprint derives the fingerprint of one user by hashing the
+// identity keys and user id over and over.
+func fingerprint(userId string, keys []byte) []byte {
+	hash := sha512.New()
+	hash.Write([]byte{0, safetyNumberVersion})
+	hash.Write(keys)
+	hash.Write([]byte(userId))
+	sum := hash.Sum(nil)
+	for i := 0; i < safetyNumberIterations; i++ {
+		hash.Reset()
+		hash.Write(sum)
+		hash.Write(keys)
+		sum = hash.Sum(sum[:0])
+	}
+	return sum[:32]
+}
+
+// fingerprintDigits encodes the first 30 bytes of a fingerprint as six
+// groups of five digits.
+func fingerprintDigits(fp []byte) string {
+	var digits strings.Builder
+	for i := 0; i < 30; i += 5 {
+		var chunk uint64
+		for _, b := range fp[i : i+5] {
+			chunk = chunk<<8 | uint64(b)
+		}
+		fmt.Fprintf(&digits, "%05d", chunk%100000)
+	}
+	return digits.String()
+}
+
+// safetyNumber combines the fingerprints of both users. They are sorted,
+// so both sides of the room end up with the same number and payload.
+func safetyNumber(userA string, keysA contactKeys, userB string, keysB contactKeys) (string, string) {
+	a := fingerprint(userA, identityKeyBytes(keysA))
+	b := fingerprint(userB, identityKeyBytes(keysB))
+	if bytes.Compare(a, b) > 0 {
+		a, b = b, a
+	}
+
+	all := fingerprintDigits(a) + fingerprintDigits(b)
+	groups := make([]string, 0, len(all)/5)
+	for i := 0; i < len(all); i += 5 {
+		groups = append(groups, all[i:i+5])
+	}
+
+	payload := append([]byte{safetyNumberVersion}, a...)
+	payload = append(payload, b...)
+	return strings.Join(groups, " "), base64.StdEncoding.EncodeToString(payload)
+}
+
+// GetSafetyNumber returns the safety number of a direct room, which
+// both participants compare to make sure nobody sits in between
+func (a *App) GetSafetyNumber(chatRoomId string) (SafetyNumber, error) {
+	own, peerId, peer, err := a.directRoomKeys(chatRoomId)
+	if err != nil {
+		return SafetyNumber{}, err
+	}
+	digits, payload := safetyNumber(a.getSenderId(), own, peerId, peer)
+	return SafetyNumber{
+		ChatRoomId: chatRoomId,
+		UserId:     peerId,
+		Digits:     digits,
+		QrPayload:  payload,
+		Verified:   a.getTrustStore().isVerified(peerId),
+	}, nil
+}
+
+// CompareSafetyNumber reports whether a scanned QR payload matches
+// the safety number of the room
+func (a *App) CompareSafetyNumber(chatRoomId string, qrPayload string) (bool, error) {
+	number, err := a.GetSafetyNumber(chatRoomId)
+	if err != nil {
+		return false, err
+	}
+	return number.QrPayload == strings.TrimSpace(qrPayload), nil
+}
+
+// VerifyContact marks the other participant of a direct room as
+// verified, after the users confirmed their safety numbers match
+func (a *App) VerifyContact(chatRoomId string) error {
+	_, peerId, peer, err := a.directRoomKeys(chatRoomId)
+	if err != nil {
+		return err
+	}
+	return a.getTrustStore().verify(peer.profile(peerId))
+}
+
+// directRoomKeys returns the keys of the user and the pinned keys of
+// the other participant of a direct room.
+func (a *App) directRoomKeys(chatRoomId string) (contactKeys, string, contactKeys, error) {
+	room, ok := a.rooms.get(chatRoomId)
+	if !ok {
+		return contactKeys{}, "", contactKeys{}, errUnknownRoom
+	}
+	if !room.Direct {
+		return contactKeys{}, "", contactKeys{}, errNotDirect
+	}
+	id := a.getIdentity()
+	if id == nil || a.getTrustStore() == nil {
+		return contactKeys{}, "", contactKeys{}, errNoIdentity
+	}
+	peerId, err := a.GetOtherUserId(chatRoomId, a.getSenderId())
+	if err != nil {
+		return contactKeys{}, "", contactKeys{}, err
+	}
+	peer, err := a.contactKeys(peerId)
+	if err != nil {
+		return contactKeys{}, "", contactKeys{}, err
+	}
+	own := contactKeys{
+		exchange: id.exchange.PublicKey(),
+		signing:  id.signing.Public().(ed25519.PublicKey),
+	}
+	return own, peerId, peer, nil
+}
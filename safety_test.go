@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func publicKeysOf(id *identity) contactKeys {
+	return contactKeys{exchange: id.exchange.PublicKey(), signing: id.signing.Public().(ed25519.PublicKey)}
+}
+
+func TestSafetyNumber(t *testing.T) {
+	alice := publicKeysOf(fixedIdentity(t, 9, 13))
+	bob := publicKeysOf(fixedIdentity(t, 7, 8))
+	carol := publicKeysOf(fixedIdentity(t, 5, 6))
+
+	digits, payload := safetyNumber(aliceId, alice, bobId, bob)
+	if !regexp.MustCompile(`^\d{5}( \d{5}){11}$`).MatchString(digits) {
+		t.Fatalf("digits %q are not twelve groups of five", digits)
+	}
+	raw, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil || len(raw) != 65 || raw[0] != safetyNumberVersion {
+		t.Fatalf("payload %q: %v", payload, err)
+	}
+
+	// both sides see the same number
+	if otherDigits, otherPayload := safetyNumber(bobId, bob, aliceId, alice); otherDigits != digits || otherPayload != payload {
+		t.Errorf("bob sees %s, alice %s", otherDigits, digits)
+	}
+	// somebody in between with other keys, or another user with the same
+	// keys, shows as another number
+	if other, _ := safetyNumber(aliceId, alice, bobId, carol); other == digits {
+		t.Error("other keys give the same number")
+	}
+	if other, _ := safetyNumber(aliceId, alice, carolId, bob); other == digits {
+		t.Error("another user gives the same number")
+	}
+}
+
+func TestTrustStoreVerify(t *testing.T) {
+	store := &trustStore{path: filepath.Join(t.TempDir(), "trust.json"), entries: make(map[string]trustEntry)}
+	alice := fixedIdentity(t, 9, 13).publicKeys(aliceId)
+	replaced := fixedIdentity(t, 5, 6).publicKeys(aliceId)
+
+	if err := store.verify(alice); !errors.Is(err, errKeyChanged) {
+		t.Fatalf("verifying unknown keys: %v", err)
+	}
+	if changed, err := store.check(alice); err != nil || changed {
+		t.Fatalf("first use: %v, %v", changed, err)
+	}
+	if err := store.verify(alice); err != nil || !store.isVerified(aliceId) {
+		t.Fatalf("verifying the pinned keys: %v", err)
+	}
+
+	// new keys never take over the verified ones on their own
+	if changed, err := store.check(replaced); err != nil || !changed {
+		t.Fatalf("replaced keys: %v, %v", changed, err)
+	}
+	if err := store.verify(replaced); !errors.Is(err, errKeyChanged) {
+		t.Fatalf("verifying the replaced keys: %v", err)
+	}
+	if err := store.trust(replaced); err != nil {
+		t.Fatal(err)
+	}
+	if store.isVerified(aliceId) {
+		t.Error("trusting new keys kept the old verification")
+	}
+	if changed, _ := store.check(replaced); changed {
+		t.Error("the trusted keys count as changed")
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ratchetContentType marks envelopes whose body is a ratchetMessage,
+// encrypted for the other participant of a direct room.
+const ratchetContentType = "application/vnd.messenger.ratchet+json"
+
+// maxReceivedIds is how many ids of decrypted messages a session
+// remembers to drop replays of them.
+const maxReceivedIds = 1000
+
+var (
+	errNoSession = errors.New("no session with the sender")
+	errReplayed  = errors.New("replayed message")
+)
+
+// ratchetMessage is the body of an envelope sent within a session.
+type ratchetMessage struct {
+	Init       *x3dhHeader   `json:"init,omitempty"`
+	Header     ratchetHeader `json:"header"`
+	Ciphertext []byte        `json:"ciphertext"`
+}
+
+// session is the state of the conversation with one other user.
+type session struct {
+	State *ratchetState `json:"state"`
+	// Init is sent along with every message until the peer answered.
+	Init *x3dhHeader `json:"init,omitempty"`
+	// PeerEphemeral is the ephemeral key of the X3DH run the peer
+	// started, so the messages carrying it set up the session only once.
+	PeerEphemeral []byte `json:"peerEphemeral,omitempty"`
+	// Confirmed is set once both users use the session, from then on a
+	// message that starts another one can only be a replay.
+	Confirmed bool `json:"confirmed,omitempty"`
+	// Received are the ids of the latest decrypted messages.
+	Received []string `json:"received,omitempty"`
+}
+
+// received reports whether the message was decrypted before.
+func (s *session) received(id string) bool {
+	for _, received := range s.Received {
+		if received == id {
+			return true
+		}
+	}
+	return false
+}
+
+// receive remembers the id of a decrypted message, forgetting the
+// oldest ones beyond maxReceivedIds.
+func (s *session) receive(id string) {
+	s.Received = append(s.Received, id)
+	if len(s.Received) > maxReceivedIds {
+		s.Received = s.Received[len(s.Received)-maxReceivedIds:]
+	}
+}
+
+// sessionStore keeps the sessions of the signed in user on disk,
+// one file per peer, so past message keys never have to be kept. Like
+// the identity file next to them, the files are only protected by
+// their permissions: a key to encrypt them with would have to be
+// stored in the same place.
+type sessionStore struct {
+	dir string
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+func loadSessionStore(userId string) (*sessionStore, error) {
+	dir, err := configDir()
+	if err != nil {
+		return nil, err
+	}
+	return &sessionStore{
+		dir:      filepath.Join(dir, "sessions-"+userId),
+		sessions: make(map[string]*session),
+	}, nil
+}
+
+// get returns the session with the peer, nil if there is none.
+// The caller must hold the lock.
+func (s *sessionStore) get(peerId string) (*session, error) {
+	if sess, ok := s.sessions[peerId]; ok {
+		return sess, nil
+	}
+	path := filepath.Join(s.dir, peerId+".json")
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var sess session
+	if err := json.Unmarshal(data, &sess); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	s.sessions[peerId] = &sess
+	return &sess, nil
+}
+
+// put stores the session with the peer. The caller must hold the lock.
+func (s *sessionStore) put(peerId string, sess *session) error {
+	data, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+	if err := writePrivateFile(filepath.Join(s.dir, peerId+".json"), data); err != nil {
+		return err
+	}
+	s.sessions[peerId] = sess
+	return nil
+}
+
+// remove forgets the session with the peer, the next message starts
+// a new one.
+func (s *sessionStore) remove(peerId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, peerId)
+	err := os.Remove(filepath.Join(s.dir, peerId+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (a *App) getSessions() (*prekeyStore, *sessionStore) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.prekeys, a.sessions
+}
+
+// encrypt encrypts messages to direct rooms within the session with the
+// other participant, starting one if needed. Messages to groups and the
+// public room are left alone.
+func (a *App) encrypt(msg *Message) error {
+	room, ok := a.rooms.get(msg.ChatRoomId)
+	if !ok || !room.Direct {
+		return nil
+	}
+	own := a.getIdentity()
+	_, sessions := a.getSessions()
+	if own == nil || sessions == nil {
+		return errNoIdentity
+	}
+	peerId, err := a.GetOtherUserId(room.Id, a.getSenderId())
+	if err != nil {
+		return err
+	}
+	keys, err := a.contactKeys(peerId)
+	if err != nil {
+		return err
+	}
+
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	sess, err := sessions.get(peerId)
+	if err != nil {
+		return err
+	}
+	if sess == nil {
+		bundle, err := a.supabase.fetchPrekeyBundle(peerId, keys)
+		if err != nil {
+			return err
+		}
+		sk, init, err := x3dhInitiate(own, bundle)
+		if err != nil {
+			return err
+		}
+		state, err := newInitiatorRatchet(sk, bundle.signedPrekey, x3dhAssociatedData(own.exchange.PublicKey(), keys.exchange))
+		if err != nil {
+			return err
+		}
+		sess = &session{State: state, Init: &init}
+	}
+
+	header, ciphertext, err := sess.State.encrypt([]byte(msg.Message), messageAad(*msg))
+	if err != nil {
+		return err
+	}
+	if err := sessions.put(peerId, sess); err != nil {
+		return err
+	}
+	body, err := json.Marshal(ratchetMessage{Init: sess.Init, Header: header, Ciphertext: ciphertext})
+	if err != nil {
+		return err
+	}
+	msg.ContentType = ratchetContentType
+	msg.Message = string(body)
+	return nil
+}
+
+// decrypt decrypts a message of a direct room sent by the other
+// participant. A message that starts a new session replaces the current
+// one, except when both users started a session at the same time: then
+// the one started by the user with the lower id is kept. Once both users
+// use a session, messages that start another one are rejected as
+// replays, and so are messages that were decrypted before.
+func (a *App) decrypt(msg *Message) error {
+	own := a.getIdentity()
+	prekeys, sessions := a.getSessions()
+	if own == nil || sessions == nil || prekeys == nil {
+		return errNoIdentity
+	}
+	var body ratchetMessage
+	if err := json.Unmarshal([]byte(msg.Message), &body); err != nil {
+		return fmt.Errorf("%w: %v", errUndecryptable, err)
+	}
+	keys, err := a.contactKeys(msg.Sender)
+	if err != nil {
+		return err
+	}
+	aad := messageAad(*msg)
+
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	sess, err := sessions.get(msg.Sender)
+	if err != nil {
+		return err
+	}
+	if sess != nil && sess.received(msg.Id) {
+		return fmt.Errorf("%w: %s was already received", errReplayed, msg.Id)
+	}
+
+	var plaintext []byte
+	if body.Init != nil && (sess == nil || !bytes.Equal(sess.PeerEphemeral, body.Init.EphemeralKey)) {
+		if sess != nil && sess.Confirmed {
+			return fmt.Errorf("%w: the session with %s was already answered", errReplayed, msg.Sender)
+		}
+		sk, spk, err := x3dhRespond(own, prekeys, keys.exchange, *body.Init)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errUndecryptable, err)
+		}
+		state := newResponderRatchet(sk, spk, x3dhAssociatedData(keys.exchange, own.exchange.PublicKey()))
+		if plaintext, err = state.decrypt(body.Header, body.Ciphertext, aad); err != nil {
+			return fmt.Errorf("%w: %v", errUndecryptable, err)
+		}
+		if sess == nil || sess.Init == nil || msg.Sender < a.getSenderId() {
+			next := &session{State: state, PeerEphemeral: body.Init.EphemeralKey}
+			if sess != nil {
+				next.Received = sess.Received
+			}
+			next.receive(msg.Id)
+			if err := sessions.put(msg.Sender, next); err != nil {
+				return err
+			}
+			if body.Init.OneTimePrekeyId != nil {
+				if err := prekeys.useOneTimePrekey(*body.Init.OneTimePrekeyId); err != nil {
+					return err
+				}
+				go a.publishIdentity()
+			}
+		} else {
+			sess.receive(msg.Id)
+			if err := sessions.put(msg.Sender, sess); err != nil {
+				return err
+			}
+		}
+	} else {
+		if sess == nil {
+			return fmt.Errorf("%w: %v", errUndecryptable, errNoSession)
+		}
+		if plaintext, err = sess.State.decrypt(body.Header, body.Ciphertext, aad); err != nil {
+			return fmt.Errorf("%w: %v", errUndecryptable, err)
+		}
+		// the peer answered, so it knows the session, and a message
+		// without the X3DH header means the peer got the answer
+		sess.Init = nil
+		if body.Init == nil {
+			sess.Confirmed = true
+		}
+		sess.receive(msg.Id)
+		if err := sessions.put(msg.Sender, sess); err != nil {
+			return err
+		}
+	}
+
+	msg.ContentType = textContentType
+	msg.Message = string(plaintext)
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newSessionApp returns an app signed in as bob with the fixed prekeys
+// and the keys of alice cached, so it decrypts without Supabase.
+func newSessionApp(t *testing.T, bob, alice *identity) *App {
+	t.Helper()
+	a := NewApp(Config{}, nil)
+	a.user.id = bobId
+	a.identity = bob
+	a.prekeys = fixedPrekeys()
+	a.prekeys.path = filepath.Join(t.TempDir(), "prekeys.json")
+	a.sessions = &sessionStore{dir: t.TempDir(), sessions: make(map[string]*session)}
+	a.contacts[aliceId] = cachedContactKeys{
+		keys:    contactKeys{exchange: alice.exchange.PublicKey(), signing: alice.signing.Public().(ed25519.PublicKey)},
+		fetched: time.Now(),
+	}
+	return a
+}
+
+// sealFromAlice encrypts the text within the ratchet of alice, carrying
+// the X3DH header if init is set.
+func sealFromAlice(t *testing.T, state *ratchetState, init *x3dhHeader, id, text string) Message {
+	t.Helper()
+	msg := Message{
+		Version:    messageVersion,
+		Id:         id,
+		ChatRoomId: "direct-room",
+		Sender:     aliceId,
+		Time:       "2026-10-17T12:00:00Z",
+	}
+	header, ciphertext, err := state.encrypt([]byte(text), messageAad(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(ratchetMessage{Init: init, Header: header, Ciphertext: ciphertext})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.ContentType = ratchetContentType
+	msg.Message = string(body)
+	return msg
+}
+
+// startSession runs X3DH as alice against the bundle of bob without a
+// one-time prekey.
+func startSession(t *testing.T, alice, bob *identity, prekeys *prekeyStore) (*ratchetState, *x3dhHeader) {
+	t.Helper()
+	bundle := bundleOf(t, bob, prekeys, false)
+	sk, init, err := x3dhInitiate(alice, bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := newInitiatorRatchet(sk, bundle.signedPrekey, x3dhAssociatedData(alice.exchange.PublicKey(), bob.exchange.PublicKey()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state, &init
+}
+
+func TestDecryptRejectsReplays(t *testing.T) {
+	alice := fixedIdentity(t, 9, 13)
+	bob := fixedIdentity(t, 7, 8)
+	a := newSessionApp(t, bob, alice)
+	decrypt := func(msg Message) (string, error) {
+		err := a.decrypt(&msg)
+		return msg.Message, err
+	}
+
+	state, init := startSession(t, alice, bob, a.prekeys)
+	first := sealFromAlice(t, state, init, "m1", "hello")
+	if text, err := decrypt(first); err != nil || text != "hello" {
+		t.Fatalf("first message: %q, %v", text, err)
+	}
+	if _, err := decrypt(first); !errors.Is(err, errReplayed) {
+		t.Fatalf("the first message again: %v, want errReplayed", err)
+	}
+
+	// bob answers, so alice stops sending the X3DH header
+	a.sessions.mu.Lock()
+	sess, err := a.sessions.get(aliceId)
+	a.sessions.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, ciphertext, err := sess.State.encrypt([]byte("hi"), []byte("answer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := state.decrypt(header, ciphertext, []byte("answer")); err != nil {
+		t.Fatal(err)
+	}
+	if text, err := decrypt(sealFromAlice(t, state, nil, "m2", "how are you")); err != nil || text != "how are you" {
+		t.Fatalf("second message: %q, %v", text, err)
+	}
+
+	// an old first message of another session must not replace the
+	// answered one, the signed prekey is still the same
+	old, oldInit := startSession(t, alice, bob, a.prekeys)
+	if _, err := decrypt(sealFromAlice(t, old, oldInit, "m0", "old")); !errors.Is(err, errReplayed) {
+		t.Fatalf("old first message: %v, want errReplayed", err)
+	}
+	if text, err := decrypt(sealFromAlice(t, state, nil, "m3", "still there")); err != nil || text != "still there" {
+		t.Fatalf("the session was replaced: %q, %v", text, err)
+	}
+}
+
+func TestSessionReceivedIdsAreBounded(t *testing.T) {
+	var sess session
+	for i := 0; i < maxReceivedIds+10; i++ {
+		sess.receive("m" + strconv.Itoa(i))
+	}
+	if len(sess.Received) != maxReceivedIds {
+		t.Fatalf("%d ids kept, want %d", len(sess.Received), maxReceivedIds)
+	}
+	if sess.received("m0") {
+		t.Error("the oldest id is kept")
+	}
+	if !sess.received("m" + strconv.Itoa(maxReceivedIds+9)) {
+		t.Error("the latest id is forgotten")
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	utils "github.com/benni347/messengerutils"
+)
+
+var (
+	errUnsigned         = errors.New("the message is not signed")
+	errInvalidSignature = errors.New("the signature of the message is invalid")
+)
+
+// signedBytes is what the signature of a message covers: all of the
+// envelope as it travels, so after encryption.
+func signedBytes(m Message) []byte {
+	return append(messageAad(m), []byte("\x00"+m.ContentType+"\x00"+m.Message)...)
+}
+
+// signMessage signs the envelope with the Ed25519 key of the sender.
+func signMessage(key ed25519.PrivateKey, msg *Message) {
+	msg.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, signedBytes(*msg)))
+}
+
+// verifyMessage checks the signature of the envelope.
+func verifyMessage(key ed25519.PublicKey, msg Message) error {
+	if msg.Signature == "" {
+		return errUnsigned
+	}
+	signature, err := base64.StdEncoding.DecodeString(msg.Signature)
+	if err != nil || !ed25519.Verify(key, signedBytes(msg), signature) {
+		return errInvalidSignature
+	}
+	return nil
+}
+
+// seal encrypts the message if it goes to a direct room and signs it,
+// if the user is signed in.
+func (a *App) seal(msg *Message) error {
+	if err := a.encrypt(msg); err != nil {
+		return fmt.Errorf("encrypting the message: %w", err)
+	}
+	if id := a.getIdentity(); id != nil && msg.Sender != "" {
+		signMessage(id.signing, msg)
+	}
+	return nil
+}
+
+// verify checks the signature of a received message against the key
+// registered for its sender and records the outcome on the message.
+func (a *App) verify(msg *Message) {
+	msg.Verified = false
+	msg.Warning = ""
+	if msg.Sender == "" {
+		msg.Warning = errUnsigned.Error()
+		return
+	}
+
+	var key ed25519.PublicKey
+	if msg.Sender == a.getSenderId() {
+		if id := a.getIdentity(); id != nil {
+			key = id.signing.Public().(ed25519.PublicKey)
+		}
+	} else {
+		keys, err := a.contactKeys(msg.Sender)
+		if err != nil {
+			msg.Warning = err.Error()
+			return
+		}
+		key = keys.signing
+	}
+	if key == nil {
+		msg.Warning = errNoIdentity.Error()
+		return
+	}
+
+	err := verifyMessage(key, *msg)
+	if err != nil && msg.Sender != a.getSenderId() {
+		// the sender may have new keys since they were fetched
+		keys, refetchErr := a.refetchContactKeys(msg.Sender)
+		if refetchErr != nil {
+			msg.Warning = refetchErr.Error()
+			return
+		}
+		err = verifyMessage(keys.signing, *msg)
+	}
+	if err != nil {
+		utils.PrintError("Unverified message from "+msg.Sender, err)
+		msg.Warning = err.Error()
+		return
+	}
+	msg.Verified = true
+}
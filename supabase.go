@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errNoAccessToken = errors.New("no Supabase access token, sign in first")
+
+// supabaseClient talks to the PostgREST API of the Supabase project
+// on behalf of the signed in user.
+type supabaseClient struct {
+	baseUrl string
+	apiKey  string
+	http    *http.Client
+
+	mu          sync.Mutex
+	accessToken string
+}
+
+func newSupabaseClient(baseUrl, apiKey string) *supabaseClient {
+	return &supabaseClient{
+		baseUrl: strings.TrimRight(baseUrl, "/"),
+		apiKey:  apiKey,
+		http:    &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+func (s *supabaseClient) setAccessToken(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accessToken = token
+}
+
+func (s *supabaseClient) token() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.accessToken
+}
+
+// rest sends a request to the PostgREST endpoint of a table and decodes
+// the JSON response into out, which may be nil.
+func (s *supabaseClient) rest(method, table string, query url.Values, body interface{}, out interface{}, headers map[string]string) error {
+	return s.restAs(s.token(), method, table, query, body, out, headers)
+}
+
+// restAs is rest with another access token than the one of the app,
+// such as the token of a gateway client or of a session the app is not
+// signed in with yet.
+func (s *supabaseClient) restAs(token, method, table string, query url.Values, body interface{}, out interface{}, headers map[string]string) error {
+	if token == "" {
+		return errNoAccessToken
+	}
+
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	endpoint := s.baseUrl + "/rest/v1/" + table
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, endpoint, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("apikey", s.apiKey)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("supabase %s %s: %s: %s", method, table, resp.Status, strings.TrimSpace(string(message)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
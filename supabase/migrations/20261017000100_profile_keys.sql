@@ -0,0 +1,32 @@
+-- Public keys of every user, published by the app after signing in
+-- (keys.go). Anybody signed in may read them, only the user may write
+-- the own row, so nobody can slip other keys under someone's name.
+
+create table if not exists public.profiles (
+  id uuid primary key references auth.users (id) on delete cascade
+);
+
+alter table public.profiles
+  add column if not exists x25519_public_key text,
+  add column if not exists ed25519_public_key text;
+
+alter table public.profiles enable row level security;
+
+drop policy if exists "profiles are readable when signed in" on public.profiles;
+create policy "profiles are readable when signed in"
+  on public.profiles for select
+  to authenticated
+  using (true);
+
+drop policy if exists "users insert their own profile" on public.profiles;
+create policy "users insert their own profile"
+  on public.profiles for insert
+  to authenticated
+  with check (id = auth.uid());
+
+drop policy if exists "users update their own profile" on public.profiles;
+create policy "users update their own profile"
+  on public.profiles for update
+  to authenticated
+  using (id = auth.uid())
+  with check (id = auth.uid());
@@ -0,0 +1,48 @@
+-- Prekeys of the X3DH key agreement (x3dh.go). The signed prekey is kept
+-- in the profile, next to the identity keys it is signed with.
+
+alter table public.profiles
+  add column if not exists signed_prekey text,
+  add column if not exists signed_prekey_id bigint,
+  add column if not exists signed_prekey_signature text;
+
+-- One-time prekeys are used only once: only their owner publishes and
+-- sees them, everybody else claims them through claim_one_time_prekey.
+create table if not exists public.one_time_prekeys (
+  user_id uuid not null references auth.users (id) on delete cascade,
+  key_id bigint not null,
+  public_key text not null,
+  primary key (user_id, key_id)
+);
+
+alter table public.one_time_prekeys enable row level security;
+
+drop policy if exists "users manage their own one-time prekeys" on public.one_time_prekeys;
+create policy "users manage their own one-time prekeys"
+  on public.one_time_prekeys for all
+  to authenticated
+  using (user_id = auth.uid())
+  with check (user_id = auth.uid());
+
+-- claim_one_time_prekey hands out a one-time prekey of the user and
+-- deletes it in the same statement, so two callers never get the same.
+create or replace function public.claim_one_time_prekey(target uuid)
+returns setof public.one_time_prekeys
+language sql
+security definer
+set search_path = public
+as $$
+  delete from public.one_time_prekeys
+  where (user_id, key_id) = (
+    select user_id, key_id
+    from public.one_time_prekeys
+    where user_id = target
+    order by key_id
+    limit 1
+    for update skip locked
+  )
+  returning *;
+$$;
+
+revoke execute on function public.claim_one_time_prekey(uuid) from public, anon;
+grant execute on function public.claim_one_time_prekey(uuid) to authenticated;
@@ -0,0 +1,59 @@
+-- Recovery codes of the second factor (mfa.go). The app shows the codes
+-- once and only stores their hashes: the SHA-256 of the code in upper
+-- case without dashes and spaces, hex encoded (hashRecoveryCode).
+
+create table if not exists public.mfa_recovery_codes (
+  user_id uuid not null references auth.users (id) on delete cascade,
+  code_hash text not null check (code_hash ~ '^[0-9a-f]{64}$'),
+  created_at timestamptz not null default now(),
+  primary key (user_id, code_hash)
+);
+
+alter table public.mfa_recovery_codes enable row level security;
+
+-- Only a session verified with the second factor may read or replace
+-- the codes, a stolen password alone must not reveal or reset them.
+drop policy if exists "users manage their own recovery codes with aal2" on public.mfa_recovery_codes;
+create policy "users manage their own recovery codes with aal2"
+  on public.mfa_recovery_codes for all
+  to authenticated
+  using (user_id = auth.uid() and (auth.jwt() ->> 'aal') = 'aal2')
+  with check (user_id = auth.uid() and (auth.jwt() ->> 'aal') = 'aal2');
+
+-- redeem_mfa_recovery_code is called with the session of the first
+-- factor instead of the code of the second one. If the calling user has
+-- a code with the hash, the code is used up: the codes and the factors
+-- of the user are deleted, so the user signs in with the first factor
+-- from then on and has to enroll again. It answers whether the code was
+-- valid. It runs as its owner, since the session has neither access to
+-- the codes nor to the factors in the auth schema.
+create or replace function public.redeem_mfa_recovery_code(code_hash text)
+returns boolean
+language plpgsql
+security definer
+set search_path = public
+as $$
+declare
+  caller uuid := auth.uid();
+begin
+  if caller is null then
+    return false;
+  end if;
+
+  -- deleting the row makes the code usable only once, concurrent calls
+  -- with the same code wait for each other and only one finds it
+  delete from public.mfa_recovery_codes c
+  where c.user_id = caller
+    and c.code_hash = lower(redeem_mfa_recovery_code.code_hash);
+  if not found then
+    return false;
+  end if;
+
+  delete from public.mfa_recovery_codes c where c.user_id = caller;
+  delete from auth.mfa_factors f where f.user_id = caller;
+  return true;
+end;
+$$;
+
+revoke execute on function public.redeem_mfa_recovery_code(text) from public, anon;
+grant execute on function public.redeem_mfa_recovery_code(text) to authenticated;
@@ -0,0 +1,139 @@
+-- Contacts and contact requests (contacts.go). Every user owns one row
+-- per contact. Adding a contact creates the row of the requester with the
+-- status pending, which the other user answers by setting it to accepted
+-- or declined; accepting also creates the row of the other user.
+
+create table if not exists public.contacts (
+  owner_id uuid not null references auth.users (id) on delete cascade,
+  contact_id uuid not null references auth.users (id) on delete cascade,
+  status text not null default 'pending' check (status in ('pending', 'accepted', 'declined')),
+  nickname text,
+  owner_name text,
+  contact_name text,
+  created_at timestamptz not null default now(),
+  primary key (owner_id, contact_id),
+  check (owner_id <> contact_id)
+);
+
+create index if not exists contacts_contact_id_idx on public.contacts (contact_id, status);
+
+-- contact_user_name is the user name a user signed up with.
+create or replace function public.contact_user_name(target uuid)
+returns text
+language sql
+stable
+security definer
+set search_path = public
+as $$
+  select raw_user_meta_data ->> 'user_name' from auth.users where id = target;
+$$;
+
+revoke execute on function public.contact_user_name(uuid) from public, anon, authenticated;
+
+-- check_contact fills in the user names of every written row from the
+-- accounts, so nobody can choose the name they appear under to someone
+-- else, and keeps both users to their part: the owner may ask or take
+-- back, only the other user may accept or decline a request, and then
+-- only by changing its status.
+create or replace function public.check_contact()
+returns trigger
+language plpgsql
+security definer
+set search_path = public
+as $$
+declare
+  caller uuid := auth.uid();
+begin
+  if tg_op = 'UPDATE' and (new.owner_id <> old.owner_id or new.contact_id <> old.contact_id) then
+    raise exception 'the users of a contact cannot be changed';
+  end if;
+
+  if caller = new.contact_id then
+    -- the other user answers the request
+    if tg_op <> 'UPDATE' or old.status <> 'pending'
+        or new.status not in ('accepted', 'declined')
+        or new.nickname is distinct from old.nickname then
+      raise exception 'only the status of a pending request can be answered';
+    end if;
+  elsif caller = new.owner_id then
+    -- an accepted row needs the accepted row of the other user
+    if new.status = 'declined' and (tg_op = 'INSERT' or old.status <> 'declined') then
+      raise exception 'a request is declined by the user it asks';
+    end if;
+    if new.status = 'accepted' and (tg_op = 'INSERT' or old.status <> 'accepted') and not exists (
+      select 1 from public.contacts other
+      where other.owner_id = new.contact_id
+        and other.contact_id = new.owner_id
+        and other.status = 'accepted'
+    ) then
+      raise exception 'the contact did not accept the request';
+    end if;
+  end if;
+
+  new.owner_name := public.contact_user_name(new.owner_id);
+  new.contact_name := public.contact_user_name(new.contact_id);
+  return new;
+end;
+$$;
+
+drop trigger if exists check_contact on public.contacts;
+create trigger check_contact
+  before insert or update on public.contacts
+  for each row execute function public.check_contact();
+
+alter table public.contacts enable row level security;
+
+drop policy if exists "users see their contacts and requests" on public.contacts;
+create policy "users see their contacts and requests"
+  on public.contacts for select
+  to authenticated
+  using (owner_id = auth.uid() or contact_id = auth.uid());
+
+drop policy if exists "users add their own contacts" on public.contacts;
+create policy "users add their own contacts"
+  on public.contacts for insert
+  to authenticated
+  with check (owner_id = auth.uid());
+
+drop policy if exists "users update their own contacts" on public.contacts;
+create policy "users update their own contacts"
+  on public.contacts for update
+  to authenticated
+  using (owner_id = auth.uid())
+  with check (owner_id = auth.uid());
+
+-- the recipient of a request PATCHes the row of the requester
+drop policy if exists "users answer the requests to them" on public.contacts;
+create policy "users answer the requests to them"
+  on public.contacts for update
+  to authenticated
+  using (contact_id = auth.uid() and status = 'pending')
+  with check (contact_id = auth.uid() and status in ('accepted', 'declined'));
+
+drop policy if exists "users remove their own contacts" on public.contacts;
+create policy "users remove their own contacts"
+  on public.contacts for delete
+  to authenticated
+  using (owner_id = auth.uid());
+
+-- find_user looks up users by their exact user name or email address and
+-- answers with their ids and user names only, so nobody can list the
+-- users or read their addresses. At most two users are returned, enough
+-- to tell that a user name is ambiguous.
+create or replace function public.find_user(query text)
+returns table (id uuid, user_name text)
+language sql
+stable
+security definer
+set search_path = public
+as $$
+  select u.id, u.raw_user_meta_data ->> 'user_name'
+  from auth.users u
+  where lower(u.email) = lower(trim(query))
+     or u.raw_user_meta_data ->> 'user_name' = trim(query)
+  order by u.created_at
+  limit 2;
+$$;
+
+revoke execute on function public.find_user(text) from public, anon;
+grant execute on function public.find_user(text) to authenticated;
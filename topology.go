@@ -0,0 +1,97 @@
+package main
+
+import (
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// All chat messages go through a single topic exchange, the routing key
+// is derived from the chat room. Every user reads from a queue of their
+// own which is bound to the routing keys of all the rooms they belong to,
+// so each participant of a room receives every message sent to it.
+// Users who are not signed in read through a temporary, server named
+// queue that only lives as long as their connection.
+const chatExchange = "messenger.rooms"
+
+// roomRoutingKey is the routing key messages to the room are published with.
+func roomRoutingKey(roomId string) string {
+	return "room." + roomId
+}
+
+// userQueueName is the durable queue a signed in user reads from.
+func userQueueName(userId string) string {
+	return "user." + userId
+}
+
+func declareChatExchange(ch *amqp.Channel) error {
+	return ch.ExchangeDeclare(
+		chatExchange,
+		amqp.ExchangeTopic,
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+}
+
+// declareUserQueue declares the queue of the user and returns its name,
+// an empty user id declares a temporary queue instead.
+func declareUserQueue(ch *amqp.Channel, userId string) (string, error) {
+	if userId == "" {
+		queue, err := ch.QueueDeclare(
+			"",
+			false,
+			true,
+			true,
+			false,
+			nil,
+		)
+		return queue.Name, err
+	}
+	queue, err := ch.QueueDeclare(
+		userQueueName(userId),
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	return queue.Name, err
+}
+
+func bindRoom(ch *amqp.Channel, queueName, roomId string) error {
+	return ch.QueueBind(queueName, roomRoutingKey(roomId), chatExchange, false, nil)
+}
+
+// declareInbox declares the queue of the user, binds it to the rooms
+// and returns its name.
+func declareInbox(ch *amqp.Channel, userId string, rooms []string) (string, error) {
+	if err := declareChatExchange(ch); err != nil {
+		return "", err
+	}
+	queueName, err := declareUserQueue(ch, userId)
+	if err != nil {
+		return "", err
+	}
+	for _, roomId := range rooms {
+		if err := bindRoom(ch, queueName, roomId); err != nil {
+			return "", err
+		}
+	}
+	return queueName, nil
+}
+
+// declareMembers makes sure every member has a queue bound to the room,
+// so nothing is lost before they open the app for the first time.
+func declareMembers(ch *amqp.Channel, roomId string, members []string) error {
+	for _, userId := range members {
+		queueName, err := declareUserQueue(ch, userId)
+		if err != nil {
+			return err
+		}
+		if err := bindRoom(ch, queueName, roomId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// TOTP codes follow RFC 6238 with the parameters every authenticator app
+// supports, which are also the ones Supabase verifies the codes with.
+const (
+	totpIssuer = "Messenger"
+	totpDigits = 6
+	totpPeriod = 30 * time.Second
+	// totpSkew is how many periods a code may be off, the clock of the
+	// phone is not always right.
+	totpSkew = 1
+	// totpQrSize is the width and height of the QR code in pixels.
+	totpQrSize = 256
+)
+
+var errInvalidTotpSecret = errors.New("invalid TOTP secret")
+
+// totp computes the codes of a TOTP secret at the time of its clock.
+type totp struct {
+	secret []byte
+	now    func() time.Time
+}
+
+// newTotp decodes the base32 secret authenticator apps are given.
+func newTotp(secret string, now func() time.Time) (*totp, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+	if err != nil || len(key) == 0 {
+		return nil, errInvalidTotpSecret
+	}
+	return &totp{secret: key, now: now}, nil
+}
+
+// code is the code of the period the time falls into.
+func (t *totp) code(at time.Time) string {
+	return t.hotp(uint64(at.Unix() / int64(totpPeriod/time.Second)))
+}
+
+// hotp is the HOTP code of the counter, RFC 4226.
+func (t *totp) hotp(counter uint64) string {
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], counter)
+	mac := hmac.New(sha1.New, t.secret)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	modulo := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%modulo)
+}
+
+// verify reports whether the code is the one of the current period or
+// of the periods next to it.
+func (t *totp) verify(code string) bool {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != totpDigits {
+		return false
+	}
+	now := t.now()
+	valid := 0
+	for skew := -totpSkew; skew <= totpSkew; skew++ {
+		expected := t.code(now.Add(time.Duration(skew) * totpPeriod))
+		valid |= subtle.ConstantTimeCompare([]byte(expected), []byte(code))
+	}
+	return valid == 1
+}
+
+// totpUri is the otpauth URI authenticator apps add the secret with,
+// https://github.com/google/google-authenticator/wiki/Key-Uri-Format.
+func totpUri(issuer, account, secret string) string {
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(int(totpPeriod / time.Second))},
+	}
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// qrDataUrl encodes the content as a QR code, a PNG image in a data URL
+// the frontend can show as it is.
+func qrDataUrl(content string) (string, error) {
+	png, err := qrcode.Encode(content, qrcode.Medium, totpQrSize)
+	if err != nil {
+		return "", err
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(png), nil
+}
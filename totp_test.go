@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 secret of RFC 6238 Appendix B,
+// "12345678901234567890" in base32.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTotpRfc6238Vectors(t *testing.T) {
+	// the appendix lists eight digits, the app uses the last six
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tc := range tests {
+		now := time.Unix(tc.unix, 0)
+		secret, err := newTotp(rfc6238Secret, func() time.Time { return now })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := secret.code(now); got != tc.code {
+			t.Errorf("code at %d = %s, want %s", tc.unix, got, tc.code)
+		}
+		if !secret.verify(tc.code) {
+			t.Errorf("code %s not accepted at %d", tc.code, tc.unix)
+		}
+	}
+}
+
+func TestTotpVerifySkew(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	secret, err := newTotp(rfc6238Secret, func() time.Time { return now })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, periods := range []int{-1, 1} {
+		code := secret.code(now.Add(time.Duration(periods) * totpPeriod))
+		if !secret.verify(code) {
+			t.Errorf("the code %d periods off is refused", periods)
+		}
+	}
+	for _, periods := range []int{-2, 2} {
+		code := secret.code(now.Add(time.Duration(periods) * totpPeriod))
+		if secret.verify(code) {
+			t.Errorf("the code %d periods off is accepted", periods)
+		}
+	}
+	for _, code := range []string{"", "08180", "0818041", "abcdef"} {
+		if secret.verify(code) {
+			t.Errorf("%q is accepted", code)
+		}
+	}
+	if !secret.verify("081 804") {
+		t.Error("a code with a space is refused")
+	}
+}
+
+func TestNewTotpRejectsInvalidSecrets(t *testing.T) {
+	for _, secret := range []string{"", "not base32!", "===="} {
+		if _, err := newTotp(secret, time.Now); !errors.Is(err, errInvalidTotpSecret) {
+			t.Errorf("%q: %v", secret, err)
+		}
+	}
+	// authenticator apps show secrets in groups and lower case
+	if _, err := newTotp("gezd gnbv gy3t qojq gezd gnbv gy3t qojq", time.Now); err != nil {
+		t.Errorf("grouped secret: %v", err)
+	}
+}
+
+func TestTotpUri(t *testing.T) {
+	uri := totpUri("Messenger", "ada@example.com", rfc6238Secret)
+	u, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" {
+		t.Errorf("%s is no otpauth://totp URI", uri)
+	}
+	if u.Path != "/Messenger:ada@example.com" {
+		t.Errorf("label %q, want the issuer and the account", u.Path)
+	}
+	want := url.Values{
+		"secret":    {rfc6238Secret},
+		"issuer":    {"Messenger"},
+		"algorithm": {"SHA1"},
+		"digits":    {"6"},
+		"period":    {"30"},
+	}
+	query := u.Query()
+	for key, values := range want {
+		if query.Get(key) != values[0] {
+			t.Errorf("%s = %q, want %q", key, query.Get(key), values[0])
+		}
+	}
+	if len(query) != len(want) {
+		t.Errorf("query %v has unexpected parameters", query)
+	}
+
+	// spaces in the label are escaped, not turned into +
+	if uri := totpUri("My Messenger", "Ada Lovelace", rfc6238Secret); !strings.Contains(uri, "/My%20Messenger:Ada%20Lovelace?") {
+		t.Errorf("label of %s is not path escaped", uri)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import "errors"
+
+const (
+	// brokerStatusEvent is emitted with a BrokerStatus whenever the
+	// connection to a broker was established or lost.
+	brokerStatusEvent = "broker:status"
+
+	// The transports the app can use, see Config.Transport.
+	transportAmqp   = "amqp"
+	transportMqtt   = "mqtt"
+	transportMemory = "memory"
+)
+
+var errUnknownTransport = errors.New("unknown transport")
+
+// Transport moves messages between the users of the chat rooms. Every
+// user has an inbox that receives the messages of all the rooms they
+// belong to, so messages sent while they are offline wait for them.
+type Transport interface {
+	// Connect connects in the background and keeps reconnecting
+	// whenever the connection is lost, until Close is called.
+	Connect()
+	// Publish sends the message to everyone in its chat room, making sure
+	// the inboxes of the members receive the room. The returned channel
+	// yields nil once the broker took over the message, or why it did not.
+	Publish(msg Message, members []string) (<-chan error, error)
+	// Subscribe hands every message arriving in the inbox of the user to
+	// handle, until cancel is called. rooms returns the rooms the inbox
+	// has to receive whenever it is set up. An empty user id subscribes
+	// to a temporary inbox that only lives as long as the subscription.
+	Subscribe(userId string, rooms func() []string, handle func(Message)) (cancel func())
+	// Join makes the inbox of the running subscription receive the room.
+	Join(roomId string) error
+	// Leave stops delivering the room to the inbox of the user, an empty
+	// user id means the temporary inbox of the running subscription.
+	Leave(userId, roomId string) error
+	// Status reports whether the transport is connected and to what.
+	Status() BrokerStatus
+	// OnStatus registers a function that is called with the new status
+	// every time the connection was established or lost.
+	OnStatus(func(BrokerStatus))
+	// Close disconnects and stops reconnecting.
+	Close()
+}
+
+// BrokerStatus tells which broker the app is connected to.
+type BrokerStatus struct {
+	Connected bool   `json:"connected"`
+	Blocked   bool   `json:"blocked"`
+	Broker    string `json:"broker"`
+}
+
+// newTransport creates the transport the config asks for.
+func newTransport(c Config, verbose bool) (Transport, error) {
+	switch c.Transport {
+	case transportAmqp, "":
+		endpoints, err := brokerEndpoints(c)
+		if err != nil {
+			return nil, err
+		}
+		return newAmqpTransport(endpoints, c.RabbitMqFailover == failoverRandom, verbose), nil
+	case transportMqtt:
+		t, err := newMqttTransport(c)
+		if err != nil {
+			return nil, err
+		}
+		return t, nil
+	case transportMemory:
+		return newMemoryBroker().transport(), nil
+	}
+	return nil, errUnknownTransport
+}
+
+// GetBrokerStatus tells whether the app is connected
+// and which of the configured brokers it uses
+func (a *App) GetBrokerStatus() BrokerStatus {
+	if a.transport == nil {
+		return BrokerStatus{}
+	}
+	return a.transport.Status()
+}
+
+// emitBrokerStatus reports a change of the connection to the frontend.
+func (a *App) emitBrokerStatus(status BrokerStatus) {
+	a.emit(brokerStatusEvent, status)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// contactKeyChangedEvent is emitted with a KeyChange when the keys a
+	// contact publishes no longer match the ones that were trusted before.
+	contactKeyChangedEvent = "contact:key-changed"
+	// verifiedKeyChangedEvent is emitted instead of contactKeyChangedEvent
+	// when the user had verified the safety number of the contact.
+	verifiedKeyChangedEvent = "contact:verified-key-changed"
+)
+
+var errKeyChanged = errors.New("the keys of the contact changed, confirm them before sending")
+
+// KeyChange is the payload of the contactKeyChangedEvent.
+type KeyChange struct {
+	UserId string `json:"userId"`
+}
+
+// trustEntry are the keys of a contact as they were first seen,
+// or as the user last confirmed them. Verified is set once the user
+// compared the safety number with the contact.
+type trustEntry struct {
+	X25519    string `json:"x25519"`
+	Ed25519   string `json:"ed25519"`
+	FirstSeen string `json:"firstSeen"`
+	Verified  bool   `json:"verified,omitempty"`
+}
+
+// trustStore pins the keys of every contact on first use, so a key
+// the server hands out later can be told apart from the known one.
+type trustStore struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]trustEntry
+}
+
+// loadTrustStore reads the trust store of the signed in user.
+func loadTrustStore(userId string) (*trustStore, error) {
+	dir, err := configDir()
+	if err != nil {
+		return nil, err
+	}
+	t := &trustStore{
+		path:    filepath.Join(dir, "trust-"+userId+".json"),
+		entries: make(map[string]trustEntry),
+	}
+	data, err := os.ReadFile(t.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &t.entries); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *trustStore) save() error {
+	data, err := json.MarshalIndent(t.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writePrivateFile(t.path, data)
+}
+
+// check compares the keys with the pinned ones and reports whether they
+// changed. Keys of contacts seen for the first time are pinned.
+func (t *trustStore) check(keys profileKeys) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entry, ok := t.entries[keys.Id]
+	if ok {
+		return entry.X25519 != keys.X25519PublicKey || entry.Ed25519 != keys.Ed25519PublicKey, nil
+	}
+	t.entries[keys.Id] = trustEntry{
+		X25519:    keys.X25519PublicKey,
+		Ed25519:   keys.Ed25519PublicKey,
+		FirstSeen: time.Now().UTC().Format(time.RFC3339),
+	}
+	return false, t.save()
+}
+
+// trust pins the keys, replacing the ones known before.
+func (t *trustStore) trust(keys profileKeys) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries[keys.Id] = trustEntry{
+		X25519:    keys.X25519PublicKey,
+		Ed25519:   keys.Ed25519PublicKey,
+		FirstSeen: time.Now().UTC().Format(time.RFC3339),
+	}
+	return t.save()
+}
+
+// verify marks the contact as verified, as long as the keys are still
+// the pinned ones.
+func (t *trustStore) verify(keys profileKeys) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entry, ok := t.entries[keys.Id]
+	if !ok || entry.X25519 != keys.X25519PublicKey || entry.Ed25519 != keys.Ed25519PublicKey {
+		return errKeyChanged
+	}
+	entry.Verified = true
+	t.entries[keys.Id] = entry
+	return t.save()
+}
+
+// isVerified reports whether the user verified the contact.
+func (t *trustStore) isVerified(userId string) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.entries[userId].Verified
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The initial key agreement of a session follows X3DH
+// (https://signal.org/docs/specifications/x3dh/): every user publishes a
+// signed prekey in their profile and a stock of one-time prekeys in the
+// oneTimePrekeysTable, the first message of a session carries what the
+// receiver needs to derive the same secret.
+
+const (
+	// oneTimePrekeysTable holds the one-time prekeys of all users,
+	// only their owner can read them.
+	oneTimePrekeysTable = "one_time_prekeys"
+	// claimOneTimePrekeyRpc is a database function that deletes one of
+	// the one-time prekeys of a user and answers with it, so no prekey
+	// is handed out twice.
+	claimOneTimePrekeyRpc = "rpc/claim_one_time_prekey"
+	// oneTimePrekeyCount is how many one-time prekeys are kept published.
+	oneTimePrekeyCount = 50
+	// signedPrekeyContext is prepended to the signed prekey when signing it.
+	signedPrekeyContext = "messenger signed prekey\x00"
+	// signedPrekeyRotation is how long a signed prekey is published before
+	// it is replaced by a new one.
+	signedPrekeyRotation = 7 * 24 * time.Hour
+	// signedPrekeyGrace is how long a replaced signed prekey is kept, for
+	// first messages that were sent before the new one was published.
+	signedPrekeyGrace = 30 * 24 * time.Hour
+)
+
+var (
+	errNoSignedPrekey       = errors.New("the user has not published a signed prekey yet")
+	errInvalidPrekey        = errors.New("the signature of the signed prekey is invalid")
+	errUnknownSignedPrekey  = errors.New("unknown signed prekey")
+	errUnknownOneTimePrekey = errors.New("unknown or already used one-time prekey")
+)
+
+// x3dhHeader is sent along with the messages of a new session until the
+// peer answered, so the peer can set up its side of the session.
+type x3dhHeader struct {
+	EphemeralKey    []byte  `json:"ek"`
+	SignedPrekeyId  uint32  `json:"spk"`
+	OneTimePrekeyId *uint32 `json:"opk,omitempty"`
+}
+
+// profilePrekey is the part of a Supabase profile that holds the signed prekey.
+type profilePrekey struct {
+	Id                    string `json:"id"`
+	SignedPrekey          string `json:"signed_prekey"`
+	SignedPrekeyId        uint32 `json:"signed_prekey_id"`
+	SignedPrekeySignature string `json:"signed_prekey_signature"`
+}
+
+// oneTimePrekeyRow is a row of the oneTimePrekeysTable.
+type oneTimePrekeyRow struct {
+	UserId    string `json:"user_id"`
+	KeyId     uint32 `json:"key_id"`
+	PublicKey string `json:"public_key"`
+}
+
+// prekeyBundle is what an initiator needs to start a session with a user.
+type prekeyBundle struct {
+	identity        contactKeys
+	signedPrekeyId  uint32
+	signedPrekey    []byte
+	oneTimePrekeyId *uint32
+	oneTimePrekey   []byte
+}
+
+// prekeyStore keeps the private prekeys of the signed in user on disk.
+type prekeyStore struct {
+	path string
+
+	mu   sync.Mutex
+	file prekeyFile
+}
+
+type prekeyFile struct {
+	SignedPrekeyId      uint32                   `json:"signedPrekeyId"`
+	SignedPrekey        []byte                   `json:"signedPrekey"`
+	SignedPrekeyCreated time.Time                `json:"signedPrekeyCreated"`
+	RetiredPrekeys      map[uint32]retiredPrekey `json:"retiredPrekeys,omitempty"`
+	OneTimePrekeys      map[uint32][]byte        `json:"oneTimePrekeys"`
+	NextId              uint32                   `json:"nextId"`
+	// PublishedId is the highest id of the uploaded one-time prekeys.
+	// The ids only grow, so every key up to it was uploaded once and is
+	// never uploaded again: a key a peer claimed is gone on the server
+	// but kept here until its first message arrives.
+	PublishedId uint32 `json:"publishedId"`
+}
+
+// retiredPrekey is a replaced signed prekey within its grace period.
+type retiredPrekey struct {
+	Key     []byte    `json:"key"`
+	Retired time.Time `json:"retired"`
+}
+
+// loadPrekeyStore reads the prekeys of the user, creating the signed
+// prekey and topping up the one-time prekeys as needed.
+func loadPrekeyStore(userId string) (*prekeyStore, error) {
+	dir, err := configDir()
+	if err != nil {
+		return nil, err
+	}
+	p := &prekeyStore{path: filepath.Join(dir, "prekeys-"+userId+".json")}
+	data, err := os.ReadFile(p.path)
+	if err == nil {
+		if err := json.Unmarshal(data, &p.file); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", p.path, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if p.file.OneTimePrekeys == nil {
+		p.file.OneTimePrekeys = make(map[uint32][]byte)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.rotate(time.Now()); err != nil {
+		return nil, err
+	}
+	if err := p.refill(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// refill generates one-time prekeys until there are enough of them.
+func (p *prekeyStore) refill() error {
+	for len(p.file.OneTimePrekeys) < oneTimePrekeyCount {
+		key, err := generateRatchetKey()
+		if err != nil {
+			return err
+		}
+		p.file.NextId++
+		p.file.OneTimePrekeys[p.file.NextId] = key
+	}
+	return p.save()
+}
+
+// rotate replaces the signed prekey once it is older than
+// signedPrekeyRotation, or creates the first one, and forgets the retired
+// ones past their grace period. The caller must hold the lock.
+func (p *prekeyStore) rotate(now time.Time) error {
+	changed := false
+	for id, retired := range p.file.RetiredPrekeys {
+		if now.Sub(retired.Retired) >= signedPrekeyGrace {
+			delete(p.file.RetiredPrekeys, id)
+			changed = true
+		}
+	}
+	if p.file.SignedPrekey == nil || now.Sub(p.file.SignedPrekeyCreated) >= signedPrekeyRotation {
+		key, err := generateRatchetKey()
+		if err != nil {
+			return err
+		}
+		if p.file.SignedPrekey != nil {
+			if p.file.RetiredPrekeys == nil {
+				p.file.RetiredPrekeys = make(map[uint32]retiredPrekey)
+			}
+			p.file.RetiredPrekeys[p.file.SignedPrekeyId] = retiredPrekey{Key: p.file.SignedPrekey, Retired: now}
+		}
+		p.file.NextId++
+		p.file.SignedPrekeyId = p.file.NextId
+		p.file.SignedPrekey = key
+		p.file.SignedPrekeyCreated = now
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return p.save()
+}
+
+func (p *prekeyStore) save() error {
+	data, err := json.Marshal(p.file)
+	if err != nil {
+		return err
+	}
+	return writePrivateFile(p.path, data)
+}
+
+func (p *prekeyStore) signedPrekey(id uint32) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if id == p.file.SignedPrekeyId {
+		return p.file.SignedPrekey, nil
+	}
+	retired, ok := p.file.RetiredPrekeys[id]
+	if !ok || time.Since(retired.Retired) >= signedPrekeyGrace {
+		return nil, errUnknownSignedPrekey
+	}
+	return retired.Key, nil
+}
+
+func (p *prekeyStore) oneTimePrekey(id uint32) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key, ok := p.file.OneTimePrekeys[id]
+	if !ok {
+		return nil, errUnknownOneTimePrekey
+	}
+	return key, nil
+}
+
+// useOneTimePrekey deletes a one-time prekey once a session was set up
+// with it and generates a replacement.
+func (p *prekeyStore) useOneTimePrekey(id uint32) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.file.OneTimePrekeys, id)
+	return p.refill()
+}
+
+// publish uploads the signed prekey and the one-time prekeys that were
+// not uploaded yet, after rotating the signed prekey if it is due.
+func (p *prekeyStore) publish(s *supabaseClient, userId string, signing ed25519.PrivateKey) error {
+	p.mu.Lock()
+	if err := p.rotate(time.Now()); err != nil {
+		p.mu.Unlock()
+		return err
+	}
+	spk, err := ratchetPublic(p.file.SignedPrekey)
+	if err != nil {
+		p.mu.Unlock()
+		return err
+	}
+	profile := profilePrekey{
+		Id:                    userId,
+		SignedPrekey:          base64.StdEncoding.EncodeToString(spk),
+		SignedPrekeyId:        p.file.SignedPrekeyId,
+		SignedPrekeySignature: base64.StdEncoding.EncodeToString(ed25519.Sign(signing, append([]byte(signedPrekeyContext), spk...))),
+	}
+	var rows []oneTimePrekeyRow
+	published := p.file.PublishedId
+	for id, key := range p.file.OneTimePrekeys {
+		if id <= p.file.PublishedId {
+			continue
+		}
+		if id > published {
+			published = id
+		}
+		pub, err := ratchetPublic(key)
+		if err != nil {
+			p.mu.Unlock()
+			return err
+		}
+		rows = append(rows, oneTimePrekeyRow{
+			UserId:    userId,
+			KeyId:     id,
+			PublicKey: base64.StdEncoding.EncodeToString(pub),
+		})
+	}
+	p.mu.Unlock()
+
+	upsert := map[string]string{"Prefer": "resolution=merge-duplicates,return=minimal"}
+	if err := s.rest("POST", profilesTable, url.Values{"on_conflict": {"id"}}, profile, nil, upsert); err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	if err := s.rest("POST", oneTimePrekeysTable, url.Values{"on_conflict": {"user_id,key_id"}}, rows, nil, upsert); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if published <= p.file.PublishedId {
+		return nil
+	}
+	p.file.PublishedId = published
+	return p.save()
+}
+
+// fetchPrekeyBundle collects what is needed to start a session with the
+// user and claims one of their one-time prekeys, if any are left.
+func (s *supabaseClient) fetchPrekeyBundle(userId string, keys contactKeys) (prekeyBundle, error) {
+	var profiles []profilePrekey
+	err := s.rest(
+		"GET",
+		profilesTable,
+		url.Values{
+			"id":     {"eq." + userId},
+			"select": {"id,signed_prekey,signed_prekey_id,signed_prekey_signature"},
+		},
+		nil,
+		&profiles,
+		nil,
+	)
+	if err != nil {
+		return prekeyBundle{}, err
+	}
+	if len(profiles) == 0 || profiles[0].SignedPrekey == "" {
+		return prekeyBundle{}, errNoSignedPrekey
+	}
+	spk, err := base64.StdEncoding.DecodeString(profiles[0].SignedPrekey)
+	if err != nil {
+		return prekeyBundle{}, errInvalidPrekey
+	}
+	signature, err := base64.StdEncoding.DecodeString(profiles[0].SignedPrekeySignature)
+	if err != nil || !ed25519.Verify(keys.signing, append([]byte(signedPrekeyContext), spk...), signature) {
+		return prekeyBundle{}, errInvalidPrekey
+	}
+	bundle := prekeyBundle{
+		identity:       keys,
+		signedPrekeyId: profiles[0].SignedPrekeyId,
+		signedPrekey:   spk,
+	}
+
+	var rows []oneTimePrekeyRow
+	err = s.rest("POST", claimOneTimePrekeyRpc, nil, map[string]string{"target": userId}, &rows, nil)
+	if err != nil || len(rows) == 0 {
+		// X3DH works without a one-time prekey, it is only weaker
+		return bundle, nil
+	}
+	if opk, err := base64.StdEncoding.DecodeString(rows[0].PublicKey); err == nil {
+		id := rows[0].KeyId
+		bundle.oneTimePrekeyId = &id
+		bundle.oneTimePrekey = opk
+	}
+	return bundle, nil
+}
+
+// x3dhSecret derives the shared secret from the concatenated DH outputs.
+func x3dhSecret(dhs ...[]byte) []byte {
+	ikm := make([]byte, 32)
+	for i := range ikm {
+		ikm[i] = 0xff
+	}
+	for _, out := range dhs {
+		ikm = append(ikm, out...)
+	}
+	return hkdfSha256(ikm, nil, []byte("messenger x3dh"), 32)
+}
+
+// x3dhAssociatedData binds both identities to every message of the session.
+func x3dhAssociatedData(initiator, responder *ecdh.PublicKey) []byte {
+	return append(append([]byte{}, initiator.Bytes()...), responder.Bytes()...)
+}
+
+// x3dhInitiate runs the initiator side of X3DH.
+func x3dhInitiate(own *identity, bundle prekeyBundle) ([]byte, x3dhHeader, error) {
+	ek, err := generateRatchetKey()
+	if err != nil {
+		return nil, x3dhHeader{}, err
+	}
+	dh1, err := dh(own.exchange.Bytes(), bundle.signedPrekey)
+	if err != nil {
+		return nil, x3dhHeader{}, err
+	}
+	dh2, err := dh(ek, bundle.identity.exchange.Bytes())
+	if err != nil {
+		return nil, x3dhHeader{}, err
+	}
+	dh3, err := dh(ek, bundle.signedPrekey)
+	if err != nil {
+		return nil, x3dhHeader{}, err
+	}
+	outputs := [][]byte{dh1, dh2, dh3}
+	if bundle.oneTimePrekey != nil {
+		dh4, err := dh(ek, bundle.oneTimePrekey)
+		if err != nil {
+			return nil, x3dhHeader{}, err
+		}
+		outputs = append(outputs, dh4)
+	}
+	ekPub, err := ratchetPublic(ek)
+	if err != nil {
+		return nil, x3dhHeader{}, err
+	}
+	return x3dhSecret(outputs...), x3dhHeader{
+		EphemeralKey:    ekPub,
+		SignedPrekeyId:  bundle.signedPrekeyId,
+		OneTimePrekeyId: bundle.oneTimePrekeyId,
+	}, nil
+}
+
+// x3dhRespond runs the responder side of X3DH and returns the secret
+// together with the signed prekey, which is the first ratchet key.
+func x3dhRespond(own *identity, prekeys *prekeyStore, peer *ecdh.PublicKey, init x3dhHeader) ([]byte, []byte, error) {
+	spk, err := prekeys.signedPrekey(init.SignedPrekeyId)
+	if err != nil {
+		return nil, nil, err
+	}
+	dh1, err := dh(spk, peer.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	dh2, err := dh(own.exchange.Bytes(), init.EphemeralKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	dh3, err := dh(spk, init.EphemeralKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	outputs := [][]byte{dh1, dh2, dh3}
+	if init.OneTimePrekeyId != nil {
+		opk, err := prekeys.oneTimePrekey(*init.OneTimePrekeyId)
+		if err != nil {
+			return nil, nil, err
+		}
+		dh4, err := dh(opk, init.EphemeralKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		outputs = append(outputs, dh4)
+	}
+	return x3dhSecret(outputs...), spk, nil
+}
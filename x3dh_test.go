@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func fixedIdentity(t *testing.T, exchange, signing byte) *identity {
+	t.Helper()
+	key, err := ecdh.X25519().NewPrivateKey(fixedKey(exchange))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &identity{exchange: key, signing: ed25519.NewKeyFromSeed(fixedKey(signing))}
+}
+
+// fixedPrekeys are the prekeys of bob, the signed prekey 1 and the
+// one-time prekey 2.
+func fixedPrekeys() *prekeyStore {
+	return &prekeyStore{file: prekeyFile{
+		SignedPrekeyId:      1,
+		SignedPrekey:        fixedKey(11),
+		SignedPrekeyCreated: time.Now(),
+		OneTimePrekeys:      map[uint32][]byte{2: fixedKey(12)},
+		NextId:              2,
+	}}
+}
+
+func TestX3dhVectors(t *testing.T) {
+	alice := fixedIdentity(t, 9, 13)
+	bob := fixedIdentity(t, 7, 8)
+	ek, err := ratchetPublic(fixedKey(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opk := uint32(2)
+	tests := []struct {
+		name string
+		init x3dhHeader
+		want string
+	}{
+		{
+			"with a one-time prekey",
+			x3dhHeader{EphemeralKey: ek, SignedPrekeyId: 1, OneTimePrekeyId: &opk},
+			"89e6adb44cedf3fdacc1f0c5906280f8d45d8b531f933d730916496caab06c8b",
+		},
+		{
+			"without a one-time prekey",
+			x3dhHeader{EphemeralKey: ek, SignedPrekeyId: 1},
+			"5b03af0e4bc5718276b8b4dd59ed4a9a978c8a8a1b793449600b455e3e9b331e",
+		},
+	}
+	for _, tc := range tests {
+		sk, spk, err := x3dhRespond(bob, fixedPrekeys(), alice.exchange.PublicKey(), tc.init)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !bytes.Equal(sk, mustHex(t, tc.want)) {
+			t.Errorf("%s: secret = %x", tc.name, sk)
+		}
+		if !bytes.Equal(spk, fixedKey(11)) {
+			t.Errorf("%s: the signed prekey is not the first ratchet key", tc.name)
+		}
+	}
+}
+
+// bundleOf is the bundle bob publishes with his prekeys.
+func bundleOf(t *testing.T, bob *identity, prekeys *prekeyStore, withOneTimePrekey bool) prekeyBundle {
+	t.Helper()
+	spk, err := ratchetPublic(prekeys.file.SignedPrekey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle := prekeyBundle{
+		identity:       contactKeys{exchange: bob.exchange.PublicKey(), signing: bob.signing.Public().(ed25519.PublicKey)},
+		signedPrekeyId: prekeys.file.SignedPrekeyId,
+		signedPrekey:   spk,
+	}
+	if withOneTimePrekey {
+		for id, key := range prekeys.file.OneTimePrekeys {
+			if bundle.oneTimePrekey, err = ratchetPublic(key); err != nil {
+				t.Fatal(err)
+			}
+			id := id
+			bundle.oneTimePrekeyId = &id
+		}
+	}
+	return bundle
+}
+
+func TestX3dhAgreement(t *testing.T) {
+	alice := fixedIdentity(t, 9, 13)
+	bob := fixedIdentity(t, 7, 8)
+	for _, withOneTimePrekey := range []bool{true, false} {
+		prekeys := fixedPrekeys()
+		bundle := bundleOf(t, bob, prekeys, withOneTimePrekey)
+		initiator, init, err := x3dhInitiate(alice, bundle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (init.OneTimePrekeyId != nil) != withOneTimePrekey {
+			t.Fatalf("one-time prekey %v in the header, want %v", init.OneTimePrekeyId, withOneTimePrekey)
+		}
+		responder, spk, err := x3dhRespond(bob, prekeys, alice.exchange.PublicKey(), init)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(initiator, responder) {
+			t.Fatalf("one-time prekey %v: the secrets differ", withOneTimePrekey)
+		}
+
+		// the secret starts a working session
+		ad := x3dhAssociatedData(alice.exchange.PublicKey(), bob.exchange.PublicKey())
+		sender, err := newInitiatorRatchet(initiator, bundle.signedPrekey, ad)
+		if err != nil {
+			t.Fatal(err)
+		}
+		receive(t, newResponderRatchet(responder, spk, ad), send(t, sender, "hello"), "hello")
+	}
+}
+
+func TestX3dhRejectsUnknownPrekeys(t *testing.T) {
+	alice := fixedIdentity(t, 9, 13)
+	bob := fixedIdentity(t, 7, 8)
+	ek, err := ratchetPublic(fixedKey(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = x3dhRespond(bob, fixedPrekeys(), alice.exchange.PublicKey(), x3dhHeader{EphemeralKey: ek, SignedPrekeyId: 7})
+	if !errors.Is(err, errUnknownSignedPrekey) {
+		t.Errorf("unknown signed prekey: %v", err)
+	}
+	opk := uint32(3)
+	_, _, err = x3dhRespond(bob, fixedPrekeys(), alice.exchange.PublicKey(), x3dhHeader{EphemeralKey: ek, SignedPrekeyId: 1, OneTimePrekeyId: &opk})
+	if !errors.Is(err, errUnknownOneTimePrekey) {
+		t.Errorf("unknown one-time prekey: %v", err)
+	}
+}
+
+func TestSignedPrekeyRotation(t *testing.T) {
+	prekeys := fixedPrekeys()
+	prekeys.path = filepath.Join(t.TempDir(), "prekeys.json")
+	created := prekeys.file.SignedPrekeyCreated
+
+	if err := prekeys.rotate(created.Add(signedPrekeyRotation - time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if prekeys.file.SignedPrekeyId != 1 {
+		t.Fatalf("rotated before signedPrekeyRotation")
+	}
+
+	rotated := created.Add(signedPrekeyRotation)
+	if err := prekeys.rotate(rotated); err != nil {
+		t.Fatal(err)
+	}
+	if prekeys.file.SignedPrekeyId != 3 || bytes.Equal(prekeys.file.SignedPrekey, fixedKey(11)) {
+		t.Fatalf("not rotated after signedPrekeyRotation")
+	}
+	// first messages sent to the old signed prekey still arrive
+	if spk, err := prekeys.signedPrekey(1); err != nil || !bytes.Equal(spk, fixedKey(11)) {
+		t.Fatalf("the retired signed prekey is gone within the grace period: %v", err)
+	}
+
+	if err := prekeys.rotate(rotated.Add(signedPrekeyGrace)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := prekeys.file.RetiredPrekeys[1]; ok {
+		t.Fatal("the retired signed prekey is kept after the grace period")
+	}
+	if _, err := prekeys.signedPrekey(1); !errors.Is(err, errUnknownSignedPrekey) {
+		t.Fatalf("the expired signed prekey is still used: %v", err)
+	}
+}
+
+func TestPublishUploadsOneTimePrekeysOnce(t *testing.T) {
+	var uploads [][]oneTimePrekeyRow
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/rest/v1/"+oneTimePrekeysTable {
+			var rows []oneTimePrekeyRow
+			data, _ := io.ReadAll(r.Body)
+			if err := json.Unmarshal(data, &rows); err != nil {
+				t.Error(err)
+			}
+			uploads = append(uploads, rows)
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	s := newSupabaseClient(server.URL, "anon-key")
+	s.setAccessToken("access")
+	bob := fixedIdentity(t, 7, 8)
+	prekeys := fixedPrekeys()
+	prekeys.path = filepath.Join(t.TempDir(), "prekeys.json")
+
+	if err := prekeys.publish(s, "bob", bob.signing); err != nil {
+		t.Fatal(err)
+	}
+	if len(uploads) != 1 || len(uploads[0]) != 1 || uploads[0][0].KeyId != 2 {
+		t.Fatalf("uploads %+v, want the one-time prekey 2", uploads)
+	}
+
+	// a peer claimed the key on the server, it stays here until the
+	// first message of the peer arrives and must not be handed out again
+	if err := prekeys.publish(s, "bob", bob.signing); err != nil {
+		t.Fatal(err)
+	}
+	if len(uploads) != 1 {
+		t.Fatalf("the published one-time prekeys were uploaded again: %+v", uploads[1:])
+	}
+
+	if err := prekeys.useOneTimePrekey(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := prekeys.publish(s, "bob", bob.signing); err != nil {
+		t.Fatal(err)
+	}
+	if len(uploads) != 2 || len(uploads[1]) != oneTimePrekeyCount {
+		t.Fatalf("uploads %+v, want the new one-time prekeys", uploads)
+	}
+	for _, row := range uploads[1] {
+		if row.KeyId <= 2 {
+			t.Errorf("the key %d was uploaded again", row.KeyId)
+		}
+	}
+}